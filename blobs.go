@@ -103,6 +103,13 @@ type BlobDescriptorService interface {
 	Clear(ctx context.Context, dgst digest.Digest) error
 }
 
+// BlobDescriptorSetter is implemented by blob services which can record the
+// descriptor of a blob they hold, such as one carrying a media type detected
+// from the content of the blob. The blob must be known to the service.
+type BlobDescriptorSetter interface {
+	SetDescriptor(ctx context.Context, dgst digest.Digest, desc v1.Descriptor) error
+}
+
 // BlobDescriptorServiceFactory creates middleware for BlobDescriptorService.
 type BlobDescriptorServiceFactory interface {
 	BlobAccessController(svc BlobDescriptorService) BlobDescriptorService
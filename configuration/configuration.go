@@ -83,6 +83,27 @@ type Repository struct {
 	// If this field is non-empty, the registry enforces that all uploaded
 	// content belongs to one of the specified classes.
 	Classes []string `yaml:"classes"`
+
+	// Partitions configures the partitions of 2dfs images served by
+	// default to the clients which cannot unpack 2dfs fields. The first
+	// policy matching the repository applies.
+	Partitions []PartitionPolicy `yaml:"partitions,omitempty"`
+}
+
+// PartitionPolicy defines the default partitions of the 2dfs images in a set
+// of repositories. They apply to the plain tag pulls of clients which do not
+// advertise 2dfs support, by listing the 2dfs field media type in their
+// Accept header.
+type PartitionPolicy struct {
+	// Repository is the pattern, in the path.Match syntax, of the names of
+	// the repositories the policy applies to. An empty pattern matches every
+	// repository.
+	Repository string `yaml:"repository,omitempty"`
+
+	// Default is the partition set served by default, following the grammar
+	// of semantic tags without the leading tag, e.g. "0.0.*.*" for every
+	// allotment or "0.0.1.1" for the first two rows and columns.
+	Default string `yaml:"default"`
 }
 
 // Catalog provides configuration options for the /v2/_catalog endpoint.
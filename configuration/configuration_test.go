@@ -380,6 +380,27 @@ func (suite *ConfigSuite) TestParseInvalidVersion() {
 	suite.Require().Error(err)
 }
 
+// TestParsePartitionPolicy validates that the default partitions of 2dfs
+// images are parsed per repository.
+func (suite *ConfigSuite) TestParsePartitionPolicy() {
+	yml := configYamlV0_1 + `
+policy:
+  repository:
+    partitions:
+      - repository: library/*
+        default: r0
+      - default: 0.0.*.*
+`
+	suite.expectedConfig.Policy.Repository.Partitions = []PartitionPolicy{
+		{Repository: "library/*", Default: "r0"},
+		{Default: "0.0.*.*"},
+	}
+
+	config, err := Parse(bytes.NewReader([]byte(yml)))
+	suite.Require().NoError(err)
+	suite.Require().Equal(suite.expectedConfig, config)
+}
+
 // TestParseExtraneousVars validates that environment variables referring to
 // nonexistent variables don't cause side effects.
 func (suite *ConfigSuite) TestParseExtraneousVars() {
@@ -24,6 +24,14 @@ var ErrUnsupported = errors.New("operation unsupported")
 // manifest but the registry is configured to reject it
 var ErrSchemaV1Unsupported = errors.New("manifest schema v1 unsupported")
 
+// ErrPartitionUnknown is returned when no derived manifest has been recorded
+// for a source manifest and partition set.
+var ErrPartitionUnknown = errors.New("derived partition manifest unknown")
+
+// ErrFlattenUnknown is returned when no flattened layer has been recorded
+// for a set of allotments.
+var ErrFlattenUnknown = errors.New("flattened allotment layer unknown")
+
 // ErrTagUnknown is returned if the given tag is not known by the tag service
 type ErrTagUnknown struct {
 	Tag string
@@ -25,6 +25,9 @@ type Builder struct {
 	// Annotations contains arbitrary metadata relating to the targeted content.
 	annotations map[string]string
 
+	// subject is the optional manifest the built manifest relates to.
+	subject *v1.Descriptor
+
 	// For testing purposes
 	mediaType string
 }
@@ -55,12 +58,18 @@ func (mb *Builder) SetMediaType(mediaType string) error {
 	return nil
 }
 
+// SetSubject assigns the manifest the built manifest relates to.
+func (mb *Builder) SetSubject(subject *v1.Descriptor) {
+	mb.subject = subject
+}
+
 // Build produces a final manifest from the given references.
 func (mb *Builder) Build(ctx context.Context) (distribution.Manifest, error) {
 	m := Manifest{
 		Versioned:   specs.Versioned{SchemaVersion: 2},
 		MediaType:   mb.mediaType,
 		Layers:      make([]v1.Descriptor, len(mb.layers)),
+		Subject:     mb.subject,
 		Annotations: mb.annotations,
 	}
 	copy(m.Layers, mb.layers)
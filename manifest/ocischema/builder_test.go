@@ -156,3 +156,35 @@ func TestBuilder(t *testing.T) {
 		t.Fatal("References() does not match the descriptors added")
 	}
 }
+
+func TestBuilderSubject(t *testing.T) {
+	imgJSON := []byte(`{"architecture": "amd64", "os": "linux", "rootfs": {"diff_ids": [], "type": "layers"}}`)
+	subject := &v1.Descriptor{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    digest.FromString("subject"),
+		Size:      7,
+	}
+
+	bs := &mockBlobService{descriptors: make(map[digest.Digest]v1.Descriptor)}
+	builder := NewManifestBuilder(bs, imgJSON, nil)
+	builder.SetSubject(subject)
+	built, err := builder.Build(context.Background())
+	if err != nil {
+		t.Fatalf("Build returned error: %v", err)
+	}
+
+	_, payload, err := built.Payload()
+	if err != nil {
+		t.Fatalf("Payload returned error: %v", err)
+	}
+	var unmarshalled DeserializedManifest
+	if err := unmarshalled.UnmarshalJSON(payload); err != nil {
+		t.Fatalf("error unmarshaling manifest: %v", err)
+	}
+	if !reflect.DeepEqual(unmarshalled.Subject, subject) {
+		t.Fatalf("unexpected subject in manifest: %+v", unmarshalled.Subject)
+	}
+	if len(unmarshalled.References()) != 1 {
+		t.Fatalf("the subject must not be part of the references: %v", unmarshalled.References())
+	}
+}
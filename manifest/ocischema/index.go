@@ -62,6 +62,10 @@ type ImageIndex struct {
 	// Manifests references a list of manifests
 	Manifests []v1.Descriptor `json:"manifests"`
 
+	// Subject is an optional link from the image index to another manifest
+	// it relates to.
+	Subject *v1.Descriptor `json:"subject,omitempty"`
+
 	// Annotations is an optional field that contains arbitrary metadata for the
 	// image index
 	Annotations map[string]string `json:"annotations,omitempty"`
@@ -91,7 +95,7 @@ func FromDescriptors(descriptors []v1.Descriptor, annotations map[string]string)
 }
 
 // fromDescriptorsWithMediaType is for testing purposes, it's useful to be able to specify the media type explicitly
-func fromDescriptorsWithMediaType(descriptors []v1.Descriptor, annotations map[string]string, mediaType string) (_ *DeserializedImageIndex, err error) {
+func fromDescriptorsWithMediaType(descriptors []v1.Descriptor, annotations map[string]string, mediaType string) (*DeserializedImageIndex, error) {
 	m := ImageIndex{
 		Versioned:   specs.Versioned{SchemaVersion: 2},
 		MediaType:   mediaType,
@@ -101,10 +105,18 @@ func fromDescriptorsWithMediaType(descriptors []v1.Descriptor, annotations map[s
 	m.Manifests = make([]v1.Descriptor, len(descriptors))
 	copy(m.Manifests, descriptors)
 
+	return FromImageIndex(m)
+}
+
+// FromImageIndex takes an ImageIndex structure, marshals it to JSON, and
+// returns a DeserializedImageIndex which contains the image index and its
+// JSON representation.
+func FromImageIndex(m ImageIndex) (*DeserializedImageIndex, error) {
 	deserialized := DeserializedImageIndex{
 		ImageIndex: m,
 	}
 
+	var err error
 	deserialized.canonical, err = json.MarshalIndent(&m, "", "   ")
 	return &deserialized, err
 }
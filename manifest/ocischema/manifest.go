@@ -62,6 +62,10 @@ type Manifest struct {
 	// configuration.
 	Layers []v1.Descriptor `json:"layers"`
 
+	// Subject is an optional link from the image manifest to another
+	// manifest it relates to.
+	Subject *v1.Descriptor `json:"subject,omitempty"`
+
 	// Annotations contains arbitrary metadata for the image manifest.
 	Annotations map[string]string `json:"annotations,omitempty"`
 }
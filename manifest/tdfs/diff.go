@@ -0,0 +1,180 @@
+package tdfs
+
+import (
+	"context"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/opencontainers/go-digest"
+)
+
+// CellDiff describes an allotment added, removed or changed between two
+// versions of a field. Digests and sizes of the missing side are empty.
+type CellDiff struct {
+	Row       int           `json:"row"`
+	Col       int           `json:"col"`
+	OldDigest digest.Digest `json:"oldDigest,omitempty"`
+	NewDigest digest.Digest `json:"newDigest,omitempty"`
+	// OldSize and NewSize are the sizes of the allotment blobs, zero if they
+	// are not available.
+	OldSize int64 `json:"oldSize,omitempty"`
+	NewSize int64 `json:"newSize,omitempty"`
+	// SizeDelta is NewSize minus OldSize.
+	SizeDelta int64 `json:"sizeDelta"`
+}
+
+// FieldDiff describes the allotments which differ between two versions of a
+// field. Unchanged allotments are not listed.
+type FieldDiff struct {
+	// From and To are the digests of the field layers, empty if the field
+	// is missing from that version.
+	From digest.Digest `json:"from,omitempty"`
+	To   digest.Digest `json:"to,omitempty"`
+	// Added, Removed and Changed list the allotments in row-major order.
+	Added   []CellDiff `json:"added"`
+	Removed []CellDiff `json:"removed"`
+	Changed []CellDiff `json:"changed"`
+	// SizeDelta is the sum of the size deltas of the listed allotments.
+	SizeDelta int64 `json:"sizeDelta"`
+}
+
+// ClipFieldDiff returns the diff keeping the allotments lying in the
+// partitions only.
+func ClipFieldDiff(diff FieldDiff, partitions []Partition) FieldDiff {
+	partitions = NormalizePartitions(partitions)
+	diff.SizeDelta = 0
+	clip := func(cells []CellDiff) []CellDiff {
+		clipped := []CellDiff{}
+		for _, cell := range cells {
+			if partitionsContain(partitions, cell.Row, cell.Col) {
+				clipped = append(clipped, cell)
+				diff.SizeDelta += cell.SizeDelta
+			}
+		}
+		return clipped
+	}
+	diff.Added = clip(diff.Added)
+	diff.Removed = clip(diff.Removed)
+	diff.Changed = clip(diff.Changed)
+	return diff
+}
+
+// DiffFields returns the allotments added, removed or changed from the field
+// described by from to the field described by to. Allotments are matched by
+// position and changed when their digests differ.
+func DiffFields(from, to FieldDescription) FieldDiff {
+	diff := FieldDiff{
+		From:    from.Digest,
+		To:      to.Digest,
+		Added:   []CellDiff{},
+		Removed: []CellDiff{},
+		Changed: []CellDiff{},
+	}
+
+	old := map[allotmentPosition]FieldCell{}
+	for _, cell := range from.Cells {
+		old[allotmentPosition{row: cell.Row, col: cell.Col}] = cell
+	}
+	for _, cell := range to.Cells {
+		position := allotmentPosition{row: cell.Row, col: cell.Col}
+		previous, ok := old[position]
+		delete(old, position)
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, CellDiff{
+				Row:       cell.Row,
+				Col:       cell.Col,
+				NewDigest: cell.Digest,
+				NewSize:   cell.Size,
+				SizeDelta: cell.Size,
+			})
+		case previous.Digest != cell.Digest:
+			diff.Changed = append(diff.Changed, CellDiff{
+				Row:       cell.Row,
+				Col:       cell.Col,
+				OldDigest: previous.Digest,
+				NewDigest: cell.Digest,
+				OldSize:   previous.Size,
+				NewSize:   cell.Size,
+				SizeDelta: cell.Size - previous.Size,
+			})
+		}
+	}
+	// from.Cells are in row-major order, so are the removed allotments
+	for _, cell := range from.Cells {
+		if _, ok := old[allotmentPosition{row: cell.Row, col: cell.Col}]; !ok {
+			continue
+		}
+		diff.Removed = append(diff.Removed, CellDiff{
+			Row:       cell.Row,
+			Col:       cell.Col,
+			OldDigest: cell.Digest,
+			OldSize:   cell.Size,
+			SizeDelta: -cell.Size,
+		})
+	}
+
+	for _, cells := range [][]CellDiff{diff.Added, diff.Removed, diff.Changed} {
+		for _, cell := range cells {
+			diff.SizeDelta += cell.SizeDelta
+		}
+	}
+	return diff
+}
+
+// DescribeFields returns the description of every field of the manifest, in
+// layer order, stating the allotment blobs with blobService. A nil manifest
+// has no fields.
+func DescribeFields(ctx context.Context, blobService distribution.BlobService, manifest *ocischema.DeserializedManifest) ([]FieldDescription, error) {
+	if manifest == nil {
+		return nil, nil
+	}
+	descriptions := []FieldDescription{}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != MediaTypeTdfsLayer {
+			continue
+		}
+		content, err := blobService.Get(ctx, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		field, err := UnmarshalField(content)
+		if err != nil {
+			return nil, err
+		}
+		description, err := DescribeField(ctx, blobService, layer.Digest, field)
+		if err != nil {
+			return nil, err
+		}
+		descriptions = append(descriptions, description)
+	}
+	return descriptions, nil
+}
+
+// DiffManifestFields returns the differences between the fields of two
+// versions of a 2dfs image manifest. Stacked fields are matched in layer
+// order; a field missing from one version is diffed against an empty field.
+// Either manifest may be nil, in which case all of its fields are missing.
+func DiffManifestFields(ctx context.Context, blobService distribution.BlobService, from, to *ocischema.DeserializedManifest) ([]FieldDiff, error) {
+	fromFields, err := DescribeFields(ctx, blobService, from)
+	if err != nil {
+		return nil, err
+	}
+	toFields, err := DescribeFields(ctx, blobService, to)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []FieldDiff{}
+	for i := 0; i < max(len(fromFields), len(toFields)); i++ {
+		var fromField, toField FieldDescription
+		if i < len(fromFields) {
+			fromField = fromFields[i]
+		}
+		if i < len(toFields) {
+			toField = toFields[i]
+		}
+		diffs = append(diffs, DiffFields(fromField, toField))
+	}
+	return diffs, nil
+}
@@ -0,0 +1,157 @@
+package tdfs
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	tdfs "github.com/2DFS/2dfs-builder/filesystem"
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestDiffFields(t *testing.T) {
+	a, b, c := digest.FromString("a"), digest.FromString("b"), digest.FromString("c")
+	from := FieldDescription{
+		Digest: digest.FromString("from"),
+		Cells: []FieldCell{
+			{Row: 0, Col: 0, Digest: a, Size: 10},
+			{Row: 0, Col: 1, Digest: b, Size: 20},
+			{Row: 1, Col: 0, Digest: c, Size: 30},
+		},
+	}
+	to := FieldDescription{
+		Digest: digest.FromString("to"),
+		Cells: []FieldCell{
+			{Row: 0, Col: 0, Digest: a, Size: 10},
+			{Row: 0, Col: 1, Digest: c, Size: 25},
+			{Row: 2, Col: 2, Digest: b, Size: 20},
+		},
+	}
+
+	diff := DiffFields(from, to)
+	expected := FieldDiff{
+		From:      from.Digest,
+		To:        to.Digest,
+		Added:     []CellDiff{{Row: 2, Col: 2, NewDigest: b, NewSize: 20, SizeDelta: 20}},
+		Removed:   []CellDiff{{Row: 1, Col: 0, OldDigest: c, OldSize: 30, SizeDelta: -30}},
+		Changed:   []CellDiff{{Row: 0, Col: 1, OldDigest: b, NewDigest: c, OldSize: 20, NewSize: 25, SizeDelta: 5}},
+		SizeDelta: -5,
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("Expected diff %+v, got %+v", expected, diff)
+	}
+
+	if diff := DiffFields(from, from); len(diff.Added)+len(diff.Removed)+len(diff.Changed) != 0 || diff.SizeDelta != 0 {
+		t.Errorf("Expected no differences between identical fields, got %+v", diff)
+	}
+}
+
+func TestClipFieldDiff(t *testing.T) {
+	a, b, c := digest.FromString("a"), digest.FromString("b"), digest.FromString("c")
+	diff := FieldDiff{
+		Added:     []CellDiff{{Row: 2, Col: 2, NewDigest: b, NewSize: 20, SizeDelta: 20}},
+		Removed:   []CellDiff{{Row: 1, Col: 0, OldDigest: c, OldSize: 30, SizeDelta: -30}},
+		Changed:   []CellDiff{{Row: 0, Col: 1, OldDigest: b, NewDigest: a, OldSize: 20, NewSize: 25, SizeDelta: 5}},
+		SizeDelta: -5,
+	}
+	partitions, err := ParsePartitions("0.0.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clipped := ClipFieldDiff(diff, partitions)
+	expected := FieldDiff{
+		Added:     []CellDiff{},
+		Removed:   []CellDiff{{Row: 1, Col: 0, OldDigest: c, OldSize: 30, SizeDelta: -30}},
+		Changed:   []CellDiff{{Row: 0, Col: 1, OldDigest: b, NewDigest: a, OldSize: 20, NewSize: 25, SizeDelta: 5}},
+		SizeDelta: -25,
+	}
+	if !reflect.DeepEqual(clipped, expected) {
+		t.Fatalf("Expected clipped diff %+v, got %+v", expected, clipped)
+	}
+}
+
+func TestDiffManifestFields(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	put := func(content string) string {
+		desc, _ := bs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte(content))
+		return desc.Digest.Encoded()
+	}
+	diffID := digest.FromString("diff").Encoded()
+
+	// the new version changes 0.1, drops 1.0 and adds 1.2
+	updated := tdfs.GetField()
+	for _, allotment := range []tdfs.Allotment{
+		{Row: 0, Col: 0, Digest: put("field 0.0")},
+		{Row: 0, Col: 1, Digest: put("field 0.1 v2")},
+		{Row: 1, Col: 1, Digest: put("field 1.1")},
+		{Row: 1, Col: 2, Digest: put("field 1.2")},
+	} {
+		allotment.DiffID = diffID
+		updated.AddAllotment(allotment)
+	}
+	updatedField, _ := bs.Put(ctx, MediaTypeTdfsLayer, []byte(updated.Marshal()))
+	updatedField.MediaType = MediaTypeTdfsLayer
+
+	field := bs.putField(t, "field", 2, 2)
+	tuneField := bs.putField(t, "tune", 1, 1)
+	manifest := func(layers ...distribution.Descriptor) *ocischema.DeserializedManifest {
+		m, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: v1.MediaTypeImageManifest,
+			Layers:    layers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	diffs, err := DiffManifestFields(ctx, bs, manifest(field, tuneField), manifest(updatedField))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 {
+		t.Fatalf("Expected the diffs of 2 fields, got %+v", diffs)
+	}
+
+	first := diffs[0]
+	if first.From != field.Digest || first.To != updatedField.Digest {
+		t.Errorf("Expected the first field to be diffed against the updated one, got %s and %s", first.From, first.To)
+	}
+	if len(first.Added) != 1 || first.Added[0].Row != 1 || first.Added[0].Col != 2 || first.Added[0].NewDigest != digest.FromString("field 1.2") {
+		t.Errorf("Expected allotment 1.2 to be added, got %+v", first.Added)
+	}
+	if len(first.Removed) != 1 || first.Removed[0].Row != 1 || first.Removed[0].Col != 0 || first.Removed[0].OldDigest != digest.FromString("field 1.0") {
+		t.Errorf("Expected allotment 1.0 to be removed, got %+v", first.Removed)
+	}
+	if len(first.Changed) != 1 || first.Changed[0].Row != 0 || first.Changed[0].Col != 1 ||
+		first.Changed[0].OldDigest != digest.FromString("field 0.1") || first.Changed[0].NewDigest != digest.FromString("field 0.1 v2") {
+		t.Fatalf("Expected allotment 0.1 to be changed, got %+v", first.Changed)
+	}
+	if first.Changed[0].OldSize != 9 || first.Changed[0].NewSize != 12 || first.Changed[0].SizeDelta != 3 || first.SizeDelta != 3 {
+		t.Errorf("Unexpected size deltas %+v", first)
+	}
+
+	// the stacked field is missing from the new version
+	second := diffs[1]
+	if second.From != tuneField.Digest || second.To != "" || len(second.Added) != 0 || len(second.Changed) != 0 ||
+		len(second.Removed) != 1 || second.SizeDelta != -int64(len("tune 0.0")) {
+		t.Errorf("Expected every allotment of the stacked field to be removed, got %+v", second)
+	}
+
+	// a missing manifest has no fields
+	diffs, err = DiffManifestFields(ctx, bs, nil, manifest(field))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || len(diffs[0].Added) != 4 || diffs[0].From != "" {
+		t.Errorf("Expected every allotment to be added, got %+v", diffs)
+	}
+}
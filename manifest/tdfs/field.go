@@ -0,0 +1,360 @@
+package tdfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	tdfsfilesystem "github.com/2DFS/2dfs-builder/filesystem"
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/internal/dcontext"
+	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/2DFS/2dfs-registry/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// defaultAllotmentMediaType is the media type of allotments whose
+// compression cannot be determined.
+const defaultAllotmentMediaType = v1.MediaTypeImageLayerGzip
+
+// layerMediaTypes are the media types allotments may be served with, media
+// types recorded for allotments are only trusted if they are one of them.
+var layerMediaTypes = map[string]bool{
+	v1.MediaTypeImageLayer:     true,
+	v1.MediaTypeImageLayerGzip: true,
+	v1.MediaTypeImageLayerZstd: true,
+	schema2.MediaTypeLayer:     true,
+}
+
+// allotmentPosition identifies an allotment by row and column.
+type allotmentPosition struct {
+	row int
+	col int
+}
+
+// ErrFieldInvalid is returned when a 2dfs field is not structurally valid.
+type ErrFieldInvalid struct {
+	Reason string
+}
+
+func (err ErrFieldInvalid) Error() string {
+	return fmt.Sprintf("invalid 2dfs field: %s", err.Reason)
+}
+
+// VerifyField checks that the field is structurally valid: the declared
+// sizes match the rows and allotments actually present, every allotment
+// sits at the position given by its row and col, no position is declared
+// twice and the digest and diffID of every non-empty allotment are well
+// formed sha256 hex digests. Empty allotments carry neither.
+func VerifyField(field tdfsfilesystem.Field) error {
+	fs, ok := field.(*tdfsfilesystem.TwoDFilesystem)
+	if !ok || fs == nil {
+		return ErrFieldInvalid{Reason: fmt.Sprintf("unsupported field type %T", field)}
+	}
+	if fs.TotRows != len(fs.Rows) {
+		return ErrFieldInvalid{Reason: fmt.Sprintf("rows_size is %d but %d rows are present", fs.TotRows, len(fs.Rows))}
+	}
+	seen := map[allotmentPosition]bool{}
+	for i, row := range fs.Rows {
+		if row.TotAllotments != len(row.Allotments) {
+			return ErrFieldInvalid{Reason: fmt.Sprintf("row %d: allotments_size is %d but %d allotments are present", i, row.TotAllotments, len(row.Allotments))}
+		}
+		for j, allotment := range row.Allotments {
+			position := allotmentPosition{row: allotment.Row, col: allotment.Col}
+			if seen[position] {
+				return ErrFieldInvalid{Reason: fmt.Sprintf("allotment %d.%d is declared more than once", allotment.Row, allotment.Col)}
+			}
+			seen[position] = true
+			if allotment.Row != i || allotment.Col != j {
+				return ErrFieldInvalid{Reason: fmt.Sprintf("allotment %d.%d is found at position %d.%d", allotment.Row, allotment.Col, i, j)}
+			}
+			if err := verifyAllotment(allotment); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifyAllotment checks the digest and diffID of the allotment.
+func verifyAllotment(allotment tdfsfilesystem.Allotment) error {
+	if allotment.Digest == "" {
+		if allotment.DiffID != "" {
+			return ErrFieldInvalid{Reason: fmt.Sprintf("allotment %d.%d has a diffid but no digest", allotment.Row, allotment.Col)}
+		}
+		return nil
+	}
+	if err := AllotmentDigest(allotment).Validate(); err != nil {
+		return ErrFieldInvalid{Reason: fmt.Sprintf("allotment %d.%d: invalid digest %q: %v", allotment.Row, allotment.Col, allotment.Digest, err)}
+	}
+	if err := AllotmentDiffID(allotment).Validate(); err != nil {
+		return ErrFieldInvalid{Reason: fmt.Sprintf("allotment %d.%d: invalid diffid %q: %v", allotment.Row, allotment.Col, allotment.DiffID, err)}
+	}
+	return nil
+}
+
+// UnmarshalField unmarshals the serialized field and verifies it with
+// VerifyField. Malformed content is reported as ErrFieldInvalid.
+func UnmarshalField(content []byte) (tdfsfilesystem.Field, error) {
+	field, err := tdfsfilesystem.GetField().Unmarshal(string(content))
+	if err != nil {
+		return nil, ErrFieldInvalid{Reason: err.Error()}
+	}
+	if err := VerifyField(field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+// AllotmentDigest returns the digest of the blob holding the allotment.
+func AllotmentDigest(allotment tdfsfilesystem.Allotment) digest.Digest {
+	return digest.NewDigestFromEncoded(digest.SHA256, allotment.Digest)
+}
+
+// AllotmentDiffID returns the uncompressed digest of the allotment.
+func AllotmentDiffID(allotment tdfsfilesystem.Allotment) digest.Digest {
+	return digest.NewDigestFromEncoded(digest.SHA256, allotment.DiffID)
+}
+
+// HasField reports whether the manifest carries at least one 2dfs field layer.
+func HasField(manifest *ocischema.DeserializedManifest) bool {
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == MediaTypeTdfsLayer {
+			return true
+		}
+	}
+	return false
+}
+
+// BlobGrant tells whether callers granted some partitions of 2dfs images
+// only may read a blob, as returned by CheckBlobGrant.
+type BlobGrant int
+
+const (
+	// BlobUnrelated blobs are neither field layers nor allotments.
+	BlobUnrelated BlobGrant = iota
+
+	// BlobGranted blobs are allotments lying in the granted partitions.
+	BlobGranted
+
+	// BlobDenied blobs are field layers, or allotments lying outside of the
+	// granted partitions.
+	BlobDenied
+)
+
+// CheckBlobGrant returns whether callers granted the partitions of the 2dfs
+// manifest only may read the blob dgst. Allotments found both in and
+// outside of the granted partitions are granted.
+func CheckBlobGrant(ctx context.Context, tdfsManifest *ocischema.DeserializedManifest, blobService distribution.BlobService, dgst digest.Digest, granted []Partition) (BlobGrant, error) {
+	granted = NormalizePartitions(granted)
+	grant := BlobUnrelated
+	for _, layer := range tdfsManifest.Layers {
+		if layer.MediaType != MediaTypeTdfsLayer {
+			continue
+		}
+		if layer.Digest == dgst {
+			return BlobDenied, nil
+		}
+		field, _, err := getField(ctx, blobService, layer)
+		if err != nil {
+			return BlobUnrelated, err
+		}
+		if field == nil {
+			continue
+		}
+		for allotment := range field.IterateAllotments() {
+			if allotment.Digest == "" || AllotmentDigest(allotment) != dgst {
+				continue
+			}
+			if partitionsContain(granted, allotment.Row, allotment.Col) {
+				return BlobGranted, nil
+			}
+			grant = BlobDenied
+		}
+	}
+	return grant, nil
+}
+
+// fieldMediaTypes returns the media types recorded by the builder for the
+// allotments of the serialized field, by position. Fields that do not
+// record media types yield an empty map.
+func fieldMediaTypes(content []byte) map[allotmentPosition]string {
+	var field struct {
+		Rows []struct {
+			Allotments []struct {
+				Row       int    `json:"row"`
+				Col       int    `json:"col"`
+				MediaType string `json:"mediatype"`
+			} `json:"allotments"`
+		} `json:"rows"`
+	}
+	mediaTypes := map[allotmentPosition]string{}
+	if err := json.Unmarshal(content, &field); err != nil {
+		return mediaTypes
+	}
+	for _, row := range field.Rows {
+		for _, allotment := range row.Allotments {
+			if allotment.MediaType != "" {
+				mediaTypes[allotmentPosition{row: allotment.Row, col: allotment.Col}] = allotment.MediaType
+			}
+		}
+	}
+	return mediaTypes
+}
+
+// allotmentMediaType returns the media type of the allotment blob described
+// by desc. The media type recorded in the field is preferred, then the one
+// of the stored descriptor, as long as they are layer media types, then the
+// one detected from the blob content. Allotments of unknown type are assumed
+// to be gzip compressed. Detected media types are recorded in the blob
+// descriptor, when the blob service supports it, so that blobs are only read
+// once.
+func allotmentMediaType(ctx context.Context, blobService distribution.BlobService, desc distribution.Descriptor, recorded string) string {
+	if layerMediaTypes[recorded] {
+		return recorded
+	}
+	if layerMediaTypes[desc.MediaType] {
+		return desc.MediaType
+	}
+	detected, err := detectLayerMediaType(ctx, blobService, desc.Digest)
+	if err != nil {
+		return defaultAllotmentMediaType
+	}
+	if detected == "" {
+		detected = defaultAllotmentMediaType
+	}
+	if setter, ok := blobService.(distribution.BlobDescriptorSetter); ok {
+		desc.MediaType = detected
+		if err := setter.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+			dcontext.GetLogger(ctx).Debugf("unable to record the media type of allotment %s: %v", desc.Digest, err)
+		}
+	}
+	return detected
+}
+
+// detectLayerMediaType detects the compression of the layer blob dgst from
+// its leading bytes, returning an empty string if it is not recognized.
+func detectLayerMediaType(ctx context.Context, blobService distribution.BlobService, dgst digest.Digest) (string, error) {
+	reader, err := blobService.Open(ctx, dgst)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	// the tar magic sits at offset 257 of the first header
+	header := make([]byte, 512)
+	n, err := io.ReadFull(reader, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return sniffLayerMediaType(header[:n]), nil
+}
+
+// sniffLayerMediaType returns the layer media type matching the first bytes
+// of a layer, or an empty string if they match no known compression.
+func sniffLayerMediaType(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return v1.MediaTypeImageLayerGzip
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return v1.MediaTypeImageLayerZstd
+	case len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar")):
+		return v1.MediaTypeImageLayer
+	}
+	return ""
+}
+
+// FieldCell describes a non-empty allotment of a field.
+type FieldCell struct {
+	Row    int           `json:"row"`
+	Col    int           `json:"col"`
+	Digest digest.Digest `json:"digest"`
+	DiffID digest.Digest `json:"diffID"`
+	// Size is the size of the allotment blob, zero if it is not available.
+	Size int64 `json:"size,omitempty"`
+}
+
+// FieldDescription describes the grid of a field and its allotments.
+type FieldDescription struct {
+	// Digest is the digest of the field layer.
+	Digest digest.Digest `json:"digest"`
+	// Rows is the rows_size of the field.
+	Rows int `json:"rows"`
+	// Columns holds the allotments_size of every row.
+	Columns []int `json:"columns"`
+	// Cells lists the non-empty allotments in row-major order.
+	Cells []FieldCell `json:"cells"`
+}
+
+// ClipFieldDescription returns the description of the field keeping the
+// cells lying in the partitions only.
+func ClipFieldDescription(description FieldDescription, partitions []Partition) FieldDescription {
+	partitions = NormalizePartitions(partitions)
+	cells := []FieldCell{}
+	for _, cell := range description.Cells {
+		if partitionsContain(partitions, cell.Row, cell.Col) {
+			cells = append(cells, cell)
+		}
+	}
+	description.Cells = cells
+	return description
+}
+
+// DescribeField returns the description of the field stored in the field
+// layer dgst, stating the allotment blobs with blobs in parallel, within the
+// concurrency limit of ctx.
+func DescribeField(ctx context.Context, blobs distribution.BlobStatter, dgst digest.Digest, field tdfsfilesystem.Field) (FieldDescription, error) {
+	fs, ok := field.(*tdfsfilesystem.TwoDFilesystem)
+	if !ok || fs == nil {
+		return FieldDescription{}, ErrFieldInvalid{Reason: fmt.Sprintf("unsupported field type %T", field)}
+	}
+
+	description := FieldDescription{
+		Digest:  dgst,
+		Rows:    fs.TotRows,
+		Columns: make([]int, 0, len(fs.Rows)),
+		Cells:   []FieldCell{},
+	}
+	for _, row := range fs.Rows {
+		description.Columns = append(description.Columns, row.TotAllotments)
+		for _, allotment := range row.Allotments {
+			if allotment.Digest == "" {
+				continue
+			}
+			description.Cells = append(description.Cells, FieldCell{
+				Row:    allotment.Row,
+				Col:    allotment.Col,
+				Digest: AllotmentDigest(allotment),
+				DiffID: AllotmentDiffID(allotment),
+			})
+		}
+	}
+
+	// stat the allotments in parallel, missing ones have no size
+	err := lookupAll(ctx, len(description.Cells), func(ctx context.Context, i int) error {
+		cell := &description.Cells[i]
+		desc, err := blobs.Stat(ctx, cell.Digest)
+		switch err {
+		case nil:
+			cell.Size = desc.Size
+		case distribution.ErrBlobUnknown:
+		default:
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return FieldDescription{}, err
+	}
+	sort.SliceStable(description.Cells, func(i, j int) bool {
+		if description.Cells[i].Row != description.Cells[j].Row {
+			return description.Cells[i].Row < description.Cells[j].Row
+		}
+		return description.Cells[i].Col < description.Cells[j].Col
+	})
+	return description, nil
+}
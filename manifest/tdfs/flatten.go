@@ -0,0 +1,313 @@
+package tdfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// whiteoutPrefix prefixes the entries removing a path of the layers
+	// below.
+	whiteoutPrefix = ".wh."
+
+	// whiteoutOpaqueDir is the entry hiding the content of its directory in
+	// the layers below.
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// Flattener merges the allotments selected in the fields, along with the
+// regular layers stacked between them, into a single layer, returning the
+// descriptor of the layer and its diffID.
+type Flattener func(ctx context.Context, allotments []distribution.Descriptor) (distribution.Descriptor, digest.Digest, error)
+
+// FlattenKey returns the digest identifying the layer flattened from the
+// allotments, in order.
+func FlattenKey(allotments []distribution.Descriptor) digest.Digest {
+	digests := make([]string, len(allotments))
+	for i, allotment := range allotments {
+		digests[i] = allotment.Digest.String()
+	}
+	return digest.FromString(strings.Join(digests, "\n"))
+}
+
+// FlattenAllotments streams the allotments, in order, into a single gzip
+// compressed tar layer stored in blobService, returning its descriptor and
+// diffID. Entries of later allotments replace the ones of earlier
+// allotments and whiteouts remove them. Whiteouts are kept in the flattened
+// layer, so that they still apply to the layers below it.
+func FlattenAllotments(ctx context.Context, blobService distribution.BlobService, allotments []distribution.Descriptor) (_ distribution.Descriptor, _ digest.Digest, err error) {
+	// first pass, find the entries surviving the merge
+	tree := newFlattenedTree()
+	for i, allotment := range allotments {
+		err := readAllotment(ctx, blobService, allotment, func(index int, header *tar.Header, _ io.Reader) error {
+			tree.add(flattenedEntry{allotment: i, index: index}, header)
+			return nil
+		})
+		if err != nil {
+			return distribution.Descriptor{}, "", err
+		}
+	}
+	kept := map[flattenedEntry]bool{}
+	for _, entry := range tree.entries {
+		kept[entry] = true
+	}
+
+	// second pass, stream the surviving entries into the flattened layer
+	writer, err := blobService.Create(ctx)
+	if err != nil {
+		return distribution.Descriptor{}, "", err
+	}
+	// committed writers are not to be cancelled
+	defer func() {
+		if err != nil {
+			writer.Cancel(ctx)
+		}
+	}()
+
+	// blob writers are filled with a single ReadFrom, as uploads are
+	layerDigester := digest.Canonical.Digester()
+	pr, pw := io.Pipe()
+	done := make(chan digest.Digest, 1)
+	go func() {
+		diffID, err := writeFlattened(ctx, blobService, allotments, tree, kept, io.MultiWriter(pw, layerDigester.Hash()))
+		pw.CloseWithError(err)
+		done <- diffID
+	}()
+	_, err = writer.ReadFrom(pr)
+	pr.CloseWithError(err)
+	diffID := <-done
+	if err != nil {
+		return distribution.Descriptor{}, "", err
+	}
+
+	desc, err := writer.Commit(ctx, v1.Descriptor{
+		MediaType: v1.MediaTypeImageLayerGzip,
+		Digest:    layerDigester.Digest(),
+		Size:      writer.Size(),
+	})
+	if err != nil {
+		return distribution.Descriptor{}, "", err
+	}
+	desc.MediaType = v1.MediaTypeImageLayerGzip
+	return desc, diffID, nil
+}
+
+// writeFlattened writes the gzip compressed tar archive of the kept entries
+// of the allotments to w, returning its diffID.
+func writeFlattened(ctx context.Context, blobService distribution.BlobService, allotments []distribution.Descriptor, tree *flattenedTree, kept map[flattenedEntry]bool, w io.Writer) (digest.Digest, error) {
+	diffIDDigester := digest.Canonical.Digester()
+	compressed := gzip.NewWriter(w)
+	flattened := tar.NewWriter(io.MultiWriter(compressed, diffIDDigester.Hash()))
+	for i, allotment := range allotments {
+		err := readAllotment(ctx, blobService, allotment, func(index int, header *tar.Header, content io.Reader) error {
+			if !kept[flattenedEntry{allotment: i, index: index}] {
+				return nil
+			}
+			if err := flattened.WriteHeader(header); err != nil {
+				return err
+			}
+			_, err := io.Copy(flattened, content)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// directories recreated over a whiteout hide the content of the layers
+	// below, as their whiteout did
+	opaque := make([]string, 0, len(tree.opaque))
+	for dir := range tree.opaque {
+		if _, ok := tree.entries[path.Join(dir, whiteoutOpaqueDir)]; !ok {
+			opaque = append(opaque, dir)
+		}
+	}
+	sort.Strings(opaque)
+	for _, dir := range opaque {
+		err := flattened.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strings.TrimPrefix(path.Join(dir, whiteoutOpaqueDir), "/"),
+			Mode:     0o644,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := flattened.Close(); err != nil {
+		return "", err
+	}
+	if err := compressed.Close(); err != nil {
+		return "", err
+	}
+	return diffIDDigester.Digest(), nil
+}
+
+// readAllotment calls fn with every entry of the tar archive of the
+// allotment, in order, decompressing it if needed.
+func readAllotment(ctx context.Context, blobService distribution.BlobService, allotment distribution.Descriptor, fn func(index int, header *tar.Header, content io.Reader) error) error {
+	blob, err := blobService.Open(ctx, allotment.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	// the tar magic sits at offset 257 of the first header
+	buffered := bufio.NewReaderSize(blob, 512)
+	header, _ := buffered.Peek(512)
+
+	var content io.Reader = buffered
+	switch sniffLayerMediaType(header) {
+	case v1.MediaTypeImageLayerGzip:
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		content = gz
+	case v1.MediaTypeImageLayerZstd:
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		content = zr
+	}
+
+	archive := tar.NewReader(content)
+	for index := 0; ; index++ {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(index, header, archive); err != nil {
+			return err
+		}
+	}
+}
+
+// flattenedEntry locates a tar entry by allotment and position in the
+// allotment.
+type flattenedEntry struct {
+	allotment int
+	index     int
+}
+
+// flattenedTree tracks the entries of the flattened layer while the
+// allotments are merged. Paths are absolute and cleaned.
+type flattenedTree struct {
+	// entries holds the entry kept for every path.
+	entries map[string]flattenedEntry
+
+	// opaque holds the directories recreated over the whiteout of an
+	// earlier allotment.
+	opaque map[string]bool
+
+	// children indexes the paths of entries and opaque, and their parents,
+	// by parent directory, so that the paths under a directory are found
+	// without scanning the whole tree.
+	children map[string]map[string]struct{}
+}
+
+func newFlattenedTree() *flattenedTree {
+	return &flattenedTree{
+		entries:  map[string]flattenedEntry{},
+		opaque:   map[string]bool{},
+		children: map[string]map[string]struct{}{},
+	}
+}
+
+// add merges the entry of an allotment into the tree. Whiteouts only apply
+// to the entries of earlier allotments.
+func (t *flattenedTree) add(entry flattenedEntry, header *tar.Header) {
+	name := path.Clean("/" + header.Name)
+	dir, base := path.Dir(name), path.Base(name)
+
+	switch {
+	case base == whiteoutOpaqueDir:
+		t.remove(entry.allotment, dir, false)
+	case strings.HasPrefix(base, whiteoutPrefix):
+		t.remove(entry.allotment, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), true)
+	default:
+		// the path and its parents replace the whiteouts of earlier
+		// allotments, directories keep hiding the layers below
+		for p := name; p != "/"; p = path.Dir(p) {
+			whiteout := path.Join(path.Dir(p), whiteoutPrefix+path.Base(p))
+			if earlier, ok := t.entries[whiteout]; ok && earlier.allotment < entry.allotment {
+				delete(t.entries, whiteout)
+				if p != name || header.Typeflag == tar.TypeDir {
+					t.opaque[p] = true
+					t.link(p)
+				}
+			}
+		}
+		if header.Typeflag != tar.TypeDir {
+			t.remove(entry.allotment, name, true)
+		}
+	}
+	t.entries[name] = entry
+	t.link(name)
+}
+
+// link indexes p under its parent directories.
+func (t *flattenedTree) link(p string) {
+	for p != "/" {
+		dir := path.Dir(p)
+		children, ok := t.children[dir]
+		if !ok {
+			children = map[string]struct{}{}
+			t.children[dir] = children
+		}
+		if _, ok := children[p]; ok {
+			return
+		}
+		children[p] = struct{}{}
+		p = dir
+	}
+}
+
+// remove removes the entries of the allotments earlier than allotment under
+// target, and target itself if self is set.
+func (t *flattenedTree) remove(allotment int, target string, self bool) {
+	if self {
+		if entry, ok := t.entries[target]; ok && entry.allotment < allotment {
+			delete(t.entries, target)
+		}
+		delete(t.opaque, target)
+	}
+	t.removeChildren(allotment, target)
+}
+
+// removeChildren removes the entries of the allotments earlier than
+// allotment under dir, dropping the paths left without entries from the
+// index.
+func (t *flattenedTree) removeChildren(allotment int, dir string) {
+	children := t.children[dir]
+	for p := range children {
+		if entry, ok := t.entries[p]; ok && entry.allotment < allotment {
+			delete(t.entries, p)
+		}
+		delete(t.opaque, p)
+		t.removeChildren(allotment, p)
+		if _, ok := t.entries[p]; !ok && len(t.children[p]) == 0 {
+			delete(children, p)
+		}
+	}
+	if len(children) == 0 {
+		delete(t.children, dir)
+	}
+}
@@ -0,0 +1,384 @@
+package tdfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tarEntry is an entry of a test tar archive, directories end with a slash.
+type tarEntry struct {
+	name    string
+	content string
+}
+
+// putTar stores the tar archive of the entries, compressed with the
+// compression of mediaType, and returns its descriptor.
+func (bs *testBlobService) putTar(t *testing.T, mediaType string, entries ...tarEntry) distribution.Descriptor {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(entry.content))}
+		if entry.name[len(entry.name)-1] == '/' {
+			header = &tar.Header{Name: entry.name, Mode: 0o755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, entry.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	switch mediaType {
+	case v1.MediaTypeImageLayerGzip:
+		gw := gzip.NewWriter(&compressed)
+		gw.Write(archive.Bytes())
+		gw.Close()
+	case v1.MediaTypeImageLayerZstd:
+		zw, _ := zstd.NewWriter(&compressed)
+		zw.Write(archive.Bytes())
+		zw.Close()
+	default:
+		compressed = archive
+	}
+	desc, _ := bs.Put(context.Background(), mediaType, compressed.Bytes())
+	desc.MediaType = mediaType
+	return desc
+}
+
+// readTar returns the entries of the uncompressed tar archive.
+func readTar(t *testing.T, archive []byte) []tarEntry {
+	entries := []tarEntry{}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tarEntry{name: header.Name, content: string(content)})
+	}
+}
+
+// reopenFailingBlobService fails opening blobs a second time, the first pass
+// of a flattening succeeds and the second one fails.
+type reopenFailingBlobService struct {
+	*testBlobService
+}
+
+func (bs reopenFailingBlobService) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	if bs.opens[dgst] > 0 {
+		return nil, errors.New("blob opened again")
+	}
+	return bs.testBlobService.Open(ctx, dgst)
+}
+
+func TestFlattenAllotments(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	allotments := []distribution.Descriptor{
+		bs.putTar(t, v1.MediaTypeImageLayerGzip,
+			tarEntry{name: "etc/"},
+			tarEntry{name: "etc/a", content: "a1"},
+			tarEntry{name: "etc/b", content: "b1"},
+			tarEntry{name: "usr/x", content: "x"},
+		),
+		bs.putTar(t, v1.MediaTypeImageLayer,
+			tarEntry{name: "etc/a", content: "a2"},
+			tarEntry{name: ".wh.usr"},
+			tarEntry{name: "etc/.wh.b"},
+			tarEntry{name: ".wh.opt"},
+		),
+		bs.putTar(t, v1.MediaTypeImageLayerZstd,
+			tarEntry{name: "usr/"},
+			tarEntry{name: "usr/y", content: "y"},
+		),
+	}
+
+	desc, diffID, err := FlattenAllotments(ctx, bs, allotments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.MediaType != v1.MediaTypeImageLayerGzip {
+		t.Errorf("Expected a gzip layer, got %s", desc.MediaType)
+	}
+
+	content, err := bs.Get(ctx, desc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest.FromBytes(archive) != diffID {
+		t.Errorf("Expected the diffID to be %s, got %s", digest.FromBytes(archive), diffID)
+	}
+
+	// the whiteouts of the layers below are kept, the recreated usr
+	// directory keeps hiding them
+	expected := []tarEntry{
+		{name: "etc/"},
+		{name: "etc/a", content: "a2"},
+		{name: "etc/.wh.b"},
+		{name: ".wh.opt"},
+		{name: "usr/"},
+		{name: "usr/y", content: "y"},
+		{name: "usr/.wh..wh..opq"},
+	}
+	if entries := readTar(t, archive); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected the flattened entries to be %v, got %v", expected, entries)
+	}
+
+	// flattening is deterministic
+	again, _, err := FlattenAllotments(ctx, bs, allotments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Digest != desc.Digest {
+		t.Errorf("Expected flattening again to give %s, got %s", desc.Digest, again.Digest)
+	}
+	if FlattenKey(allotments) == FlattenKey(allotments[1:]) {
+		t.Errorf("Expected different allotments to have different keys")
+	}
+
+	// only failed flattenings cancel their upload
+	if bs.cancelled != 0 {
+		t.Errorf("Expected committed flattened layers not to be cancelled, got %d cancellations", bs.cancelled)
+	}
+	bs.opens = make(map[digest.Digest]int)
+	if _, _, err := FlattenAllotments(ctx, reopenFailingBlobService{bs}, allotments); err == nil {
+		t.Fatal("Expected flattening to fail when the allotments cannot be read again")
+	}
+	if bs.cancelled != 1 {
+		t.Errorf("Expected the failed flattening to be cancelled, got %d cancellations", bs.cancelled)
+	}
+}
+
+func TestFlattenedTree(t *testing.T) {
+	tree := newFlattenedTree()
+	add := func(allotment, index int, name string, typeflag byte) {
+		tree.add(flattenedEntry{allotment: allotment, index: index}, &tar.Header{Name: name, Typeflag: typeflag})
+	}
+	add(0, 0, "opt/", tar.TypeDir)
+	add(0, 1, "opt/bin/", tar.TypeDir)
+	add(0, 2, "opt/bin/tool", tar.TypeReg)
+	add(0, 3, "opt/lib", tar.TypeReg)
+	add(1, 0, "opt/lib", tar.TypeReg)
+	add(1, 1, "opt/bin", tar.TypeReg)
+
+	// files replace the files and the directories of earlier allotments
+	expected := map[string]flattenedEntry{
+		"/opt":     {allotment: 0, index: 0},
+		"/opt/lib": {allotment: 1, index: 0},
+		"/opt/bin": {allotment: 1, index: 1},
+	}
+	if !reflect.DeepEqual(tree.entries, expected) {
+		t.Errorf("Expected the entries %v, got %v", expected, tree.entries)
+	}
+	if _, ok := tree.children["/opt/bin"]; ok {
+		t.Errorf("Expected the replaced directory to be dropped from the index")
+	}
+
+	add(2, 0, ".wh.opt", tar.TypeReg)
+	expected = map[string]flattenedEntry{"/.wh.opt": {allotment: 2, index: 0}}
+	if !reflect.DeepEqual(tree.entries, expected) {
+		t.Errorf("Expected the entries %v, got %v", expected, tree.entries)
+	}
+	if _, ok := tree.children["/opt"]; ok {
+		t.Errorf("Expected the removed directory to be dropped from the index")
+	}
+}
+
+func TestConvertFlattened(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	base, _ := bs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte("base"))
+	base.MediaType = v1.MediaTypeImageLayerGzip
+	field := bs.putField(t, "field", 2, 2)
+
+	config, _ := json.Marshal(v1.Image{
+		RootFS: v1.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromString("base diff")},
+		},
+		History: []v1.History{
+			{CreatedBy: "base"},
+			{CreatedBy: "field"},
+		},
+	})
+	configDesc, _ := bs.Put(ctx, v1.MediaTypeImageConfig, config)
+	configDesc.MediaType = v1.MediaTypeImageConfig
+
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []distribution.Descriptor{base, field},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flattenedLayer := distribution.Descriptor{
+		MediaType: v1.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("flattened"),
+		Size:      42,
+	}
+	flattenedDiffID := digest.FromString("flattened diff")
+	var flattened [][]distribution.Descriptor
+	flatten := func(ctx context.Context, allotments []distribution.Descriptor) (distribution.Descriptor, digest.Digest, error) {
+		flattened = append(flattened, allotments)
+		return flattenedLayer, flattenedDiffID, nil
+	}
+
+	converted, _, err := ConvertTdfsManifestToFlatOciManifest(ctx, source, bs, mustPartitions(t, "v1--c1"), Provenance{}, flatten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := converted.(*ocischema.DeserializedManifest)
+
+	if len(flattened) != 1 || len(flattened[0]) != 2 ||
+		flattened[0][0].Digest != digest.FromString("field 0.1") || flattened[0][1].Digest != digest.FromString("field 1.1") {
+		t.Fatalf("Expected the allotments of column 1 to be flattened, got %v", flattened)
+	}
+	if expected := []distribution.Descriptor{base, flattenedLayer}; !reflect.DeepEqual(manifest.Layers, expected) {
+		t.Fatalf("Expected layers %v, got %v", expected, manifest.Layers)
+	}
+
+	var derivedConfig v1.Image
+	content, err := bs.Get(ctx, manifest.Config.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(content, &derivedConfig); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []digest.Digest{digest.FromString("base diff"), flattenedDiffID}; !reflect.DeepEqual(derivedConfig.RootFS.DiffIDs, expected) {
+		t.Errorf("Expected diffIDs %v, got %v", expected, derivedConfig.RootFS.DiffIDs)
+	}
+	if len(derivedConfig.History) != 3 || !derivedConfig.History[1].EmptyLayer ||
+		derivedConfig.History[2].CreatedBy != "2dfs allotments 0.1 1.1 of field "+field.Digest.String()+" flattened" {
+		t.Errorf("Unexpected flattened history %+v", derivedConfig.History)
+	}
+}
+
+func TestConvertFlattenedStacked(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	base, _ := bs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte("base"))
+	base.MediaType = v1.MediaTypeImageLayerGzip
+	top, _ := bs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte("top"))
+	top.MediaType = v1.MediaTypeImageLayerGzip
+	baseField := bs.putField(t, "base field", 1, 2)
+	tuneField := bs.putField(t, "tune field", 1, 1)
+
+	config, _ := json.Marshal(v1.Image{
+		RootFS: v1.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromString("base diff"), digest.FromString("top diff")},
+		},
+		History: []v1.History{
+			{CreatedBy: "base"},
+			{CreatedBy: "base field"},
+			{CreatedBy: "top"},
+			{CreatedBy: "tune field"},
+		},
+	})
+	configDesc, _ := bs.Put(ctx, v1.MediaTypeImageConfig, config)
+	configDesc.MediaType = v1.MediaTypeImageConfig
+
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []distribution.Descriptor{base, baseField, top, tuneField},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flattenedLayer := distribution.Descriptor{
+		MediaType: v1.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("flattened"),
+		Size:      42,
+	}
+	flattenedDiffID := digest.FromString("flattened diff")
+	var flattened [][]distribution.Descriptor
+	flatten := func(ctx context.Context, allotments []distribution.Descriptor) (distribution.Descriptor, digest.Digest, error) {
+		flattened = append(flattened, allotments)
+		return flattenedLayer, flattenedDiffID, nil
+	}
+
+	converted, _, err := ConvertTdfsManifestToFlatOciManifest(ctx, source, bs, mustPartitions(t, "v1--r0"), Provenance{}, flatten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := converted.(*ocischema.DeserializedManifest)
+
+	// the regular layer stacked between the fields is merged as well
+	var merged []digest.Digest
+	for _, layer := range flattened[0] {
+		merged = append(merged, layer.Digest)
+	}
+	expectedMerged := []digest.Digest{
+		digest.FromString("base field 0.0"),
+		digest.FromString("base field 0.1"),
+		top.Digest,
+		digest.FromString("tune field 0.0"),
+	}
+	if len(flattened) != 1 || !reflect.DeepEqual(merged, expectedMerged) {
+		t.Fatalf("Expected the layers %v to be flattened together, got %v", expectedMerged, flattened)
+	}
+	if expected := []distribution.Descriptor{base, flattenedLayer}; !reflect.DeepEqual(manifest.Layers, expected) {
+		t.Fatalf("Expected layers %v, got %v", expected, manifest.Layers)
+	}
+
+	var derivedConfig v1.Image
+	content, err := bs.Get(ctx, manifest.Config.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(content, &derivedConfig); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []digest.Digest{digest.FromString("base diff"), flattenedDiffID}; !reflect.DeepEqual(derivedConfig.RootFS.DiffIDs, expected) {
+		t.Errorf("Expected diffIDs %v, got %v", expected, derivedConfig.RootFS.DiffIDs)
+	}
+	history := derivedConfig.History
+	if len(history) != 5 || history[0].EmptyLayer || !history[1].EmptyLayer || !history[2].EmptyLayer || !history[3].EmptyLayer ||
+		history[4].CreatedBy != "2dfs allotments 0.0 0.1 of field "+baseField.Digest.String()+", 0.0 of field "+tuneField.Digest.String()+" flattened" {
+		t.Errorf("Unexpected flattened history %+v", history)
+	}
+}
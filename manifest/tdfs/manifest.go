@@ -27,7 +27,7 @@ func init() {
 
 func unmarshalTdfs(b []byte) (distribution.Manifest, distribution.Descriptor, error) {
 	m := &DeserializedTdfsManifest{}
-	field, err := tdfs.GetField().Unmarshal(string(b))
+	field, err := UnmarshalField(b)
 	if err != nil {
 		return nil, distribution.Descriptor{}, err
 	}
@@ -1,10 +1,12 @@
 package tdfs
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 
 	tdfs "github.com/2DFS/2dfs-builder/filesystem"
+	distribution "github.com/2DFS/2dfs-registry/v3"
 )
 
 const expectedManifestSerialization = `{
@@ -109,3 +111,79 @@ func TestManifest(t *testing.T) {
 		t.Fatalf("unexpected number of allotments: %d", totAllotments)
 	}
 }
+
+func TestUnmarshalInvalidField(t *testing.T) {
+	const (
+		hexA = "4125b344c065ea823f46ad3ea56b468398d6a71cee2c853f38594741aca8d6d2"
+		hexB = "76d9d151de596d0b6031e9263da644d8ded6fbdd201d68840d2bdf08d2f187dd"
+	)
+	cell := func(row, col int, dgst, diffID string) string {
+		return fmt.Sprintf(`{"row":%d,"col":%d,"digest":%q,"diffid":%q}`, row, col, dgst, diffID)
+	}
+
+	if _, _, err := distribution.UnmarshalManifest(MediaTypeTdfsLayer, []byte(expectedManifestSerialization)); err != nil {
+		t.Fatalf("unexpected error unmarshaling a valid field: %v", err)
+	}
+
+	for _, testcase := range []struct {
+		name   string
+		field  string
+		reason string
+	}{
+		{
+			name:   "malformed",
+			field:  `{"rows":`,
+			reason: "unexpected end of JSON input",
+		},
+		{
+			name:   "rows size",
+			field:  `{"rows":[],"rows_size":1}`,
+			reason: "rows_size is 1 but 0 rows are present",
+		},
+		{
+			name:   "allotments size",
+			field:  `{"rows":[{"allotments":[` + cell(0, 0, hexA, hexB) + `],"allotments_size":2}],"rows_size":1}`,
+			reason: "row 0: allotments_size is 2 but 1 allotments are present",
+		},
+		{
+			name:   "position",
+			field:  `{"rows":[{"allotments":[` + cell(0, 0, hexA, hexB) + `,` + cell(1, 1, hexA, hexB) + `],"allotments_size":2}],"rows_size":1}`,
+			reason: "allotment 1.1 is found at position 0.1",
+		},
+		{
+			name:   "duplicate",
+			field:  `{"rows":[{"allotments":[` + cell(0, 0, hexA, hexB) + `,` + cell(0, 0, hexB, hexA) + `],"allotments_size":2}],"rows_size":1}`,
+			reason: "allotment 0.0 is declared more than once",
+		},
+		{
+			name:   "digest",
+			field:  `{"rows":[{"allotments":[` + cell(0, 0, "not hex", hexB) + `],"allotments_size":1}],"rows_size":1}`,
+			reason: `allotment 0.0: invalid digest "not hex"`,
+		},
+		{
+			name:   "uppercase digest",
+			field:  `{"rows":[{"allotments":[` + cell(0, 0, strings.ToUpper(hexA), hexB) + `],"allotments_size":1}],"rows_size":1}`,
+			reason: "allotment 0.0: invalid digest",
+		},
+		{
+			name:   "diffid",
+			field:  `{"rows":[{"allotments":[` + cell(0, 0, hexA, hexB[:10]) + `],"allotments_size":1}],"rows_size":1}`,
+			reason: "allotment 0.0: invalid diffid",
+		},
+		{
+			name:   "diffid without digest",
+			field:  `{"rows":[{"allotments":[` + cell(0, 0, "", hexB) + `],"allotments_size":1}],"rows_size":1}`,
+			reason: "allotment 0.0 has a diffid but no digest",
+		},
+	} {
+		_, _, err := distribution.UnmarshalManifest(MediaTypeTdfsLayer, []byte(testcase.field))
+		invalid, ok := err.(ErrFieldInvalid)
+		if !ok {
+			t.Errorf("%s: expected an invalid field error, got %v", testcase.name, err)
+			continue
+		}
+		if !strings.Contains(invalid.Reason, testcase.reason) {
+			t.Errorf("%s: expected reason %q, got %q", testcase.name, testcase.reason, invalid.Reason)
+		}
+	}
+}
@@ -4,183 +4,1134 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
-	"regexp"
+	"math"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 
 	tdfsfilesystem "github.com/2DFS/2dfs-builder/filesystem"
 	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/internal/dcontext"
 	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/2DFS/2dfs-registry/v3/tracing"
 )
 
+// tracer is the OpenTelemetry tracer utilized for tracing operations within
+// this package's code.
+var tracer = otel.Tracer("github.com/2DFS/2dfs-registry/v3/manifest/tdfs")
+
+// Partition is a rectangle of allotments of a 2dfs field, spanning rows x1
+// to x2 and columns y1 to y2, bounds included. An end set to openEnd
+// extends the partition to the last row or column of the field. Excluded
+// partitions remove their allotments from the ones selected by the others.
 type Partition struct {
 	x1 int
 	y1 int
 	x2 int
 	y2 int
+	// exclude marks the partition as an exclusion
+	exclude bool
+	// segment is the semantic tag segment the partition was parsed from
+	segment string
 }
 
+// PartitionGrammarVersion is the version of the semantic tag grammar
+// understood by CheckTagPartitions. A semantic tag is a tag followed by one
+// or more partitions, each introduced by "--":
+//
+//	version 1:
+//	  x1.y1.x2.y2   rows x1 to x2, columns y1 to y2
+//	version 2:
+//	  rN            the whole row N
+//	  cN            the whole column N
+//	  x1.y1.*.*     a "*" end extends the range to the end of the field,
+//	                a "*" start begins it at the first row or column
+//	  exP           excludes the allotments of partition P, any of the
+//	                forms above; if only exclusions are given they apply
+//	                to the whole field
+//
+// Every version is a superset of the previous ones and all the forms are
+// normalized to the same partition set, see NormalizePartitions.
+const PartitionGrammarVersion = 2
+
+const (
+	// PartitionHeader is the request header carrying the partitions to
+	// select from a 2dfs image, as an alternative to semantic tags.
+	PartitionHeader = "OCI-2DFS-Partition"
+	// PartitionQueryParam is the query parameter carrying the partitions to
+	// select from a 2dfs image, as an alternative to semantic tags.
+	PartitionQueryParam = "partition"
+	// FlattenQueryParam is the boolean query parameter requesting the
+	// allotments selected in every field to be flattened into a single
+	// layer.
+	FlattenQueryParam = "flatten"
+)
+
 const (
 	//semantic tag partition init char
 	partitionInit = `--`
 	//semantic tag partition split char
 	partitionSplitChar = `.`
-	//semantic partition regex patter
-	semanticTagPattern = partitionInit + `\d+\` + partitionSplitChar + `\d+\` + partitionSplitChar + `\d+\` + partitionSplitChar + `\d+`
+	//semantic tag open range char
+	partitionOpenChar = `*`
+	//semantic tag whole row prefix
+	partitionRowPrefix = `r`
+	//semantic tag whole column prefix
+	partitionColPrefix = `c`
+	//semantic tag exclusion prefix
+	partitionExcludePrefix = `ex`
+	//openEnd marks a range extending to the end of the field. It is small
+	//enough for the normalization arithmetic not to overflow.
+	openEnd = math.MaxInt32
 )
 
-// CheckTagPartitions checks if the tag contains semantic partitions and returns the tag and the partitions
-func CheckTagPartitions(tag string) (string, []Partition) {
-	partitions := []Partition{}
-	onlyTag := tag
-	re := regexp.MustCompile(semanticTagPattern)
-	matches := re.FindAllString(tag, -1)
-
-	if len(matches) > 0 {
-		onlyTag = strings.Split(tag, partitionInit)[0]
-		//semantic tag with partition
-		log.Default().Printf("Semantic tag with partition detected %s\n", tag)
-		for _, match := range matches {
-			part, err := parsePartition(strings.Replace(match, partitionInit, "", -1))
-			if err != nil {
-				log.Default().Printf("[WARNING] Invalid partition %s, skipping...\n", match)
+// ConcurrencyLimit bounds the blobs looked up in parallel while partitioning
+// a manifest, and the manifests of an index partitioned in parallel.
+var ConcurrencyLimit = runtime.GOMAXPROCS(0)
+
+// concurrencyLimitKey is the context key of the limit shared by the lookups
+// of the partitionings using the context.
+type concurrencyLimitKey struct{}
+
+// WithConcurrencyLimit returns a context whose partitionings share a single
+// limit of ConcurrencyLimit blobs looked up in parallel, such as the ones of
+// the manifests of an index partitioned in parallel. Partitionings otherwise
+// have a limit of their own.
+func WithConcurrencyLimit(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(concurrencyLimitKey{}).(chan struct{}); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, concurrencyLimitKey{}, make(chan struct{}, ConcurrencyLimit))
+}
+
+// lookupAll runs lookup for every index below n in parallel, within the
+// concurrency limit of ctx, and returns the first error.
+func lookupAll(ctx context.Context, n int, lookup func(ctx context.Context, i int) error) error {
+	limit := WithConcurrencyLimit(ctx).Value(concurrencyLimitKey{}).(chan struct{})
+	g, gctx := errgroup.WithContext(ctx)
+	for i := range n {
+		select {
+		case limit <- struct{}{}:
+		case <-gctx.Done():
+			if err := g.Wait(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+		g.Go(func() error {
+			defer func() { <-limit }()
+			return lookup(gctx, i)
+		})
+	}
+	return g.Wait()
+}
+
+const (
+	// AnnotationSourceDigest is the annotation of partitioned manifests and
+	// indexes holding the digest of the 2dfs manifest they derive from.
+	AnnotationSourceDigest = "org.2dfs.partition.source.digest"
+	// AnnotationSourceTag is the annotation of partitioned manifests and
+	// indexes holding the tag the 2dfs source was requested by, if any.
+	AnnotationSourceTag = "org.2dfs.partition.source.tag"
+	// AnnotationPartitions is the annotation of partitioned manifests and
+	// indexes holding the normalized partition set, see FormatPartitions.
+	AnnotationPartitions = "org.2dfs.partition.set"
+)
+
+// Provenance describes the 2dfs manifest or index a partitioned one is
+// derived from.
+type Provenance struct {
+	// Source is the descriptor of the 2dfs manifest or index.
+	Source distribution.Descriptor
+	// Tag is the tag the source was requested by, empty for digest
+	// references.
+	Tag string
+}
+
+// annotations returns the annotations of the manifest derived from the
+// source with the partitions, keeping the source annotations.
+func (prov Provenance) annotations(source map[string]string, partitions []Partition) map[string]string {
+	annotations := make(map[string]string, len(source)+3)
+	for k, v := range source {
+		annotations[k] = v
+	}
+	if prov.Source.Digest != "" {
+		annotations[AnnotationSourceDigest] = prov.Source.Digest.String()
+	}
+	if prov.Tag != "" {
+		annotations[AnnotationSourceTag] = prov.Tag
+	}
+	annotations[AnnotationPartitions] = FormatPartitions(partitions)
+	return annotations
+}
+
+// subject returns the descriptor of the source, or nil if unknown.
+func (prov Provenance) subject() *distribution.Descriptor {
+	if prov.Source.Digest == "" {
+		return nil
+	}
+	return &distribution.Descriptor{
+		MediaType: prov.Source.MediaType,
+		Digest:    prov.Source.Digest,
+		Size:      prov.Source.Size,
+	}
+}
+
+// ErrPartitionInvalid is returned when a requested partition is malformed
+// or does not fit the 2dfs field.
+type ErrPartitionInvalid struct {
+	Partition string
+	Reason    string
+}
+
+func (err ErrPartitionInvalid) Error() string {
+	return fmt.Sprintf("invalid partition %q: %s", err.Partition, err.Reason)
+}
+
+// String returns the semantic tag representation of the partition.
+func (p Partition) String() string {
+	coordinates := make([]string, 0, 4)
+	for _, c := range []int{p.x1, p.y1, p.x2, p.y2} {
+		if c == openEnd {
+			coordinates = append(coordinates, partitionOpenChar)
+		} else {
+			coordinates = append(coordinates, strconv.Itoa(c))
+		}
+	}
+	formatted := strings.Join(coordinates, partitionSplitChar)
+	if p.exclude {
+		return partitionExcludePrefix + formatted
+	}
+	return formatted
+}
+
+// name returns the semantic tag segment naming the partition in errors.
+func (p Partition) name() string {
+	if p.segment != "" {
+		return p.segment
+	}
+	return p.String()
+}
+
+// contains reports whether the allotment at row, col lies in the partition.
+func (p Partition) contains(row, col int) bool {
+	return row >= p.x1 && row <= p.x2 && col >= p.y1 && col <= p.y2
+}
+
+// partitionsContain reports whether the allotment at row, col lies in one of
+// the normalized partitions.
+func partitionsContain(partitions []Partition, row, col int) bool {
+	for _, p := range partitions {
+		if p.contains(row, col) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizePartitions returns the canonical form of a partition set: the
+// disjoint rectangles covering the same cells, sorted in row-major order.
+// Overlapping and adjacent partitions are merged, exclusions subtracted and
+// empty partitions dropped, so that equivalent sets always share the same
+// normalized form.
+func NormalizePartitions(partitions []Partition) []Partition {
+	included := []Partition{}
+	excluded := []Partition{}
+	for _, p := range partitions {
+		if p.x1 > p.x2 || p.y1 > p.y2 {
+			continue
+		}
+		if p.exclude {
+			excluded = append(excluded, p)
+		} else {
+			included = append(included, p)
+		}
+	}
+	// exclusions alone apply to the whole field
+	if len(included) == 0 && len(excluded) > 0 {
+		included = append(included, Partition{x2: openEnd, y2: openEnd})
+	}
+
+	// split the rows in bands where the set of partitions crossing them
+	// does not change
+	bounds := []int{}
+	for _, p := range append(slices.Clone(included), excluded...) {
+		bounds = append(bounds, p.x1, p.x2+1)
+	}
+	sort.Ints(bounds)
+	bounds = slices.Compact(bounds)
+
+	normalized := []Partition{}
+	// open holds the rectangles that may still grow in the next band
+	open := []Partition{}
+	for i := 0; i+1 < len(bounds); i++ {
+		top, bottom := bounds[i], bounds[i+1]-1
+		merged := subtractColumns(bandColumns(included, top, bottom), bandColumns(excluded, top, bottom))
+
+		// extend the rectangles of the previous band if it covers the very
+		// same columns, close them otherwise
+		if len(open) == len(merged) && len(open) > 0 && open[0].x2+1 == top {
+			same := true
+			for j := range merged {
+				if open[j].y1 != merged[j].y1 || open[j].y2 != merged[j].y2 {
+					same = false
+					break
+				}
+			}
+			if same {
+				for j := range open {
+					open[j].x2 = bottom
+				}
 				continue
 			}
-			partitions = append(partitions, part)
-			log.Default().Printf("[PARTITIONING...] Added partition %+v \n", part)
 		}
+		normalized = append(normalized, open...)
+		open = open[:0:0]
+		for _, c := range merged {
+			open = append(open, Partition{x1: top, y1: c.y1, x2: bottom, y2: c.y2})
+		}
+	}
+	normalized = append(normalized, open...)
+
+	sort.Slice(normalized, func(a, b int) bool {
+		if normalized[a].x1 != normalized[b].x1 {
+			return normalized[a].x1 < normalized[b].x1
+		}
+		return normalized[a].y1 < normalized[b].y1
+	})
+	return normalized
+}
+
+// bandColumns returns the sorted, merged column ranges of the partitions
+// crossing the rows top to bottom.
+func bandColumns(partitions []Partition, top, bottom int) []Partition {
+	columns := []Partition{}
+	for _, p := range partitions {
+		if p.x1 > top || p.x2 < bottom {
+			continue
+		}
+		columns = append(columns, Partition{y1: p.y1, y2: p.y2})
+	}
+	sort.Slice(columns, func(a, b int) bool { return columns[a].y1 < columns[b].y1 })
+	merged := []Partition{}
+	for _, c := range columns {
+		if last := len(merged) - 1; last >= 0 && c.y1 <= merged[last].y2+1 {
+			merged[last].y2 = max(merged[last].y2, c.y2)
+			continue
+		}
+		merged = append(merged, c)
 	}
-	return onlyTag, partitions
+	return merged
+}
+
+// subtractColumns removes the excluded column ranges from the included
+// ones, both sorted and merged.
+func subtractColumns(included, excluded []Partition) []Partition {
+	result := []Partition{}
+	for _, c := range included {
+		for _, e := range excluded {
+			if e.y2 < c.y1 || e.y1 > c.y2 {
+				continue
+			}
+			if e.y1 > c.y1 {
+				result = append(result, Partition{y1: c.y1, y2: e.y1 - 1})
+			}
+			c.y1 = e.y2 + 1
+			if c.y1 > c.y2 {
+				break
+			}
+		}
+		if c.y1 <= c.y2 {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// FormatPartitions returns the representation of the normalized partition
+// set, so that equivalent sets share the same representation.
+func FormatPartitions(partitions []Partition) string {
+	normalized := NormalizePartitions(partitions)
+	formatted := make([]string, 0, len(normalized))
+	for _, p := range normalized {
+		formatted = append(formatted, p.String())
+	}
+	return strings.Join(formatted, partitionInit)
+}
+
+// ClampPartitions returns the normalized partition set restricted to a grid
+// of rows by cols allotments, with its open ends closed at the last row or
+// column of the grid. The open forms and the explicit rectangles selecting the
+// same allotments of a field thus share the same representation. Partitions
+// should be checked to fit the field first, see CheckPartitionBounds.
+func ClampPartitions(partitions []Partition, rows, cols int) []Partition {
+	return ClipPartitions(partitions, []Partition{{x2: rows - 1, y2: cols - 1}})
+}
+
+// ClipPartitions returns the normalized partition set selecting the
+// allotments selected by both partitions and allowed. The set is empty if
+// they have no allotment in common.
+func ClipPartitions(partitions, allowed []Partition) []Partition {
+	clipped := []Partition{}
+	for _, p := range NormalizePartitions(partitions) {
+		for _, a := range NormalizePartitions(allowed) {
+			c := Partition{x1: max(p.x1, a.x1), y1: max(p.y1, a.y1), x2: min(p.x2, a.x2), y2: min(p.y2, a.y2)}
+			if c.x1 <= c.x2 && c.y1 <= c.y2 {
+				clipped = append(clipped, c)
+			}
+		}
+	}
+	return NormalizePartitions(clipped)
+}
+
+// CheckTagPartitions checks if the tag contains semantic partitions and
+// returns the tag and the partitions, following the grammar described by
+// PartitionGrammarVersion. Every segment following the first partition
+// separator must be a well formed partition, an ErrPartitionInvalid naming
+// the first offending segment is returned otherwise. Tags may contain the
+// partition separator as well, callers look the tag up before parsing it.
+func CheckTagPartitions(tag string) (string, []Partition, error) {
+	onlyTag, partitions, found := strings.Cut(tag, partitionInit)
+	if !found {
+		return tag, []Partition{}, nil
+	}
+	parsed, err := ParsePartitions(partitions)
+	if err != nil {
+		return onlyTag, nil, err
+	}
+	return onlyTag, parsed, nil
+}
+
+// ParsePartitions parses a list of partitions separated by "--", as found
+// after the tag of a semantic tag, in a partition query parameter or in a
+// PartitionHeader.
+func ParsePartitions(partitions string) ([]Partition, error) {
+	segments := strings.Split(partitions, partitionInit)
+	parsed := make([]Partition, 0, len(segments))
+	for _, segment := range segments {
+		part, err := parsePartition(segment)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, part)
+	}
+	return parsed, nil
 }
 
 func parsePartition(p string) (Partition, error) {
-	parts := strings.Split(p, partitionSplitChar)
-	result := Partition{}
+	result := Partition{segment: p}
+	body := p
+	if strings.HasPrefix(body, partitionExcludePrefix) {
+		result.exclude = true
+		body = strings.TrimPrefix(body, partitionExcludePrefix)
+	}
+
+	switch {
+	case strings.HasPrefix(body, partitionRowPrefix):
+		row, err := parseCoordinate(p, strings.TrimPrefix(body, partitionRowPrefix))
+		if err != nil {
+			return result, err
+		}
+		result.x1, result.y1, result.x2, result.y2 = row, 0, row, openEnd
+		return result, nil
+	case strings.HasPrefix(body, partitionColPrefix):
+		col, err := parseCoordinate(p, strings.TrimPrefix(body, partitionColPrefix))
+		if err != nil {
+			return result, err
+		}
+		result.x1, result.y1, result.x2, result.y2 = 0, col, openEnd, col
+		return result, nil
+	}
+
+	parts := strings.Split(body, partitionSplitChar)
 	if len(parts) != 4 {
-		return result, fmt.Errorf("invalid partition %s", p)
+		return result, ErrPartitionInvalid{Partition: p, Reason: "expected x1.y1.x2.y2, rN or cN"}
 	}
-	var err error
-	result.x1, err = strconv.Atoi(parts[0])
+	coordinates := make([]int, len(parts))
+	for i, part := range parts {
+		if part == partitionOpenChar {
+			// an open start begins at the first row or column
+			if i < 2 {
+				coordinates[i] = 0
+			} else {
+				coordinates[i] = openEnd
+			}
+			continue
+		}
+		value, err := parseCoordinate(p, part)
+		if err != nil {
+			return result, err
+		}
+		coordinates[i] = value
+	}
+	result.x1, result.y1, result.x2, result.y2 = coordinates[0], coordinates[1], coordinates[2], coordinates[3]
+	if result.x1 > result.x2 {
+		return result, ErrPartitionInvalid{Partition: p, Reason: fmt.Sprintf("row %d is after row %d", result.x1, result.x2)}
+	}
+	if result.y1 > result.y2 {
+		return result, ErrPartitionInvalid{Partition: p, Reason: fmt.Sprintf("column %d is after column %d", result.y1, result.y2)}
+	}
+	return result, nil
+}
+
+// parseCoordinate parses a single coordinate of the partition segment p.
+func parseCoordinate(p, coordinate string) (int, error) {
+	// only plain decimal digits, Atoi would also accept signs
+	if coordinate == "" || strings.Trim(coordinate, "0123456789") != "" {
+		return 0, ErrPartitionInvalid{Partition: p, Reason: fmt.Sprintf("coordinate %q is not a non-negative integer", coordinate)}
+	}
+	value, err := strconv.Atoi(coordinate)
+	if err != nil || value >= openEnd {
+		return 0, ErrPartitionInvalid{Partition: p, Reason: fmt.Sprintf("coordinate %q is out of range", coordinate)}
+	}
+	return value, nil
+}
+
+// CheckPartitionBounds checks that every partition lies within the grid of
+// the field, as declared by its rows_size and allotments_size. Open ranges
+// only need to start within the grid.
+func CheckPartitionBounds(field tdfsfilesystem.Field, partitions []Partition) error {
+	fs, ok := field.(*tdfsfilesystem.TwoDFilesystem)
+	if !ok || fs == nil {
+		return ErrFieldInvalid{Reason: fmt.Sprintf("unsupported field type %T", field)}
+	}
+	for _, p := range partitions {
+		lastRow := p.x2
+		if lastRow == openEnd {
+			lastRow = p.x1
+		}
+		if lastRow >= fs.TotRows {
+			return ErrPartitionInvalid{Partition: p.name(), Reason: fmt.Sprintf("row %d is out of the field rows_size %d", lastRow, fs.TotRows)}
+		}
+		columns := 0
+		for row := p.x1; row <= p.x2 && row < len(fs.Rows); row++ {
+			columns = max(columns, fs.Rows[row].TotAllotments)
+		}
+		lastCol := p.y2
+		if lastCol == openEnd {
+			lastCol = p.y1
+		}
+		if lastCol >= columns {
+			return ErrPartitionInvalid{Partition: p.name(), Reason: fmt.Sprintf("column %d is out of the field allotments_size %d", lastCol, columns)}
+		}
+	}
+	return nil
+}
+
+// ConvertTdfsManifestToOciManifest derives the image manifest holding the
+// partitions of the 2dfs manifest, materializing the selected allotments of
+// every field layer, and returns it with the number of allotments selected.
+// The derived manifest records its provenance through annotations and its
+// subject.
+func ConvertTdfsManifestToOciManifest(ctx context.Context, tdfsManifest *ocischema.DeserializedManifest, blobService distribution.BlobService, partitions []Partition, provenance Provenance) (distribution.Manifest, int, error) {
+	return convertTdfsManifest(ctx, tdfsManifest, blobService, partitions, provenance, nil)
+}
+
+// ConvertTdfsManifestToFlatOciManifest derives the image manifest holding
+// the partitions of the 2dfs manifest like ConvertTdfsManifestToOciManifest,
+// merging the allotments selected in the field layers into the single layer
+// returned by flatten.
+func ConvertTdfsManifestToFlatOciManifest(ctx context.Context, tdfsManifest *ocischema.DeserializedManifest, blobService distribution.BlobService, partitions []Partition, provenance Provenance, flatten Flattener) (distribution.Manifest, int, error) {
+	return convertTdfsManifest(ctx, tdfsManifest, blobService, partitions, provenance, flatten)
+}
+
+// convertTdfsManifest derives the partitioned manifest, flattening the
+// allotments of the fields with flatten if set, and returns it with the
+// number of allotments selected.
+func convertTdfsManifest(ctx context.Context, tdfsManifest *ocischema.DeserializedManifest, blobService distribution.BlobService, partitions []Partition, provenance Provenance, flatten Flattener) (distribution.Manifest, int, error) {
+	ctx, span := tracer.Start(
+		ctx,
+		"ConvertTdfsManifest",
+		trace.WithAttributes(
+			attribute.String(tracing.AttributePrefix+"tdfs.source.digest", provenance.Source.Digest.String()),
+			attribute.String(tracing.AttributePrefix+"tdfs.partitions", FormatPartitions(partitions)),
+			attribute.Bool(tracing.AttributePrefix+"tdfs.flatten", flatten != nil),
+		))
+	defer span.End()
+
+	dcontext.GetLogger(ctx).Debugf("converting 2dfs manifest %s", provenance.Source.Digest)
+	newLayers := []distribution.Descriptor{}
+	newDiffIDs := []digest.Digest{}
+	config, err := getConfig(ctx, blobService, tdfsManifest.Config)
 	if err != nil {
-		return result, err
+		return nil, 0, err
 	}
-	result.y1, err = strconv.Atoi(parts[1])
+
+	partitioned, err := partitionLayers(ctx, tdfsManifest, blobService, partitions)
 	if err != nil {
-		return result, err
+		return nil, 0, err
 	}
-	result.x2, err = strconv.Atoi(parts[2])
+	layers := partitioned.layers
+	if flatten != nil {
+		layers, err = flattenLayers(ctx, layers, flatten)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	//the config diffIDs only list the regular layers, consume them in layer order
+	diffIDs := config.RootFS.DiffIDs
+	nextDiffID := 0
+	for _, layer := range layers {
+		newLayers = append(newLayers, layer.Descriptor)
+		if layer.allotment {
+			newDiffIDs = append(newDiffIDs, layer.diffID)
+			nextDiffID = min(nextDiffID+layer.merged, len(diffIDs))
+		} else if nextDiffID < len(diffIDs) {
+			newDiffIDs = append(newDiffIDs, diffIDs[nextDiffID])
+			nextDiffID++
+		}
+	}
+	config.RootFS.DiffIDs = append(newDiffIDs, diffIDs[nextDiffID:]...)
+	config.History = partitionedHistory(ctx, config.History, tdfsManifest.Layers, partitioned.materialized, flatten != nil)
+
+	newConfig, err := json.Marshal(config)
 	if err != nil {
-		return result, err
+		return nil, 0, err
 	}
-	result.y2, err = strconv.Atoi(parts[3])
+
+	//create new manifest, storing its config
+	ctx, buildSpan := tracer.Start(
+		ctx,
+		"BuildManifest",
+		trace.WithAttributes(attribute.Int(tracing.AttributePrefix+"tdfs.layers", len(newLayers))))
+	defer buildSpan.End()
+
+	// the annotation records the partitions as they apply to the fields
+	clamped := ClampPartitions(partitions, partitioned.rows, partitioned.cols)
+	manifestBuilder := ocischema.NewManifestBuilder(blobService, newConfig, provenance.annotations(tdfsManifest.Annotations, clamped))
+	manifestBuilder.SetSubject(provenance.subject())
+	err = manifestBuilder.SetMediaType(v1.MediaTypeImageManifest)
 	if err != nil {
-		return result, err
+		return nil, 0, err
 	}
-	return result, nil
+	for _, layer := range newLayers {
+		err := manifestBuilder.AppendReference(layer)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	derived, err := manifestBuilder.Build(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return derived, partitioned.allotments(), nil
 }
 
-func ConvertTdfsManifestToOciManifest(ctx context.Context, tdfsManifest *ocischema.DeserializedManifest, blobService distribution.BlobService, partitions []Partition) (distribution.Manifest, error) {
+// getConfig fetches and unmarshals the image config described by desc.
+func getConfig(ctx context.Context, blobService distribution.BlobService, desc distribution.Descriptor) (v1.Image, error) {
+	ctx, span := tracer.Start(
+		ctx,
+		"GetConfig",
+		trace.WithAttributes(attribute.String(tracing.AttributePrefix+"tdfs.config.digest", desc.Digest.String())))
+	defer span.End()
 
-	log.Default().Printf("Converting TDFS manifest to OCI manifest\n")
-	newLayers := []distribution.Descriptor{}
-	partitionAllotment := []tdfsfilesystem.Allotment{}
-	layerConfigBlob, err := blobService.Get(ctx, tdfsManifest.Config.Digest)
+	var config v1.Image
+	content, err := blobService.Get(ctx, desc.Digest)
 	if err != nil {
-		log.Default().Printf("Error getting config %s\n", tdfsManifest.Config.Digest)
-		return nil, err
+		return config, err
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return config, fmt.Errorf("unmarshaling config %s: %w", desc.Digest, err)
 	}
-	var config v1.Image = v1.Image{}
-	err = json.Unmarshal(layerConfigBlob, &config)
+	return config, nil
+}
+
+// getField fetches and unmarshals the 2dfs field stored in the layer,
+// returning the field with the media types recorded for its allotments. The
+// field is nil if the layer holds none.
+func getField(ctx context.Context, blobService distribution.BlobService, layer distribution.Descriptor) (tdfsfilesystem.Field, map[allotmentPosition]string, error) {
+	ctx, span := tracer.Start(
+		ctx,
+		"GetField",
+		trace.WithAttributes(attribute.String(tracing.AttributePrefix+"tdfs.field.digest", layer.Digest.String())))
+	defer span.End()
+
+	content, err := blobService.Get(ctx, layer.Digest)
 	if err != nil {
-		log.Default().Printf("Error unmarshalling config %s\n", tdfsManifest.Config.Digest)
-		return nil, err
+		return nil, nil, err
 	}
 
-	//select partitions
+	_, unmarshalSpan := tracer.Start(
+		ctx,
+		"UnmarshalField",
+		trace.WithAttributes(attribute.Int(tracing.AttributePrefix+"tdfs.field.size", len(content))))
+	defer unmarshalSpan.End()
+
+	mediaTypes := fieldMediaTypes(content)
+	field, err := UnmarshalField(content)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("invalid field %s: %v", layer.Digest, err)
+		return nil, nil, err
+	}
+	if fs, ok := field.(*tdfsfilesystem.TwoDFilesystem); ok && fs != nil {
+		rows, cols := fieldGrid(fs)
+		attrs := []attribute.KeyValue{
+			attribute.Int(tracing.AttributePrefix+"tdfs.field.rows", rows),
+			attribute.Int(tracing.AttributePrefix+"tdfs.field.cols", cols),
+		}
+		unmarshalSpan.SetAttributes(attrs...)
+		span.SetAttributes(attrs...)
+	}
+	return field, mediaTypes, nil
+}
+
+// fieldGrid returns the number of rows of the field and the number of
+// allotments of its widest row, as declared by its rows_size and
+// allotments_size.
+func fieldGrid(fs *tdfsfilesystem.TwoDFilesystem) (int, int) {
+	cols := 0
+	for _, row := range fs.Rows {
+		cols = max(cols, row.TotAllotments)
+	}
+	return fs.TotRows, cols
+}
+
+// partitionedLayer is a layer of a partitioned manifest, either a regular
+// layer of the source manifest or a materialized allotment.
+type partitionedLayer struct {
+	distribution.Descriptor
+
+	// allotment is true for the layers materialized from a field.
+	allotment bool
+
+	// diffID is the diffID of a materialized allotment.
+	diffID digest.Digest
+
+	// field is the index of the source layer of a materialized allotment.
+	field int
+
+	// merged counts the regular layers merged into a flattened layer.
+	merged int
+}
+
+// partitionedLayers are the layers of a partitioned manifest, as selected by
+// partitionLayers.
+type partitionedLayers struct {
+	layers []partitionedLayer
+
+	// materialized holds the allotments materialized for the field layers,
+	// by layer index.
+	materialized map[int][]tdfsfilesystem.Allotment
+
+	// rows and cols are the size of the grid enclosing every field.
+	rows int
+	cols int
+}
+
+// allotments returns the number of allotments materialized for the fields.
+func (partitioned partitionedLayers) allotments() int {
+	count := 0
+	for _, allotments := range partitioned.materialized {
+		count += len(allotments)
+	}
+	return count
+}
+
+// partitionLayers selects the layers of the manifest holding the partitions
+// of the 2dfs manifest, replacing every field layer with its selected
+// allotments. The allotments are only stat'ed, nothing is stored.
+func partitionLayers(ctx context.Context, tdfsManifest *ocischema.DeserializedManifest, blobService distribution.BlobService, partitions []Partition) (partitionedLayers, error) {
+	partitioned := partitionedLayers{materialized: map[int][]tdfsfilesystem.Allotment{}}
+	layers := []partitionedLayer{}
+	selected := NormalizePartitions(partitions)
+	bounds := newFieldBounds(partitions)
+	materialized := partitioned.materialized
+
+	//select partitions, materializing every field at the position it appears in
+	for i, layer := range tdfsManifest.Layers {
+		if layer.MediaType != MediaTypeTdfsLayer {
+			layers = append(layers, partitionedLayer{Descriptor: layer})
+			continue
+		}
+		materialized[i] = nil
+		dcontext.GetLogger(ctx).Debugf("partitioning field %s", layer.Digest)
+		field, mediaTypes, err := getField(ctx, blobService, layer)
+		if err != nil {
+			return partitionedLayers{}, err
+		}
+		if field == nil {
+			continue
+		}
+		bounds.add(field)
+
+		partitionAllotment := selectAllotments(field, selected)
+
+		//adding partitioned layers, looking up the allotments in parallel
+		allotmentLayers, err := statAllotments(ctx, blobService, layer, i, partitionAllotment, mediaTypes)
+		if err != nil {
+			return partitionedLayers{}, err
+		}
+		layers = append(layers, allotmentLayers...)
+		materialized[i] = partitionAllotment
+		dcontext.GetLogger(ctx).Debugf("selected %d allotments of field %s", len(partitionAllotment), layer.Digest)
+	}
+	if err := bounds.err(); err != nil {
+		return partitionedLayers{}, err
+	}
+	partitioned.layers = layers
+	partitioned.rows, partitioned.cols = bounds.rows, bounds.cols
+	return partitioned, nil
+}
+
+// CheckManifestPartitions checks that every partition fits at least one of
+// the fields of the 2dfs manifest, as ConvertTdfsManifestToOciManifest does,
+// and returns the size of the grid enclosing the fields. Only the fields are
+// read, the allotments are not looked up.
+func CheckManifestPartitions(ctx context.Context, tdfsManifest *ocischema.DeserializedManifest, blobService distribution.BlobService, partitions []Partition) (int, int, error) {
+	bounds := newFieldBounds(partitions)
 	for _, layer := range tdfsManifest.Layers {
-		if layer.MediaType == MediaTypeTdfsLayer {
-			log.Default().Printf("Converting tdfs layer %s\n", layer.Digest)
-			layerContent, err := blobService.Get(ctx, layer.Digest)
-			if err != nil {
-				log.Default().Printf("Error getting layer %s\n", layer.Digest)
-				return nil, err
-			}
-			field, err := tdfsfilesystem.GetField().Unmarshal(string(layerContent))
-			if err != nil {
-				log.Default().Printf("Error unmarshalling layer %s\n", layer.Digest)
-				return nil, err
-			}
-			if len(partitionAllotment) == 0 {
-				log.Default().Printf("Adding field!!\n")
-				if field != nil {
-					for allotment := range field.IterateAllotments() {
-						//skip empty allotments
-						if allotment.Digest == "" {
-							continue
-						}
-						for _, p := range partitions {
-							if allotment.Row >= p.x1 && allotment.Row <= p.x2 && allotment.Col >= p.y1 && allotment.Col <= p.y2 {
-								log.Default().Printf("Added partition %d,%d,%d,%d \n", p.x1, p.y1, p.x2, p.y2)
-								partitionAllotment = append(partitionAllotment, allotment)
-								//TODO remove duplicated
-							}
-						}
-					}
-				}
+		if layer.MediaType != MediaTypeTdfsLayer {
+			continue
+		}
+		field, _, err := getField(ctx, blobService, layer)
+		if err != nil {
+			return 0, 0, err
+		}
+		if field == nil {
+			continue
+		}
+		bounds.add(field)
+	}
+	if err := bounds.err(); err != nil {
+		return 0, 0, err
+	}
+	return bounds.rows, bounds.cols, nil
+}
+
+// FieldPartitions returns the normalized partition set selecting every
+// allotment of the fields of the 2dfs manifest, as declared by their
+// rows_size and allotments_size. Only the fields are read, the allotments are
+// not looked up.
+func FieldPartitions(ctx context.Context, tdfsManifest *ocischema.DeserializedManifest, blobService distribution.BlobService) ([]Partition, error) {
+	partitions := []Partition{}
+	for _, layer := range tdfsManifest.Layers {
+		if layer.MediaType != MediaTypeTdfsLayer {
+			continue
+		}
+		field, _, err := getField(ctx, blobService, layer)
+		if err != nil {
+			return nil, err
+		}
+		fs, ok := field.(*tdfsfilesystem.TwoDFilesystem)
+		if !ok || fs == nil {
+			continue
+		}
+		for row, r := range fs.Rows {
+			if r.TotAllotments > 0 {
+				partitions = append(partitions, Partition{x1: row, y1: 0, x2: row, y2: r.TotAllotments - 1})
 			}
-		} else {
-			log.Default().Printf("Appended layer %s\n", layer.Digest)
-			newLayers = append(newLayers, layer)
 		}
 	}
+	return NormalizePartitions(partitions), nil
+}
+
+// fieldBounds checks partitions against the stacked fields of a manifest,
+// which may differ in size: a partition has to fit at least one of them.
+type fieldBounds struct {
+	partitions  []Partition
+	fits        map[Partition]bool
+	outOfBounds map[Partition]error
+
+	// rows and cols are the size of the grid enclosing the fields.
+	rows int
+	cols int
+}
+
+func newFieldBounds(partitions []Partition) *fieldBounds {
+	return &fieldBounds{
+		partitions:  partitions,
+		fits:        map[Partition]bool{},
+		outOfBounds: map[Partition]error{},
+	}
+}
 
-	//create new layers
-	if len(partitionAllotment) > 0 {
-		//adding partitioned layers
-		for _, p := range partitionAllotment {
-			blob, err := blobService.Stat(ctx, digest.Digest(fmt.Sprintf("sha256:%s", p.Digest)))
-			if err != nil {
-				log.Default().Printf("Unable to find allotment %s\n", p.Digest)
-				return nil, err
+// add checks the partitions against one more field.
+func (b *fieldBounds) add(field tdfsfilesystem.Field) {
+	if fs, ok := field.(*tdfsfilesystem.TwoDFilesystem); ok && fs != nil {
+		rows, cols := fieldGrid(fs)
+		b.rows, b.cols = max(b.rows, rows), max(b.cols, cols)
+	}
+	for _, p := range b.partitions {
+		if err := CheckPartitionBounds(field, []Partition{p}); err != nil {
+			if _, seen := b.outOfBounds[p]; !seen {
+				b.outOfBounds[p] = err
 			}
-			fmt.Printf("Partition %s [CREATING]\n", p.Digest)
-			newLayers = append(newLayers, distribution.Descriptor{
-				MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
-				Digest:    digest.Digest(fmt.Sprintf("sha256:%s", p.Digest)),
-				Size:      blob.Size,
-			})
-			config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.Digest(fmt.Sprintf("sha256:%s", p.DiffID)))
+		} else {
+			b.fits[p] = true
 		}
-		log.Default().Printf("Allotments added!\n")
 	}
+}
 
-	newConfig, err := json.Marshal(config)
+// err returns the error of the first partition fitting none of the fields.
+func (b *fieldBounds) err() error {
+	for _, p := range b.partitions {
+		if err, ok := b.outOfBounds[p]; ok && !b.fits[p] {
+			return err
+		}
+	}
+	return nil
+}
+
+// statAllotments looks up the selected allotments of the field stored in
+// layer, the index-th layer of the manifest, in parallel within the
+// concurrency limit of ctx, and returns their partitioned layers.
+func statAllotments(ctx context.Context, blobService distribution.BlobService, layer distribution.Descriptor, index int, allotments []tdfsfilesystem.Allotment, mediaTypes map[allotmentPosition]string) ([]partitionedLayer, error) {
+	ctx, span := tracer.Start(
+		ctx,
+		"StatAllotments",
+		trace.WithAttributes(
+			attribute.String(tracing.AttributePrefix+"tdfs.field.digest", layer.Digest.String()),
+			attribute.Int(tracing.AttributePrefix+"tdfs.allotments", len(allotments)),
+		))
+	defer span.End()
+
+	allotmentLayers := make([]partitionedLayer, len(allotments))
+	err := lookupAll(ctx, len(allotments), func(ctx context.Context, j int) error {
+		p := allotments[j]
+		blob, err := blobService.Stat(ctx, AllotmentDigest(p))
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("unable to find allotment %d.%d of field %s: %v", p.Row, p.Col, layer.Digest, err)
+			return err
+		}
+		recorded := mediaTypes[allotmentPosition{row: p.Row, col: p.Col}]
+		allotmentLayers[j] = partitionedLayer{
+			Descriptor: distribution.Descriptor{
+				MediaType: allotmentMediaType(ctx, blobService, blob, recorded),
+				Digest:    AllotmentDigest(p),
+				Size:      blob.Size,
+			},
+			allotment: true,
+			diffID:    AllotmentDiffID(p),
+			field:     index,
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return allotmentLayers, nil
+}
 
-	//create new manifest
-	manifestBuilder := ocischema.NewManifestBuilder(blobService, newConfig, tdfsManifest.Annotations)
-	err = manifestBuilder.SetMediaType(v1.MediaTypeImageManifest)
+// selectAllotments returns the non-empty allotments of the field lying in
+// the normalized partitions. Every selected allotment is returned once, in
+// row-major order.
+func selectAllotments(field tdfsfilesystem.Field, selected []Partition) []tdfsfilesystem.Allotment {
+	allotments := []tdfsfilesystem.Allotment{}
+	for allotment := range field.IterateAllotments() {
+		//skip empty allotments
+		if allotment.Digest == "" {
+			continue
+		}
+		for _, p := range selected {
+			if p.contains(allotment.Row, allotment.Col) {
+				allotments = append(allotments, allotment)
+				break
+			}
+		}
+	}
+	sort.SliceStable(allotments, func(i, j int) bool {
+		if allotments[i].Row != allotments[j].Row {
+			return allotments[i].Row < allotments[j].Row
+		}
+		return allotments[i].Col < allotments[j].Col
+	})
+	return slices.CompactFunc(allotments, func(a, b tdfsfilesystem.Allotment) bool {
+		return a.Row == b.Row && a.Col == b.Col
+	})
+}
+
+// flattenLayers replaces the allotments materialized for the fields with
+// the single layer returned by flatten. Regular layers stacked between the
+// fields are merged into the flattened layer as well, so that it keeps the
+// order in which the layers apply.
+func flattenLayers(ctx context.Context, layers []partitionedLayer, flatten Flattener) ([]partitionedLayer, error) {
+	first, last := -1, -1
+	for i, layer := range layers {
+		if layer.allotment {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 {
+		return layers, nil
+	}
+
+	merged := make([]distribution.Descriptor, 0, last-first+1)
+	flattenedLayer := partitionedLayer{allotment: true, field: layers[last].field}
+	for _, layer := range layers[first : last+1] {
+		merged = append(merged, layer.Descriptor)
+		if !layer.allotment {
+			flattenedLayer.merged++
+		}
+	}
+	desc, diffID, err := flatten(ctx, merged)
 	if err != nil {
-		log.Default().Printf("Error setting media type %s\n", v1.MediaTypeImageManifest)
 		return nil, err
 	}
-	for _, layer := range newLayers {
-		err := manifestBuilder.AppendReference(layer)
-		if err != nil {
-			log.Default().Printf("Error appending layer %s\n", layer.Digest)
-			return nil, err
+	dcontext.GetLogger(ctx).Debugf("flattened %d layers into %s", len(merged), desc.Digest)
+	flattenedLayer.Descriptor = desc
+	flattenedLayer.diffID = diffID
+
+	flattened := make([]partitionedLayer, 0, first+1+len(layers)-last-1)
+	flattened = append(flattened, layers[:first]...)
+	flattened = append(flattened, flattenedLayer)
+	return append(flattened, layers[last+1:]...), nil
+}
+
+// PartitionPreview describes the layers of the manifest holding the
+// partitions of a 2dfs manifest, as returned by PreviewTdfsManifest.
+type PartitionPreview struct {
+	// Allotments are the allotments selected by the partitions, in the
+	// order they appear in the partitioned manifest.
+	Allotments []distribution.Descriptor `json:"allotments"`
+
+	// AllotmentsSize is the compressed size of the allotments.
+	AllotmentsSize int64 `json:"allotmentsSize"`
+
+	// Size is the compressed size of all the layers of the partitioned
+	// manifest, regular layers included.
+	Size int64 `json:"size"`
+}
+
+// PreviewTdfsManifest describes the layers ConvertTdfsManifestToOciManifest
+// would select for the partitions of the 2dfs manifest, without building
+// the partitioned manifest.
+func PreviewTdfsManifest(ctx context.Context, tdfsManifest *ocischema.DeserializedManifest, blobService distribution.BlobService, partitions []Partition) (PartitionPreview, error) {
+	preview := PartitionPreview{Allotments: []distribution.Descriptor{}}
+	partitioned, err := partitionLayers(ctx, tdfsManifest, blobService, partitions)
+	if err != nil {
+		return preview, err
+	}
+	for _, layer := range partitioned.layers {
+		if layer.allotment {
+			preview.Allotments = append(preview.Allotments, layer.Descriptor)
+			preview.AllotmentsSize += layer.Size
+		}
+		preview.Size += layer.Size
+	}
+	return preview, nil
+}
+
+// partitionedHistory returns the config history matching the layers of the
+// partitioned manifest: the entry of every field layer is marked as removed
+// and followed by one entry per materialized allotment. If the allotments
+// were flattened, the entries of the regular layers merged into the
+// flattened layer are marked as merged and a single entry follows the one of
+// the last field. History recorded without entries for the field layers gets
+// the allotment entries at the position of the field. History that does not
+// match the layers is returned unchanged.
+func partitionedHistory(ctx context.Context, history []v1.History, layers []distribution.Descriptor, materialized map[int][]tdfsfilesystem.Allotment, flattened bool) []v1.History {
+	if len(history) == 0 {
+		return history
+	}
+	nonEmpty := 0
+	for _, entry := range history {
+		if !entry.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	fieldHasEntry := nonEmpty == len(layers)
+	if !fieldHasEntry && nonEmpty != len(layers)-len(materialized) {
+		dcontext.GetLogger(ctx).Warnf("history has %d layer entries for %d layers, leaving it unchanged", nonEmpty, len(layers))
+		return history
+	}
+
+	// the layers from the first to the last field with allotments are
+	// flattened together
+	first, last := -1, -1
+	if flattened {
+		for i := range layers {
+			if len(materialized[i]) > 0 {
+				if first < 0 {
+					first = i
+				}
+				last = i
+			}
+		}
+	}
+
+	derived := make([]v1.History, 0, len(history))
+	flattenedFields := []string{}
+	next := 0
+	for i, layer := range layers {
+		allotments, isField := materialized[i]
+		if !isField || fieldHasEntry {
+			// copy the entries up to the one of the layer
+			for next < len(history) && history[next].EmptyLayer {
+				derived = append(derived, history[next])
+				next++
+			}
+		}
+		if !isField {
+			entry := history[next]
+			next++
+			if first < i && i < last {
+				entry.EmptyLayer = true
+				entry.Comment = fmt.Sprintf("layer %s merged into the flattened 2dfs allotments", layer.Digest)
+			}
+			derived = append(derived, entry)
+			continue
+		}
+
+		var fieldEntry v1.History
+		if fieldHasEntry {
+			fieldEntry = history[next]
+			next++
+			removed := fieldEntry
+			removed.EmptyLayer = true
+			removed.Comment = fmt.Sprintf("2dfs field %s removed by partitioning", layer.Digest)
+			derived = append(derived, removed)
+		}
+		if flattened {
+			if len(allotments) > 0 {
+				positions := make([]string, len(allotments))
+				for j, allotment := range allotments {
+					positions[j] = fmt.Sprintf("%d.%d", allotment.Row, allotment.Col)
+				}
+				flattenedFields = append(flattenedFields, fmt.Sprintf("%s of field %s", strings.Join(positions, " "), layer.Digest))
+			}
+			if i == last {
+				derived = append(derived, v1.History{
+					Created:   fieldEntry.Created,
+					CreatedBy: fmt.Sprintf("2dfs allotments %s flattened", strings.Join(flattenedFields, ", ")),
+					Author:    fieldEntry.Author,
+				})
+			}
+			continue
+		}
+		for _, allotment := range allotments {
+			derived = append(derived, v1.History{
+				Created:   fieldEntry.Created,
+				CreatedBy: fmt.Sprintf("2dfs allotment %d.%d of field %s", allotment.Row, allotment.Col, layer.Digest),
+				Author:    fieldEntry.Author,
+			})
 		}
 	}
-	return manifestBuilder.Build(ctx)
+	return append(derived, history[next:]...)
 }
 
-func ConvertPartitionedIndexToOciIndex(tdfsManifest *ocischema.DeserializedImageIndex) ([]byte, error) {
-	log.Default().Printf("Converting partitioned index to OCI index\n")
-	return tdfsManifest.MarshalJSON()
+// ConvertPartitionedIndexToOciIndex builds the index referencing the
+// partitioned manifests, keeping the annotations of the source index. The
+// derived index records its provenance through annotations and its subject.
+func ConvertPartitionedIndexToOciIndex(tdfsIndex *ocischema.DeserializedImageIndex, manifests []distribution.Descriptor, partitions []Partition, provenance Provenance) (*ocischema.DeserializedImageIndex, error) {
+	return ocischema.FromImageIndex(ocischema.ImageIndex{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   v1.MediaTypeImageIndex,
+		Manifests:   manifests,
+		Subject:     provenance.subject(),
+		Annotations: provenance.annotations(tdfsIndex.Annotations, partitions),
+	})
 }
@@ -1,8 +1,28 @@
 package tdfs
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	tdfs "github.com/2DFS/2dfs-builder/filesystem"
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/sync/errgroup"
 )
 
 type PartitionResult struct {
@@ -11,14 +31,14 @@ type PartitionResult struct {
 }
 
 var tagsAndPartitions map[string]PartitionResult = map[string]PartitionResult{
-	"v1--1.0.0.0": {
+	"v1--0.1.1.1": {
 		Tag: "v1",
 		Partitions: []Partition{
 			{
-				x1: 1,
-				y1: 0,
-				x2: 0,
-				y2: 0,
+				x1: 0,
+				y1: 1,
+				x2: 1,
+				y2: 1,
 			},
 		},
 	},
@@ -47,7 +67,10 @@ var tagsAndPartitions map[string]PartitionResult = map[string]PartitionResult{
 
 func TestCheckTagPartitions(t *testing.T) {
 	for tag, result := range tagsAndPartitions {
-		parsedTag, paresdPartitions := CheckTagPartitions(tag)
+		parsedTag, paresdPartitions, err := CheckTagPartitions(tag)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %s: %v", tag, err)
+		}
 		if parsedTag != result.Tag {
 			t.Errorf("Expected tag %s, got %s", result.Tag, parsedTag)
 		}
@@ -60,6 +83,1128 @@ func TestCheckTagPartitions(t *testing.T) {
 				t.Errorf("Expected partition %v, got %v", result.Partitions[i], partition)
 			}
 		}
-		log.Default().Printf("Tag %s with partitions %v parsed successfully\n", parsedTag, paresdPartitions)
+		t.Logf("Tag %s with partitions %v parsed successfully", parsedTag, paresdPartitions)
+	}
+}
+
+func TestCheckTagPartitionsInvalid(t *testing.T) {
+	for tag, segment := range map[string]string{
+		"v1--1.0.0.0":         "1.0.0.0",
+		"v1--0.1.0.0":         "0.1.0.0",
+		"v1--0.0.1":           "0.0.1",
+		"v1--0.0.1.1.1":       "0.0.1.1.1",
+		"v1--0.0.1.x":         "0.0.1.x",
+		"v1--0.0.1.+1":        "0.0.1.+1",
+		"v1--0.0.1.1--2.2.3":  "2.2.3",
+		"v1--":                "",
+		"v1--0.0.1.1--":       "",
+		"v1--0.0.1.1abc":      "0.0.1.1abc",
+		"v1--0.0.1.1-1.1.1.1": "0.0.1.1-1.1.1.1",
+	} {
+		_, _, err := CheckTagPartitions(tag)
+		partitionErr, ok := err.(ErrPartitionInvalid)
+		if !ok {
+			t.Errorf("Expected %s to be rejected with ErrPartitionInvalid, got %v", tag, err)
+			continue
+		}
+		if partitionErr.Partition != segment {
+			t.Errorf("Expected %s to be rejected for segment %q, got %q", tag, segment, partitionErr.Partition)
+		}
+	}
+}
+
+func TestPartitionGrammar(t *testing.T) {
+	for _, testcase := range []struct {
+		tags       []string
+		normalized string
+	}{
+		{
+			tags:       []string{"v1--r2", "v1--2.0.2.*", "v1--2.*.2.*", "v1--r2--2.1.2.3"},
+			normalized: "2.0.2.*",
+		},
+		{
+			tags:       []string{"v1--c0", "v1--0.0.*.0", "v1--*.0.*.0"},
+			normalized: "0.0.*.0",
+		},
+		{
+			tags:       []string{"v1--1.0.*.*", "v1--r1--2.0.*.*", "v1--*.*.*.*--exr0"},
+			normalized: "1.0.*.*",
+		},
+		{
+			tags:       []string{"v1--0.0.2.2--ex1.1.1.1", "v1--0.0.0.2--1.0.1.0--1.2.1.2--2.0.2.2", "v1--0.0.2.2--ex1.1.1.1--ex1.1.1.1"},
+			normalized: "0.0.0.2--1.0.1.0--1.2.1.2--2.0.2.2",
+		},
+		{
+			tags:       []string{"v1--exr1--exc1", "v1--0.0.0.0--0.2.0.*--2.0.*.0--2.2.*.*"},
+			normalized: "0.0.0.0--0.2.0.*--2.0.*.0--2.2.*.*",
+		},
+		{
+			tags:       []string{"v1--r1--exr1", "v1--0.0.1.1--ex0.0.1.1"},
+			normalized: "",
+		},
+	} {
+		for _, tag := range testcase.tags {
+			partitions := mustPartitions(t, tag)
+			if formatted := FormatPartitions(partitions); formatted != testcase.normalized {
+				t.Errorf("Expected %s to be normalized to %q, got %q", tag, testcase.normalized, formatted)
+			}
+		}
+	}
+
+	for tag, segment := range map[string]string{
+		"v1--r":                     "r",
+		"v1--c1.2":                  "c1.2",
+		"v1--rx":                    "rx",
+		"v1--ex":                    "ex",
+		"v1--2.*.0.*":               "2.*.0.*",
+		"v1--ex*.*.*":               "ex*.*.*",
+		"v1--r99999999999999999999": "r99999999999999999999",
+	} {
+		_, _, err := CheckTagPartitions(tag)
+		partitionErr, ok := err.(ErrPartitionInvalid)
+		if !ok {
+			t.Errorf("Expected %s to be rejected with ErrPartitionInvalid, got %v", tag, err)
+			continue
+		}
+		if partitionErr.Partition != segment {
+			t.Errorf("Expected %s to be rejected for segment %q, got %q", tag, segment, partitionErr.Partition)
+		}
+	}
+}
+
+func TestParsePartitions(t *testing.T) {
+	partitions, err := ParsePartitions("1.1.2.2--r0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatted := FormatPartitions(partitions); formatted != FormatPartitions(mustPartitions(t, "v1--r0--1.1.2.2")) {
+		t.Errorf("Expected the partitions to match the semantic tag ones, got %s", formatted)
+	}
+	if _, err := ParsePartitions("1.1.2.2--"); err == nil {
+		t.Errorf("Expected an empty partition to be rejected")
+	}
+}
+
+// mustPartitions returns the partitions of a valid semantic tag.
+func mustPartitions(t *testing.T, tag string) []Partition {
+	_, partitions, err := CheckTagPartitions(tag)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing %s: %v", tag, err)
+	}
+	return partitions
+}
+
+func TestFormatPartitions(t *testing.T) {
+	partitions := mustPartitions(t, "v1--1.1.2.2--0.0.1.1--1.1.2.2")
+	formatted := FormatPartitions(partitions)
+	if formatted != "0.0.0.1--1.0.1.2--2.1.2.2" {
+		t.Errorf("Expected normalized partitions 0.0.0.1--1.0.1.2--2.1.2.2, got %s", formatted)
+	}
+	if FormatPartitions(nil) != "" {
+		t.Errorf("Expected empty partitions to be formatted as an empty string")
+	}
+}
+
+func TestNormalizePartitions(t *testing.T) {
+	for _, testcase := range []struct {
+		tags       []string
+		normalized string
+	}{
+		{
+			tags:       []string{"v1--0.0.1.1", "v1--0.0.0.1--1.0.1.1", "v1--1.0.1.1--0.0.1.0--0.1.0.1"},
+			normalized: "0.0.1.1",
+		},
+		{
+			tags:       []string{"v1--0.0.1.1--1.1.2.2", "v1--1.1.2.2--0.0.1.1", "v1--0.0.0.1--1.0.1.2--2.1.2.2"},
+			normalized: "0.0.0.1--1.0.1.2--2.1.2.2",
+		},
+		{
+			tags:       []string{"v1--0.0.0.0--2.2.2.2", "v1--2.2.2.2--0.0.0.0--0.0.0.0"},
+			normalized: "0.0.0.0--2.2.2.2",
+		},
+		{
+			tags:       []string{"v1--0.0.0.0--0.2.0.2", "v1--0.2.0.2--0.0.0.0"},
+			normalized: "0.0.0.0--0.2.0.2",
+		},
+	} {
+		for _, tag := range testcase.tags {
+			partitions := mustPartitions(t, tag)
+			if formatted := FormatPartitions(partitions); formatted != testcase.normalized {
+				t.Errorf("Expected %s to be normalized to %s, got %s", tag, testcase.normalized, formatted)
+			}
+		}
+	}
+}
+
+func TestClipPartitions(t *testing.T) {
+	for _, testcase := range []struct {
+		partitions string
+		allowed    string
+		clipped    string
+	}{
+		{partitions: "v1--0.0.2.2", allowed: "v1--1.1.3.3", clipped: "1.1.2.2"},
+		{partitions: "v1--r1", allowed: "v1--0.0.1.1--c3", clipped: "1.0.1.1--1.3.1.3"},
+		{partitions: "v1--0.0.*.*", allowed: "v1--r0--ex0.1.0.1", clipped: "0.0.0.0--0.2.0.*"},
+		{partitions: "v1--r0--ex0.0.0.0", allowed: "v1--0.0.0.1", clipped: "0.1.0.1"},
+		{partitions: "v1--r2", allowed: "v1--0.0.1.1", clipped: ""},
+	} {
+		clipped := ClipPartitions(mustPartitions(t, testcase.partitions), mustPartitions(t, testcase.allowed))
+		if formatted := FormatPartitions(clipped); formatted != testcase.clipped {
+			t.Errorf("Expected %s clipped to %s to give %q, got %q", testcase.partitions, testcase.allowed, testcase.clipped, formatted)
+		}
+	}
+}
+
+func TestClampPartitions(t *testing.T) {
+	for _, testcase := range []struct {
+		partitions string
+		clamped    string
+	}{
+		{partitions: "v1--r2", clamped: "2.0.2.3"},
+		{partitions: "v1--2.0.2.3", clamped: "2.0.2.3"},
+		{partitions: "v1--c1", clamped: "0.1.2.1"},
+		{partitions: "v1--1.1.*.*", clamped: "1.1.2.3"},
+		{partitions: "v1--exr1", clamped: "0.0.0.3--2.0.2.3"},
+		{partitions: "v1--r0--1.0.1.3", clamped: "0.0.1.3"},
+		{partitions: "v1--r5", clamped: ""},
+	} {
+		clamped := ClampPartitions(mustPartitions(t, testcase.partitions), 3, 4)
+		if formatted := FormatPartitions(clamped); formatted != testcase.clamped {
+			t.Errorf("Expected %s clamped to a 3x4 grid to give %q, got %q", testcase.partitions, testcase.clamped, formatted)
+		}
+	}
+}
+
+// concurrentStatter stats blobs of a testBlobService, holding every Stat
+// until limit of them are in flight or for wait.
+type concurrentStatter struct {
+	bs      *testBlobService
+	limit   int
+	wait    time.Duration
+	mu      sync.Mutex
+	flight  int
+	maximum int
+	full    chan struct{}
+	once    sync.Once
+}
+
+func (cs *concurrentStatter) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	cs.mu.Lock()
+	cs.flight++
+	cs.maximum = max(cs.maximum, cs.flight)
+	if cs.flight == cs.limit {
+		cs.once.Do(func() { close(cs.full) })
+	}
+	cs.mu.Unlock()
+	defer func() {
+		cs.mu.Lock()
+		cs.flight--
+		cs.mu.Unlock()
+	}()
+
+	select {
+	case <-cs.full:
+	case <-time.After(cs.wait):
+	}
+	return cs.bs.Stat(ctx, dgst)
+}
+
+func TestDescribeFieldParallel(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+	layer := bs.putField(t, "field", 2, 2)
+	field, _, err := getField(ctx, bs, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(limit int) { ConcurrencyLimit = limit }(ConcurrencyLimit)
+	ConcurrencyLimit = 2
+	statter := &concurrentStatter{bs: bs, limit: 2, wait: time.Second, full: make(chan struct{})}
+	description, err := DescribeField(ctx, statter, layer.Digest, field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statter.maximum != 2 {
+		t.Errorf("Expected 2 allotments stated in parallel, got %d", statter.maximum)
+	}
+	if len(description.Cells) != 4 {
+		t.Fatalf("Expected 4 cells, got %d", len(description.Cells))
+	}
+	for i, cell := range description.Cells {
+		if cell.Row != i/2 || cell.Col != i%2 {
+			t.Errorf("Expected cell %d at %d.%d, got %d.%d", i, i/2, i%2, cell.Row, cell.Col)
+		}
+		if cell.Size != int64(len(bs.blobs[cell.Digest])) {
+			t.Errorf("Expected cell %d to have size %d, got %d", i, len(bs.blobs[cell.Digest]), cell.Size)
+		}
+	}
+}
+
+func TestConcurrencyLimitShared(t *testing.T) {
+	bs := newTestBlobService()
+	var fields []distribution.Descriptor
+	for _, prefix := range []string{"first", "second"} {
+		fields = append(fields, bs.putField(t, prefix, 2, 2))
+	}
+
+	defer func(limit int) { ConcurrencyLimit = limit }(ConcurrencyLimit)
+	ConcurrencyLimit = 2
+	// the statter never holds the stats for long, they never reach its limit
+	statter := &concurrentStatter{bs: bs, limit: 3, wait: 10 * time.Millisecond, full: make(chan struct{})}
+
+	ctx := WithConcurrencyLimit(context.Background())
+	var g errgroup.Group
+	for _, layer := range fields {
+		field, _, err := getField(ctx, bs, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.Go(func() error {
+			_, err := DescribeField(ctx, statter, layer.Digest, field)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if statter.maximum != 2 {
+		t.Errorf("Expected the fields to share a limit of 2 allotments stated in parallel, got %d", statter.maximum)
+	}
+}
+
+// testBlobService is a minimal in memory distribution.BlobService.
+type testBlobService struct {
+	blobs map[digest.Digest][]byte
+	// mediaTypes overrides the media type of the stored descriptors
+	mediaTypes map[digest.Digest]string
+	// opens counts the blobs opened, by digest
+	opens map[digest.Digest]int
+	// cancelled counts the blob writers cancelled
+	cancelled int
+}
+
+func newTestBlobService() *testBlobService {
+	return &testBlobService{
+		blobs:      make(map[digest.Digest][]byte),
+		mediaTypes: make(map[digest.Digest]string),
+		opens:      make(map[digest.Digest]int),
+	}
+}
+
+func (bs *testBlobService) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	content, ok := bs.blobs[dgst]
+	if !ok {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+	mediaType, ok := bs.mediaTypes[dgst]
+	if !ok {
+		mediaType = "application/octet-stream"
+	}
+	return distribution.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(content))}, nil
+}
+
+func (bs *testBlobService) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	content, ok := bs.blobs[dgst]
+	if !ok {
+		return nil, distribution.ErrBlobUnknown
+	}
+	return content, nil
+}
+
+func (bs *testBlobService) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	content, ok := bs.blobs[dgst]
+	if !ok {
+		return nil, distribution.ErrBlobUnknown
+	}
+	bs.opens[dgst]++
+	return nopCloser{bytes.NewReader(content)}, nil
+}
+
+func (bs *testBlobService) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
+	if _, ok := bs.blobs[dgst]; !ok {
+		return distribution.ErrBlobUnknown
+	}
+	bs.mediaTypes[dgst] = desc.MediaType
+	return nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+func (bs *testBlobService) Put(ctx context.Context, mediaType string, p []byte) (distribution.Descriptor, error) {
+	dgst := digest.FromBytes(p)
+	bs.blobs[dgst] = p
+	return distribution.Descriptor{MediaType: "application/octet-stream", Digest: dgst, Size: int64(len(p))}, nil
+}
+
+func (bs *testBlobService) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	return &testBlobWriter{bs: bs, startedAt: time.Now()}, nil
+}
+
+// testBlobWriter buffers a blob, storing it in its testBlobService on commit.
+type testBlobWriter struct {
+	bytes.Buffer
+	bs        *testBlobService
+	startedAt time.Time
+}
+
+func (bw *testBlobWriter) Size() int64          { return int64(bw.Len()) }
+func (bw *testBlobWriter) ID() string           { return "test" }
+func (bw *testBlobWriter) StartedAt() time.Time { return bw.startedAt }
+func (bw *testBlobWriter) Close() error         { return nil }
+
+func (bw *testBlobWriter) Commit(ctx context.Context, provisional v1.Descriptor) (v1.Descriptor, error) {
+	content := bytes.Clone(bw.Bytes())
+	if dgst := digest.FromBytes(content); dgst != provisional.Digest {
+		return v1.Descriptor{}, distribution.ErrBlobInvalidDigest{Digest: provisional.Digest, Reason: fmt.Errorf("content digest %s", dgst)}
+	}
+	return bw.bs.Put(ctx, provisional.MediaType, content)
+}
+
+func (bw *testBlobWriter) Cancel(ctx context.Context) error {
+	bw.bs.cancelled++
+	bw.Reset()
+	return nil
+}
+
+func (bs *testBlobService) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
+	return nil, distribution.ErrUnsupported
+}
+
+// putField stores a rows x cols field whose allotments are named after prefix
+// and returns its descriptor.
+func (bs *testBlobService) putField(t *testing.T, prefix string, rows, cols int) distribution.Descriptor {
+	field := tdfs.GetField()
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			content := fmt.Sprintf("%s %d.%d", prefix, row, col)
+			desc, _ := bs.Put(context.Background(), v1.MediaTypeImageLayerGzip, []byte(content))
+			field.AddAllotment(tdfs.Allotment{
+				Row:    row,
+				Col:    col,
+				Digest: desc.Digest.Encoded(),
+				DiffID: digest.FromString(content + " diff").Encoded(),
+			})
+		}
+	}
+	desc, _ := bs.Put(context.Background(), MediaTypeTdfsLayer, []byte(field.Marshal()))
+	desc.MediaType = MediaTypeTdfsLayer
+	return desc
+}
+
+func TestConvertStackedFields(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	base, _ := bs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte("base"))
+	base.MediaType = v1.MediaTypeImageLayerGzip
+	top, _ := bs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte("top"))
+	top.MediaType = v1.MediaTypeImageLayerGzip
+	baseField := bs.putField(t, "base field", 1, 2)
+	tuneField := bs.putField(t, "tune field", 1, 1)
+
+	config, _ := json.Marshal(v1.Image{
+		RootFS: v1.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromString("base diff"), digest.FromString("top diff")},
+		},
+	})
+	configDesc, _ := bs.Put(ctx, v1.MediaTypeImageConfig, config)
+	configDesc.MediaType = v1.MediaTypeImageConfig
+
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []distribution.Descriptor{base, baseField, tuneField, top},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partitions := mustPartitions(t, "v1--0.0.0.1")
+	converted, allotments, err := ConvertTdfsManifestToOciManifest(ctx, source, bs, partitions, Provenance{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allotments != 3 {
+		t.Errorf("Expected 3 allotments selected in both fields, got %d", allotments)
+	}
+	manifest := converted.(*ocischema.DeserializedManifest)
+
+	expectedLayers := []digest.Digest{
+		base.Digest,
+		digest.FromString("base field 0.0"),
+		digest.FromString("base field 0.1"),
+		digest.FromString("tune field 0.0"),
+		top.Digest,
+	}
+	expectedDiffIDs := []digest.Digest{
+		digest.FromString("base diff"),
+		digest.FromString("base field 0.0 diff"),
+		digest.FromString("base field 0.1 diff"),
+		digest.FromString("tune field 0.0 diff"),
+		digest.FromString("top diff"),
+	}
+
+	if len(manifest.Layers) != len(expectedLayers) {
+		t.Fatalf("Expected %d layers, got %d", len(expectedLayers), len(manifest.Layers))
+	}
+	for i, layer := range manifest.Layers {
+		if layer.Digest != expectedLayers[i] {
+			t.Errorf("Expected layer %d to be %s, got %s", i, expectedLayers[i], layer.Digest)
+		}
+	}
+
+	var derivedConfig v1.Image
+	content, err := bs.Get(ctx, manifest.Config.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(content, &derivedConfig); err != nil {
+		t.Fatal(err)
+	}
+	if len(derivedConfig.RootFS.DiffIDs) != len(expectedDiffIDs) {
+		t.Fatalf("Expected %d diffIDs, got %d", len(expectedDiffIDs), len(derivedConfig.RootFS.DiffIDs))
+	}
+	for i, diffID := range derivedConfig.RootFS.DiffIDs {
+		if diffID != expectedDiffIDs[i] {
+			t.Errorf("Expected diffID %d to be %s, got %s", i, expectedDiffIDs[i], diffID)
+		}
+	}
+}
+
+func TestConvertOverlappingPartitions(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	field := bs.putField(t, "field", 3, 3)
+	config, _ := json.Marshal(v1.Image{RootFS: v1.RootFS{Type: "layers"}})
+	configDesc, _ := bs.Put(ctx, v1.MediaTypeImageConfig, config)
+	configDesc.MediaType = v1.MediaTypeImageConfig
+
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []distribution.Descriptor{field},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []byte
+	for _, tag := range []string{"v1--0.0.1.1--1.1.2.2", "v1--1.1.2.2--0.0.1.1", "v1--0.0.0.1--1.0.1.2--2.1.2.2"} {
+		partitions := mustPartitions(t, tag)
+		converted, _, err := ConvertTdfsManifestToOciManifest(ctx, source, bs, partitions, Provenance{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, payload, err := converted.Payload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected == nil {
+			expected = payload
+			cells := []string{"0.0", "0.1", "1.0", "1.1", "1.2", "2.1", "2.2"}
+			layers := converted.(*ocischema.DeserializedManifest).Layers
+			if len(layers) != len(cells) {
+				t.Fatalf("Expected %d layers, got %d", len(cells), len(layers))
+			}
+			for i, cell := range cells {
+				if layers[i].Digest != digest.FromString("field "+cell) {
+					t.Errorf("Expected layer %d to be allotment %s", i, cell)
+				}
+			}
+			continue
+		}
+		if string(payload) != string(expected) {
+			t.Errorf("Expected %s to produce the same manifest as the equivalent tags", tag)
+		}
+	}
+}
+
+func TestConvertOutOfBoundsPartitions(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	field := bs.putField(t, "field", 2, 3)
+	config, _ := json.Marshal(v1.Image{RootFS: v1.RootFS{Type: "layers"}})
+	configDesc, _ := bs.Put(ctx, v1.MediaTypeImageConfig, config)
+	configDesc.MediaType = v1.MediaTypeImageConfig
+
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []distribution.Descriptor{field},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ConvertTdfsManifestToOciManifest(ctx, source, bs, mustPartitions(t, "v1--1.0.1.2"), Provenance{}); err != nil {
+		t.Fatalf("Unexpected error for a partition within the field: %v", err)
+	}
+	for tag, segment := range map[string]string{
+		"v1--0.0.2.0":          "0.0.2.0",
+		"v1--0.0.0.3":          "0.0.0.3",
+		"v1--0.0.0.0--5.5.6.6": "5.5.6.6",
+	} {
+		_, _, err := ConvertTdfsManifestToOciManifest(ctx, source, bs, mustPartitions(t, tag), Provenance{})
+		partitionErr, ok := err.(ErrPartitionInvalid)
+		if !ok {
+			t.Errorf("Expected %s to be rejected with ErrPartitionInvalid, got %v", tag, err)
+			continue
+		}
+		if partitionErr.Partition != segment {
+			t.Errorf("Expected %s to be rejected for segment %q, got %q", tag, segment, partitionErr.Partition)
+		}
+	}
+}
+
+func TestConvertInvalidField(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	field, _ := bs.Put(ctx, MediaTypeTdfsLayer, []byte(`{"rows":[{"allotments":[{"row":0,"col":1,"digest":"","diffid":""}],"allotments_size":1}],"rows_size":1}`))
+	field.MediaType = MediaTypeTdfsLayer
+	config, _ := json.Marshal(v1.Image{RootFS: v1.RootFS{Type: "layers"}})
+	configDesc, _ := bs.Put(ctx, v1.MediaTypeImageConfig, config)
+	configDesc.MediaType = v1.MediaTypeImageConfig
+
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []distribution.Descriptor{field},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = ConvertTdfsManifestToOciManifest(ctx, source, bs, mustPartitions(t, "v1--0.0.0.0"), Provenance{})
+	if _, ok := err.(ErrFieldInvalid); !ok {
+		t.Fatalf("Expected the malformed field to be rejected with ErrFieldInvalid, got %v", err)
+	}
+}
+
+func TestConvertPartitionGrammar(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	field := bs.putField(t, "field", 3, 3)
+	config, _ := json.Marshal(v1.Image{RootFS: v1.RootFS{Type: "layers"}})
+	configDesc, _ := bs.Put(ctx, v1.MediaTypeImageConfig, config)
+	configDesc.MediaType = v1.MediaTypeImageConfig
+
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []distribution.Descriptor{field},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the forms select the same allotments of the 3x3 field, their open
+	// ends are clamped to the grid so that they derive the very same manifest
+	var expected []byte
+	for _, tag := range []string{"v1--1.0.1.2", "v1--r1", "v1--1.*.1.*", "v1--exr0--exr2", "v1--c0--c1--c2--ex0.0.0.*--ex2.*.*.*"} {
+		converted, allotments, err := ConvertTdfsManifestToOciManifest(ctx, source, bs, mustPartitions(t, tag), Provenance{})
+		if err != nil {
+			t.Fatalf("Unexpected error converting %s: %v", tag, err)
+		}
+		if allotments != 3 {
+			t.Errorf("Expected %s to select 3 allotments, got %d", tag, allotments)
+		}
+		_, payload, err := converted.Payload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if annotation := converted.(*ocischema.DeserializedManifest).Annotations[AnnotationPartitions]; annotation != "1.0.1.2" {
+			t.Errorf("Expected %s to be annotated with the clamped partitions 1.0.1.2, got %s", tag, annotation)
+		}
+		if expected == nil {
+			expected = payload
+			continue
+		}
+		if digest.FromBytes(payload) != digest.FromBytes(expected) {
+			t.Errorf("Expected %s to derive the same manifest as the equivalent tags", tag)
+		}
+	}
+
+	for tag, segment := range map[string]string{
+		"v1--r3":       "r3",
+		"v1--c4":       "c4",
+		"v1--3.0.*.*":  "3.0.*.*",
+		"v1--r0--exr5": "exr5",
+	} {
+		_, _, err := ConvertTdfsManifestToOciManifest(ctx, source, bs, mustPartitions(t, tag), Provenance{})
+		partitionErr, ok := err.(ErrPartitionInvalid)
+		if !ok {
+			t.Errorf("Expected %s to be rejected with ErrPartitionInvalid, got %v", tag, err)
+			continue
+		}
+		if partitionErr.Partition != segment {
+			t.Errorf("Expected %s to be rejected for segment %q, got %q", tag, segment, partitionErr.Partition)
+		}
+	}
+}
+
+func TestConvertAllotmentMediaTypes(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	tarHeader := make([]byte, 512)
+	copy(tarHeader[257:], "ustar")
+	allotments := []struct {
+		content   []byte
+		stored    string
+		recorded  string
+		mediaType string
+	}{
+		// recorded in the field
+		{content: []byte("recorded"), recorded: v1.MediaTypeImageLayerZstd, mediaType: v1.MediaTypeImageLayerZstd},
+		// stored descriptor
+		{content: []byte("stored"), stored: v1.MediaTypeImageLayer, mediaType: v1.MediaTypeImageLayer},
+		// detected from the content
+		{content: []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, mediaType: v1.MediaTypeImageLayerZstd},
+		{content: []byte{0x1f, 0x8b, 0x08, 0x00}, mediaType: v1.MediaTypeImageLayerGzip},
+		{content: tarHeader, mediaType: v1.MediaTypeImageLayer},
+		// unknown
+		{content: []byte("unknown"), mediaType: v1.MediaTypeImageLayerGzip},
+		// recorded or stored media types which are not layer media types
+		{content: []byte{0x28, 0xb5, 0x2f, 0xfd, 0x01}, recorded: "text/plain", mediaType: v1.MediaTypeImageLayerZstd},
+		{content: []byte{0x1f, 0x8b, 0x08, 0x01}, stored: "text/plain", mediaType: v1.MediaTypeImageLayerGzip},
+	}
+
+	var rawAllotments []string
+	for i, allotment := range allotments {
+		desc, _ := bs.Put(ctx, "", allotment.content)
+		if allotment.stored != "" {
+			bs.mediaTypes[desc.Digest] = allotment.stored
+		}
+		rawAllotments = append(rawAllotments, fmt.Sprintf(`{"row":0,"col":%d,"digest":%q,"diffid":%q,"mediatype":%q}`,
+			i, desc.Digest.Encoded(), digest.FromBytes(allotment.content).Encoded(), allotment.recorded))
+	}
+	rawField := fmt.Sprintf(`{"rows":[{"allotments":[%s],"allotments_size":%d}],"rows_size":1,"owner":""}`,
+		strings.Join(rawAllotments, ","), len(allotments))
+	field, _ := bs.Put(ctx, MediaTypeTdfsLayer, []byte(rawField))
+	field.MediaType = MediaTypeTdfsLayer
+
+	config, _ := json.Marshal(v1.Image{RootFS: v1.RootFS{Type: "layers"}})
+	configDesc, _ := bs.Put(ctx, v1.MediaTypeImageConfig, config)
+	configDesc.MediaType = v1.MediaTypeImageConfig
+
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []distribution.Descriptor{field},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// detected media types are recorded, converting again does not read
+	// the allotments
+	for range 2 {
+		converted, _, err := ConvertTdfsManifestToOciManifest(ctx, source, bs, mustPartitions(t, "v1--r0"), Provenance{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers := converted.(*ocischema.DeserializedManifest).Layers
+		if len(layers) != len(allotments) {
+			t.Fatalf("Expected %d layers, got %d", len(allotments), len(layers))
+		}
+		for i, allotment := range allotments {
+			if layers[i].MediaType != allotment.mediaType {
+				t.Errorf("Expected layer %d to have media type %s, got %s", i, allotment.mediaType, layers[i].MediaType)
+			}
+			if opens := bs.opens[layers[i].Digest]; opens > 1 {
+				t.Errorf("Expected layer %d to be read at most once, got %d", i, opens)
+			}
+		}
+	}
+}
+
+func TestConvertHistory(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	base, _ := bs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte("base"))
+	base.MediaType = v1.MediaTypeImageLayerGzip
+	top, _ := bs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte("top"))
+	top.MediaType = v1.MediaTypeImageLayerGzip
+	field := bs.putField(t, "field", 1, 2)
+
+	for _, testcase := range []struct {
+		name     string
+		history  []v1.History
+		expected []v1.History
+	}{
+		{
+			name: "field with history entry",
+			history: []v1.History{
+				{CreatedBy: "ENV", EmptyLayer: true},
+				{CreatedBy: "base"},
+				{CreatedBy: "field"},
+				{CreatedBy: "LABEL", EmptyLayer: true},
+				{CreatedBy: "top"},
+			},
+			expected: []v1.History{
+				{CreatedBy: "ENV", EmptyLayer: true},
+				{CreatedBy: "base"},
+				{CreatedBy: "field", EmptyLayer: true, Comment: fmt.Sprintf("2dfs field %s removed by partitioning", field.Digest)},
+				{CreatedBy: fmt.Sprintf("2dfs allotment 0.0 of field %s", field.Digest)},
+				{CreatedBy: fmt.Sprintf("2dfs allotment 0.1 of field %s", field.Digest)},
+				{CreatedBy: "LABEL", EmptyLayer: true},
+				{CreatedBy: "top"},
+			},
+		},
+		{
+			name: "field without history entry",
+			history: []v1.History{
+				{CreatedBy: "base"},
+				{CreatedBy: "top"},
+			},
+			expected: []v1.History{
+				{CreatedBy: "base"},
+				{CreatedBy: fmt.Sprintf("2dfs allotment 0.0 of field %s", field.Digest)},
+				{CreatedBy: fmt.Sprintf("2dfs allotment 0.1 of field %s", field.Digest)},
+				{CreatedBy: "top"},
+			},
+		},
+		{
+			name:     "no history",
+			history:  nil,
+			expected: nil,
+		},
+	} {
+		config, _ := json.Marshal(v1.Image{
+			RootFS: v1.RootFS{
+				Type:    "layers",
+				DiffIDs: []digest.Digest{digest.FromString("base diff"), digest.FromString("top diff")},
+			},
+			History: testcase.history,
+		})
+		configDesc, _ := bs.Put(ctx, v1.MediaTypeImageConfig, config)
+		configDesc.MediaType = v1.MediaTypeImageConfig
+
+		source, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: v1.MediaTypeImageManifest,
+			Config:    configDesc,
+			Layers:    []distribution.Descriptor{base, field, top},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		converted, _, err := ConvertTdfsManifestToOciManifest(ctx, source, bs, mustPartitions(t, "v1--r0"), Provenance{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var derivedConfig v1.Image
+		content, _ := bs.Get(ctx, converted.(*ocischema.DeserializedManifest).Config.Digest)
+		if err := json.Unmarshal(content, &derivedConfig); err != nil {
+			t.Fatal(err)
+		}
+		if len(derivedConfig.History) != len(testcase.expected) {
+			t.Fatalf("%s: expected %d history entries, got %d", testcase.name, len(testcase.expected), len(derivedConfig.History))
+		}
+		layerEntries := 0
+		for i, entry := range derivedConfig.History {
+			if entry != testcase.expected[i] {
+				t.Errorf("%s: expected history entry %d to be %+v, got %+v", testcase.name, i, testcase.expected[i], entry)
+			}
+			if !entry.EmptyLayer {
+				layerEntries++
+			}
+		}
+		if len(testcase.expected) > 0 && layerEntries != len(derivedConfig.RootFS.DiffIDs) {
+			t.Errorf("%s: expected one history entry per diffID, got %d for %d", testcase.name, layerEntries, len(derivedConfig.RootFS.DiffIDs))
+		}
+	}
+}
+
+func TestConvertProvenance(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	field := bs.putField(t, "field", 2, 2)
+	config, _ := json.Marshal(v1.Image{RootFS: v1.RootFS{Type: "layers"}})
+	configDesc, _ := bs.Put(ctx, v1.MediaTypeImageConfig, config)
+	configDesc.MediaType = v1.MediaTypeImageConfig
+
+	sourceAnnotations := map[string]string{"org.opencontainers.image.title": "tdfs"}
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   v1.MediaTypeImageManifest,
+		Config:      configDesc,
+		Layers:      []distribution.Descriptor{field},
+		Annotations: sourceAnnotations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, _ := source.Payload()
+	sourceDesc := distribution.Descriptor{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(payload),
+		Size:      int64(len(payload)),
+		Platform:  &v1.Platform{Architecture: "amd64", OS: "linux"},
+	}
+
+	partitions := mustPartitions(t, "v1--r1--0.0.0.0")
+	converted, _, err := ConvertTdfsManifestToOciManifest(ctx, source, bs, partitions, Provenance{Source: sourceDesc, Tag: "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := converted.(*ocischema.DeserializedManifest)
+	if manifest.Subject == nil || manifest.Subject.Digest != sourceDesc.Digest || manifest.Subject.Size != sourceDesc.Size ||
+		manifest.Subject.MediaType != v1.MediaTypeImageManifest || manifest.Subject.Platform != nil {
+		t.Errorf("Unexpected subject %+v", manifest.Subject)
+	}
+	expected := map[string]string{
+		"org.opencontainers.image.title": "tdfs",
+		AnnotationSourceDigest:           sourceDesc.Digest.String(),
+		AnnotationSourceTag:              "v1",
+		AnnotationPartitions:             "0.0.0.0--1.0.1.1",
+	}
+	if len(manifest.Annotations) != len(expected) {
+		t.Errorf("Expected annotations %v, got %v", expected, manifest.Annotations)
+	}
+	for k, v := range expected {
+		if manifest.Annotations[k] != v {
+			t.Errorf("Expected annotation %s to be %q, got %q", k, v, manifest.Annotations[k])
+		}
+	}
+	if len(sourceAnnotations) != 1 {
+		t.Errorf("Expected the source annotations to be left untouched, got %v", sourceAnnotations)
+	}
+
+	index, err := ocischema.FromDescriptors([]distribution.Descriptor{sourceDesc}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, _ = index.Payload()
+	indexDesc := distribution.Descriptor{MediaType: v1.MediaTypeImageIndex, Digest: digest.FromBytes(payload), Size: int64(len(payload))}
+	derivedIndex, err := ConvertPartitionedIndexToOciIndex(index, index.Manifests, partitions, Provenance{Source: indexDesc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if derivedIndex.Subject == nil || derivedIndex.Subject.Digest != indexDesc.Digest {
+		t.Errorf("Unexpected subject %+v", derivedIndex.Subject)
+	}
+	if _, ok := derivedIndex.Annotations[AnnotationSourceTag]; ok {
+		t.Errorf("Expected no source tag annotation without a tag, got %v", derivedIndex.Annotations)
+	}
+	if derivedIndex.Annotations[AnnotationSourceDigest] != indexDesc.Digest.String() {
+		t.Errorf("Unexpected source digest annotation %q", derivedIndex.Annotations[AnnotationSourceDigest])
+	}
+}
+
+func TestPreviewTdfsManifest(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	base, _ := bs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte("base"))
+	base.MediaType = v1.MediaTypeImageLayerGzip
+	field := bs.putField(t, "field", 2, 2)
+
+	config, _ := json.Marshal(v1.Image{
+		RootFS: v1.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromString("base diff")},
+		},
+	})
+	configDesc, _ := bs.Put(ctx, v1.MediaTypeImageConfig, config)
+	configDesc.MediaType = v1.MediaTypeImageConfig
+
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []distribution.Descriptor{base, field},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := len(bs.blobs)
+
+	partitions := mustPartitions(t, "v1--r1")
+	preview, err := PreviewTdfsManifest(ctx, source, bs, partitions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs.blobs) != blobs {
+		t.Errorf("Expected the preview not to store blobs, %d were stored", len(bs.blobs)-blobs)
+	}
+
+	converted, _, err := ConvertTdfsManifestToOciManifest(ctx, source, bs, partitions, Provenance{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := converted.(*ocischema.DeserializedManifest).Layers
+	if !reflect.DeepEqual(preview.Allotments, layers[1:]) {
+		t.Errorf("Expected the preview allotments to be %v, got %v", layers[1:], preview.Allotments)
+	}
+
+	allotmentsSize := int64(len("field 1.0") + len("field 1.1"))
+	if preview.AllotmentsSize != allotmentsSize {
+		t.Errorf("Expected the allotments size to be %d, got %d", allotmentsSize, preview.AllotmentsSize)
+	}
+	if preview.Size != allotmentsSize+base.Size {
+		t.Errorf("Expected the size to be %d, got %d", allotmentsSize+base.Size, preview.Size)
+	}
+
+	if _, err := PreviewTdfsManifest(ctx, source, bs, mustPartitions(t, "v1--r2")); err == nil {
+		t.Errorf("Expected an error previewing out of bounds partitions")
+	}
+}
+
+func TestCheckManifestPartitions(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	baseField := bs.putField(t, "base field", 2, 2)
+	tuneField := bs.putField(t, "tune field", 1, 3)
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Layers:    []distribution.Descriptor{baseField, tuneField},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the grid encloses both fields, a partition has to fit one of them
+	rows, cols, err := CheckManifestPartitions(ctx, source, bs, mustPartitions(t, "v1--r1--0.2.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 2 || cols != 3 {
+		t.Errorf("Expected a 2x3 grid, got %dx%d", rows, cols)
+	}
+	for _, tag := range []string{"v1--1.2.1.2", "v1--c3", "v1--r2"} {
+		if _, _, err := CheckManifestPartitions(ctx, source, bs, mustPartitions(t, tag)); err == nil {
+			t.Errorf("Expected %s to fit none of the fields", tag)
+		}
+	}
+}
+
+func TestFieldPartitions(t *testing.T) {
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	baseField := bs.putField(t, "base field", 2, 2)
+	tuneField := bs.putField(t, "tune field", 1, 3)
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Layers:    []distribution.Descriptor{baseField, tuneField},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partitions, err := FieldPartitions(ctx, source, bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := FormatPartitions(mustPartitions(t, "v1--0.0.0.2--1.0.1.1"))
+	if formatted := FormatPartitions(partitions); formatted != expected {
+		t.Errorf("Expected the fields to span %s, got %s", expected, formatted)
+	}
+	clipped := ClipPartitions(mustPartitions(t, "v1--0.0.3.3"), partitions)
+	if formatted := FormatPartitions(clipped); formatted != expected {
+		t.Errorf("Expected the partitions to be clipped to %s, got %s", expected, formatted)
+	}
+}
+
+func TestConvertSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+	otel.SetTracerProvider(provider)
+
+	ctx := context.Background()
+	bs := newTestBlobService()
+
+	field := bs.putField(t, "field", 2, 3)
+	config, _ := json.Marshal(v1.Image{RootFS: v1.RootFS{Type: "layers"}})
+	configDesc, _ := bs.Put(ctx, v1.MediaTypeImageConfig, config)
+	configDesc.MediaType = v1.MediaTypeImageConfig
+
+	source, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []distribution.Descriptor{field},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ConvertTdfsManifestToOciManifest(ctx, source, bs, mustPartitions(t, "v1--r1"), Provenance{}); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	root, ok := spans["ConvertTdfsManifest"]
+	if !ok {
+		t.Fatalf("Expected a conversion span, got %v", spans)
+	}
+	for _, name := range []string{"GetConfig", "GetField", "StatAllotments", "BuildManifest"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a %s span", name)
+			continue
+		}
+		if span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("Expected %s to be a child of the conversion span", name)
+		}
+	}
+	if span, ok := spans["UnmarshalField"]; !ok || span.Parent().SpanID() != spans["GetField"].SpanContext().SpanID() {
+		t.Errorf("Expected an UnmarshalField span child of the field fetch")
+	}
+
+	expected := map[string]attribute.Value{
+		"io.cncf.distribution.tdfs.partitions": attribute.StringValue("1.0.1.*"),
+	}
+	checkSpanAttributes(t, root, expected)
+	checkSpanAttributes(t, spans["GetField"], map[string]attribute.Value{
+		"io.cncf.distribution.tdfs.field.rows": attribute.IntValue(2),
+		"io.cncf.distribution.tdfs.field.cols": attribute.IntValue(3),
+	})
+	checkSpanAttributes(t, spans["StatAllotments"], map[string]attribute.Value{
+		"io.cncf.distribution.tdfs.allotments": attribute.IntValue(3),
+	})
+}
+
+// checkSpanAttributes checks that span carries the expected attributes.
+func checkSpanAttributes(t *testing.T, span sdktrace.ReadOnlySpan, expected map[string]attribute.Value) {
+	t.Helper()
+	if span == nil {
+		return
+	}
+	attributes := map[string]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attributes[string(kv.Key)] = kv.Value
+	}
+	for key, value := range expected {
+		if attributes[key] != value {
+			t.Errorf("Expected %s of span %s to be %v, got %v", key, span.Name(), value.Emit(), attributes[key].Emit())
+		}
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"mime"
 
+	"github.com/distribution/reference"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -49,6 +50,50 @@ type ManifestEnumerator interface {
 	Enumerate(ctx context.Context, ingester func(digest.Digest) error) error
 }
 
+// PartitionIndex records the manifests derived from a 2dfs manifest by
+// partitioning, so that repeated requests for the same partitions resolve to
+// the same manifest without converting it again.
+type PartitionIndex interface {
+	// Get returns the digest of the manifest derived from source for the
+	// normalized partition set. ErrPartitionUnknown is returned if no such
+	// manifest has been recorded.
+	Get(ctx context.Context, source digest.Digest, partitions string) (digest.Digest, error)
+
+	// Set records derived as the manifest derived from source for the
+	// normalized partition set.
+	Set(ctx context.Context, source digest.Digest, partitions string, derived digest.Digest) error
+
+	// Clear removes every derived manifest recorded for source.
+	Clear(ctx context.Context, source digest.Digest) error
+}
+
+// PartitionIndexProvider is implemented by namespaces able to persist a
+// PartitionIndex for their repositories.
+type PartitionIndexProvider interface {
+	// PartitionIndex returns the partition index of the named repository.
+	PartitionIndex(name reference.Named) PartitionIndex
+}
+
+// FlattenIndex records the layers flattened from the allotments of 2dfs
+// fields, so that every set of allotments is flattened only once.
+type FlattenIndex interface {
+	// Get returns the digest and diffID of the layer flattened from the
+	// allotments identified by key. ErrFlattenUnknown is returned if no
+	// such layer has been recorded.
+	Get(ctx context.Context, key digest.Digest) (layer digest.Digest, diffID digest.Digest, err error)
+
+	// Set records layer, with its diffID, as the layer flattened from the
+	// allotments identified by key.
+	Set(ctx context.Context, key digest.Digest, layer digest.Digest, diffID digest.Digest) error
+}
+
+// FlattenIndexProvider is implemented by namespaces able to persist a
+// FlattenIndex for their repositories.
+type FlattenIndexProvider interface {
+	// FlattenIndex returns the flatten index of the named repository.
+	FlattenIndex(name reference.Named) FlattenIndex
+}
+
 // Describable is an interface for descriptors.
 //
 // Implementations of Describable are generally objects which can be
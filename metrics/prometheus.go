@@ -16,4 +16,7 @@ var (
 
 	// ProxyNamespace is the prometheus namespace of proxy related metrics
 	ProxyNamespace = metrics.NewNamespace(NamespacePrefix, "proxy", nil)
+
+	// PartitionNamespace is the prometheus namespace of 2dfs partitioning related metrics
+	PartitionNamespace = metrics.NewNamespace(NamespacePrefix, "partition", nil)
 )
@@ -22,7 +22,10 @@ type bridge struct {
 	sink              events.Sink
 }
 
-var _ Listener = &bridge{}
+var (
+	_ Listener          = &bridge{}
+	_ PartitionListener = &bridge{}
+)
 
 // URLBuilder defines a subset of url builder to be used by the event listener.
 type URLBuilder interface {
@@ -87,6 +90,22 @@ func (b *bridge) ManifestPulled(repo reference.Named, sm distribution.Manifest,
 	return b.sink.Write(*manifestEvent)
 }
 
+func (b *bridge) ManifestPartitioned(repo reference.Named, sm distribution.Manifest, partition PartitionRecord, options ...distribution.ManifestServiceOption) error {
+	manifestEvent, err := b.createManifestEvent(EventActionPartition, repo, sm)
+	if err != nil {
+		return err
+	}
+	manifestEvent.Partition = &partition
+
+	for _, option := range options {
+		if opt, ok := option.(distribution.WithTagOption); ok {
+			manifestEvent.Target.Tag = opt.Tag
+			break
+		}
+	}
+	return b.sink.Write(*manifestEvent)
+}
+
 func (b *bridge) ManifestDeleted(repo reference.Named, dgst digest.Digest) error {
 	return b.createManifestDeleteEventAndWrite(EventActionDelete, repo, dgst)
 }
@@ -99,6 +99,34 @@ func TestEventBridgeManifestPulledWithTag(t *testing.T) {
 	}
 }
 
+func TestEventBridgeManifestPartitioned(t *testing.T) {
+	partition := PartitionRecord{
+		Source:     digest.FromString("source"),
+		Partitions: []string{"0.0.1.1"},
+		Allotments: 4,
+	}
+	l := createTestEnv(t, testSinkFn(func(event events.Event) error {
+		checkCommonManifest(t, EventActionPartition, event)
+		if event.(Event).Target.Tag != tag {
+			t.Fatalf("missing or unexpected tag: %#v", event.(Event).Target)
+		}
+		if p := event.(Event).Partition; p == nil || p.Source != partition.Source || p.Allotments != 4 || len(p.Partitions) != 1 {
+			t.Fatalf("missing or unexpected partition: %#v", p)
+		}
+
+		return nil
+	}))
+
+	pl, ok := l.(PartitionListener)
+	if !ok {
+		t.Fatalf("expected the bridge to implement PartitionListener")
+	}
+	repoRef, _ := reference.WithName(repo)
+	if err := pl.ManifestPartitioned(repoRef, sm, partition, distribution.WithTag(tag)); err != nil {
+		t.Fatalf("unexpected error notifying manifest partition: %v", err)
+	}
+}
+
 func TestEventBridgeManifestDeleted(t *testing.T) {
 	l := createTestEnv(t, testSinkFn(func(event events.Event) error {
 		checkDeleted(t, EventActionDelete, event)
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	events "github.com/docker/go-events"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -14,6 +15,10 @@ const (
 	EventActionPush   = "push"
 	EventActionMount  = "mount"
 	EventActionDelete = "delete"
+
+	// EventActionPartition is the action of the events recording the
+	// derivation of the manifest holding some partitions of a 2dfs image.
+	EventActionPartition = "partition"
 )
 
 const (
@@ -77,6 +82,10 @@ type Event struct {
 		References []v1.Descriptor `json:"references,omitempty"`
 	} `json:"target,omitempty"`
 
+	// Partition describes the partitioning of a 2dfs image, for partition
+	// events only. The target of a partition event is the derived manifest.
+	Partition *PartitionRecord `json:"partition,omitempty"`
+
 	// Request covers the request that generated the event.
 	Request RequestRecord `json:"request,omitempty"`
 
@@ -129,6 +138,26 @@ type RequestRecord struct {
 	UserAgent string `json:"useragent"`
 }
 
+// PartitionRecord describes the derivation of the manifest holding some
+// partitions of a 2dfs image.
+type PartitionRecord struct {
+	// Source is the digest of the 2dfs image index or manifest the derived
+	// manifest holds partitions of.
+	Source digest.Digest `json:"source"`
+
+	// Partitions are the normalized rectangles of the field selected by the
+	// request, in the semantic tag format, such as "0.0.1.1".
+	Partitions []string `json:"partitions"`
+
+	// Flattened is set when the selected allotments were merged into a
+	// single layer.
+	Flattened bool `json:"flattened,omitempty"`
+
+	// Allotments is the number of allotments selected in the fields of the
+	// source, summed over the image manifests of an index.
+	Allotments int `json:"allotments"`
+}
+
 // SourceRecord identifies the registry node that generated the event. Put
 // differently, while the actor "initiates" the event, the source "generates"
 // it.
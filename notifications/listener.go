@@ -28,6 +28,14 @@ type BlobListener interface {
 	BlobDeleted(repo reference.Named, desc digest.Digest) error
 }
 
+// PartitionListener describes a listener that can respond to the
+// partitioning of 2dfs images. It is not part of Listener, the registry
+// checks whether its listener implements it before dispatching partition
+// events.
+type PartitionListener interface {
+	ManifestPartitioned(repo reference.Named, sm distribution.Manifest, partition PartitionRecord, options ...distribution.ManifestServiceOption) error
+}
+
 // RepoListener provides repository methods that respond to repository lifecycle
 type RepoListener interface {
 	TagDeleted(repo reference.Named, tag string) error
@@ -41,6 +49,23 @@ type Listener interface {
 	RepoListener
 }
 
+// internalKey is the context key marking internal operations.
+type internalKey struct{}
+
+// WithInternal returns a context marking the repository operations carried
+// out with it as internal to the registry, such as the reads and writes
+// deriving the partitioned manifests of 2dfs images. No event is dispatched
+// for internal operations, the caller reports them instead.
+func WithInternal(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalKey{}, true)
+}
+
+// isInternal reports whether ctx marks internal operations.
+func isInternal(ctx context.Context) bool {
+	internal, _ := ctx.Value(internalKey{}).(bool)
+	return internal
+}
+
 type repositoryListener struct {
 	distribution.Repository
 	listener Listener
@@ -95,7 +120,7 @@ type manifestServiceListener struct {
 
 func (msl *manifestServiceListener) Delete(ctx context.Context, dgst digest.Digest) error {
 	err := msl.ManifestService.Delete(ctx, dgst)
-	if err == nil {
+	if err == nil && !isInternal(ctx) {
 		if err := msl.parent.listener.ManifestDeleted(msl.parent.Repository.Named(), dgst); err != nil {
 			dcontext.GetLogger(ctx).Errorf("error dispatching manifest delete to listener: %v", err)
 		}
@@ -106,7 +131,7 @@ func (msl *manifestServiceListener) Delete(ctx context.Context, dgst digest.Dige
 
 func (msl *manifestServiceListener) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
 	sm, err := msl.ManifestService.Get(ctx, dgst, options...)
-	if err == nil {
+	if err == nil && !isInternal(ctx) {
 		if err := msl.parent.listener.ManifestPulled(msl.parent.Repository.Named(), sm, options...); err != nil {
 			dcontext.GetLogger(ctx).Errorf("error dispatching manifest pull to listener: %v", err)
 		}
@@ -118,7 +143,7 @@ func (msl *manifestServiceListener) Get(ctx context.Context, dgst digest.Digest,
 func (msl *manifestServiceListener) Put(ctx context.Context, sm distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
 	dgst, err := msl.ManifestService.Put(ctx, sm, options...)
 
-	if err == nil {
+	if err == nil && !isInternal(ctx) {
 		if err := msl.parent.listener.ManifestPushed(msl.parent.Repository.Named(), sm, options...); err != nil {
 			dcontext.GetLogger(ctx).Errorf("error dispatching manifest push to listener: %v", err)
 		}
@@ -136,7 +161,7 @@ var _ distribution.BlobStore = &blobServiceListener{}
 
 func (bsl *blobServiceListener) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
 	p, err := bsl.BlobStore.Get(ctx, dgst)
-	if err == nil {
+	if err == nil && !isInternal(ctx) {
 		if desc, err := bsl.Stat(ctx, dgst); err != nil {
 			dcontext.GetLogger(ctx).Errorf("error resolving descriptor in ServeBlob listener: %v", err)
 		} else {
@@ -151,7 +176,7 @@ func (bsl *blobServiceListener) Get(ctx context.Context, dgst digest.Digest) ([]
 
 func (bsl *blobServiceListener) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
 	rc, err := bsl.BlobStore.Open(ctx, dgst)
-	if err == nil {
+	if err == nil && !isInternal(ctx) {
 		if desc, err := bsl.Stat(ctx, dgst); err != nil {
 			dcontext.GetLogger(ctx).Errorf("error resolving descriptor in ServeBlob listener: %v", err)
 		} else {
@@ -166,7 +191,7 @@ func (bsl *blobServiceListener) Open(ctx context.Context, dgst digest.Digest) (i
 
 func (bsl *blobServiceListener) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
 	err := bsl.BlobStore.ServeBlob(ctx, w, r, dgst)
-	if err == nil {
+	if err == nil && !isInternal(ctx) {
 		if desc, err := bsl.Stat(ctx, dgst); err != nil {
 			dcontext.GetLogger(ctx).Errorf("error resolving descriptor in ServeBlob listener: %v", err)
 		} else {
@@ -181,7 +206,7 @@ func (bsl *blobServiceListener) ServeBlob(ctx context.Context, w http.ResponseWr
 
 func (bsl *blobServiceListener) Put(ctx context.Context, mediaType string, p []byte) (v1.Descriptor, error) {
 	desc, err := bsl.BlobStore.Put(ctx, mediaType, p)
-	if err == nil {
+	if err == nil && !isInternal(ctx) {
 		if err := bsl.parent.listener.BlobPushed(bsl.parent.Repository.Named(), desc); err != nil {
 			dcontext.GetLogger(ctx).Errorf("error dispatching layer push to listener: %v", err)
 		}
@@ -204,7 +229,7 @@ func (bsl *blobServiceListener) Create(ctx context.Context, options ...distribut
 
 func (bsl *blobServiceListener) Delete(ctx context.Context, dgst digest.Digest) error {
 	err := bsl.BlobStore.Delete(ctx, dgst)
-	if err == nil {
+	if err == nil && !isInternal(ctx) {
 		if err := bsl.parent.listener.BlobDeleted(bsl.parent.Repository.Named(), dgst); err != nil {
 			dcontext.GetLogger(ctx).Errorf("error dispatching layer delete to listener: %v", err)
 		}
@@ -213,6 +238,16 @@ func (bsl *blobServiceListener) Delete(ctx context.Context, dgst digest.Digest)
 	return err
 }
 
+// SetDescriptor records the descriptor of a blob if the wrapped blob store
+// supports it, it is not an event.
+func (bsl *blobServiceListener) SetDescriptor(ctx context.Context, dgst digest.Digest, desc v1.Descriptor) error {
+	setter, ok := bsl.BlobStore.(distribution.BlobDescriptorSetter)
+	if !ok {
+		return distribution.ErrUnsupported
+	}
+	return setter.SetDescriptor(ctx, dgst, desc)
+}
+
 func (bsl *blobServiceListener) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
 	wr, err := bsl.BlobStore.Resume(ctx, id)
 	return bsl.decorateWriter(wr), err
@@ -232,7 +267,7 @@ type blobWriterListener struct {
 
 func (bwl *blobWriterListener) Commit(ctx context.Context, desc v1.Descriptor) (v1.Descriptor, error) {
 	committed, err := bwl.BlobWriter.Commit(ctx, desc)
-	if err == nil {
+	if err == nil && !isInternal(ctx) {
 		if err := bwl.parent.parent.listener.BlobPushed(bwl.parent.parent.Repository.Named(), committed); err != nil {
 			dcontext.GetLogger(ctx).Errorf("error dispatching blob push to listener: %v", err)
 		}
@@ -62,6 +62,48 @@ func TestListener(t *testing.T) {
 	}
 }
 
+func TestListenerInternal(t *testing.T) {
+	ctx := dcontext.Background()
+
+	registry, err := storage.NewRegistry(ctx, inmemory.New(),
+		storage.BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)),
+		storage.EnableDelete, storage.EnableRedirect)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	tl := &testListener{
+		ops: make(map[string]int),
+	}
+
+	repoRef, _ := reference.WithName("foo/bar")
+	repository, err := registry.Repository(ctx, repoRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	repository, _ = Listen(repository, registry.(distribution.RepositoryRemover), tl)
+
+	// internal operations dispatch no event
+	internal := WithInternal(ctx)
+	blobs := repository.Blobs(internal)
+	desc, err := blobs.Put(internal, "foo/bar", []byte(`{"name": "foo"}`))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+	if _, err := blobs.Get(internal, desc.Digest); err != nil {
+		t.Fatalf("unexpected error getting blob: %v", err)
+	}
+	if len(tl.ops) != 0 {
+		t.Fatalf("unexpected events for internal operations: %v", tl.ops)
+	}
+
+	if _, err := repository.Blobs(ctx).Get(ctx, desc.Digest); err != nil {
+		t.Fatalf("unexpected error getting blob: %v", err)
+	}
+	if expectedOps := map[string]int{"layer:pull": 1}; !reflect.DeepEqual(tl.ops, expectedOps) {
+		t.Fatalf("counts do not match:\n%v\n !=\n%v", tl.ops, expectedOps)
+	}
+}
+
 type testListener struct {
 	ops map[string]int
 }
@@ -101,6 +143,11 @@ func (tl *testListener) BlobDeleted(repo reference.Named, d digest.Digest) error
 	return nil
 }
 
+func (tl *testListener) ManifestPartitioned(repo reference.Named, m distribution.Manifest, partition PartitionRecord, options ...distribution.ManifestServiceOption) error {
+	tl.ops["manifest:partition"]++
+	return nil
+}
+
 func (tl *testListener) TagDeleted(repo reference.Named, tag string) error {
 	tl.ops["tag:delete"]++
 	return nil
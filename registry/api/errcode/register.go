@@ -224,6 +224,18 @@ var (
 		the maximum allowed.`,
 		HTTPStatusCode: http.StatusBadRequest,
 	})
+
+	// ErrorCodePartitionInvalid is returned when the 2dfs partitions requested
+	// for a manifest are malformed or do not fit the field.
+	ErrorCodePartitionInvalid = register(errGroup, ErrorDescriptor{
+		Value:   "PARTITION_INVALID",
+		Message: "invalid 2dfs partition",
+		Description: `When a manifest is fetched with semantic partitions, each
+		partition must be a well formed rectangle of the 2dfs field. This
+		error is returned if a partition is malformed, inverted or out of the
+		field bounds. The detail names the offending partition.`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
 )
 
 var (
@@ -98,6 +98,32 @@ var (
 		Format:      "<digest>",
 	}
 
+	partitionHeader = ParameterDescriptor{
+		Name:        "OCI-2DFS-Partition",
+		Type:        "string",
+		Description: "2DFS partitions to select from the manifest, following the semantic tag grammar. Several partitions are separated by `--` or commas.",
+		Format:      "<partition>[--<partition>...]",
+		Examples:    []string{"0.0.1.1--r3"},
+	}
+
+	partitionParameters = []ParameterDescriptor{
+		{
+			Name:        "partition",
+			Type:        "query",
+			Description: "2DFS partitions to select from the manifest, following the semantic tag grammar. May be repeated and combines with the partitions of the header and of a semantic tag.",
+			Format:      "<partition>[--<partition>...]",
+			Required:    false,
+		},
+	}
+
+	flattenParameter = ParameterDescriptor{
+		Name:        "flatten",
+		Type:        "query",
+		Description: "If true, the allotments of the requested 2DFS partitions are flattened into a single layer per field, built once and reused.",
+		Format:      "<boolean>",
+		Required:    false,
+	}
+
 	linkHeader = ParameterDescriptor{
 		Name:        "Link",
 		Type:        "link",
@@ -536,11 +562,13 @@ var routeDescriptors = []RouteDescriptor{
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
+							partitionHeader,
 						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
 							referenceParameterDescriptor,
 						},
+						QueryParameters: append(partitionParameters, flattenParameter),
 						Successes: []ResponseDescriptor{
 							{
 								Description: "The manifest identified by `name` and `reference`. The contents can be used to identify and resolve resources required to run the specified image.",
@@ -561,6 +589,7 @@ var routeDescriptors = []RouteDescriptor{
 								ErrorCodes: []errcode.ErrorCode{
 									errcode.ErrorCodeNameInvalid,
 									errcode.ErrorCodeTagInvalid,
+									errcode.ErrorCodePartitionInvalid,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -1609,4 +1638,339 @@ var routeDescriptors = []RouteDescriptor{
 			},
 		},
 	},
+	{
+		Name:        RouteNameTdfsField,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/_2dfs/field/{reference:" + reference.TagRegexp.String() + "|" + digest.DigestRegexp.String() + "}",
+		Entity:      "2DFS Field",
+		Description: "Inspect the 2DFS fields of an image without downloading them.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Fetch the description of the 2DFS fields of the image index or image manifest identified by `name` and `reference` where `reference` can be a tag or digest.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							referenceParameterDescriptor,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The grid of every 2DFS field of the image, listed by image manifest. Image manifests without a field have no `fields`.",
+								StatusCode:  http.StatusOK,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+    "name": <name>,
+    "reference": <reference>,
+    "digest": <digest>,
+    "manifests": [
+        {
+            "digest": <digest>,
+            "platform": <platform>,
+            "fields": [
+                {
+                    "digest": <digest>,
+                    "rows": <rows_size>,
+                    "columns": [<allotments_size>, ...],
+                    "cells": [
+                        {
+                            "row": <row>,
+                            "col": <col>,
+                            "digest": <digest>,
+                            "diffID": <diffID>,
+                            "size": <size>
+                        },
+                        ...
+                    ]
+                },
+                ...
+            ]
+        },
+        ...
+    ]
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Description: "The name or reference was invalid.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameInvalid,
+									errcode.ErrorCodeTagInvalid,
+									errcode.ErrorCodeManifestInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							{
+								Description: "The named manifest is not known to the registry.",
+								StatusCode:  http.StatusNotFound,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameUnknown,
+									errcode.ErrorCodeManifestUnknown,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameTdfsPreview,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/_2dfs/preview/{reference:" + reference.TagRegexp.String() + "|" + digest.DigestRegexp.String() + "}",
+		Entity:      "2DFS Preview",
+		Description: "Preview the layers and size of a 2DFS partition without deriving the partitioned manifest.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Fetch, for every image manifest, the allotments selected by the partitions of the image identified by `name` and `reference` where `reference` can be a semantic tag, a tag or a digest. Nothing is stored by the registry.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+							partitionHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							referenceParameterDescriptor,
+						},
+						QueryParameters: partitionParameters,
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The allotments selected for every image manifest, listed by image manifest. The `size` counts every layer of the partitioned manifest, `allotmentsSize` the allotments only.",
+								StatusCode:  http.StatusOK,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+    "name": <name>,
+    "reference": <reference>,
+    "digest": <digest>,
+    "partitions": <partition>[--<partition>...],
+    "manifests": [
+        {
+            "digest": <digest>,
+            "platform": <platform>,
+            "allotments": [
+                {
+                    "mediaType": <media type>,
+                    "digest": <digest>,
+                    "size": <size>
+                },
+                ...
+            ],
+            "allotmentsSize": <size>,
+            "size": <size>
+        },
+        ...
+    ]
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Description: "The name, reference or partitions were invalid.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameInvalid,
+									errcode.ErrorCodeTagInvalid,
+									errcode.ErrorCodeManifestInvalid,
+									errcode.ErrorCodePartitionInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							{
+								Description: "The named manifest or one of its allotments is not known to the registry.",
+								StatusCode:  http.StatusNotFound,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameUnknown,
+									errcode.ErrorCodeManifestUnknown,
+									errcode.ErrorCodeBlobUnknown,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameTdfsDiff,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/_2dfs/diff/{from:" + reference.TagRegexp.String() + "|" + digest.DigestRegexp.String() + "}/{reference:" + reference.TagRegexp.String() + "|" + digest.DigestRegexp.String() + "}",
+		Entity:      "2DFS Diff",
+		Description: "Compare the 2DFS fields of two versions of an image without downloading them.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Fetch the allotments added, removed or changed from the image identified by `name` and `from` to the image identified by `name` and `reference`, where `from` and `reference` can be tags or digests.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							{
+								Name:        "from",
+								Type:        "string",
+								Format:      reference.TagRegexp.String(),
+								Required:    true,
+								Description: `Tag or digest of the previous version of the image.`,
+							},
+							referenceParameterDescriptor,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The allotments which differ between the two versions, listed by image manifest. Image manifests of image indexes are matched by platform and fields by layer order. Unchanged allotments are not listed. Sizes are zero when an allotment blob is not available.",
+								StatusCode:  http.StatusOK,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+    "name": <name>,
+    "from": <from>,
+    "fromDigest": <digest>,
+    "reference": <reference>,
+    "digest": <digest>,
+    "manifests": [
+        {
+            "platform": <platform>,
+            "from": <digest>,
+            "to": <digest>,
+            "fields": [
+                {
+                    "from": <digest>,
+                    "to": <digest>,
+                    "added": [
+                        {
+                            "row": <row>,
+                            "col": <col>,
+                            "newDigest": <digest>,
+                            "newSize": <size>,
+                            "sizeDelta": <size delta>
+                        },
+                        ...
+                    ],
+                    "removed": [
+                        {
+                            "row": <row>,
+                            "col": <col>,
+                            "oldDigest": <digest>,
+                            "oldSize": <size>,
+                            "sizeDelta": <size delta>
+                        },
+                        ...
+                    ],
+                    "changed": [
+                        {
+                            "row": <row>,
+                            "col": <col>,
+                            "oldDigest": <digest>,
+                            "newDigest": <digest>,
+                            "oldSize": <size>,
+                            "newSize": <size>,
+                            "sizeDelta": <size delta>
+                        },
+                        ...
+                    ],
+                    "sizeDelta": <size delta>
+                },
+                ...
+            ]
+        },
+        ...
+    ]
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Description: "The name or references were invalid.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameInvalid,
+									errcode.ErrorCodeTagInvalid,
+									errcode.ErrorCodeManifestInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							{
+								Description: "One of the named manifests is not known to the registry.",
+								StatusCode:  http.StatusNotFound,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameUnknown,
+									errcode.ErrorCodeManifestUnknown,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
 }
@@ -16,6 +16,9 @@ const (
 	RouteNameBlobUpload      = "blob-upload"
 	RouteNameBlobUploadChunk = "blob-upload-chunk"
 	RouteNameCatalog         = "catalog"
+	RouteNameTdfsField       = "tdfs-field"
+	RouteNameTdfsPreview     = "tdfs-preview"
+	RouteNameTdfsDiff        = "tdfs-diff"
 )
 
 var (
@@ -102,6 +102,39 @@ func TestRouter(t *testing.T) {
 				"name": "foo/bar",
 			},
 		},
+		{
+			RouteName:  RouteNameTdfsField,
+			RequestURI: "/v2/foo/bar/_2dfs/field/tag",
+			Vars: map[string]string{
+				"name":      "foo/bar",
+				"reference": "tag",
+			},
+		},
+		{
+			RouteName:  RouteNameTdfsField,
+			RequestURI: "/v2/foo/bar/_2dfs/field/sha256:abcdef0919234",
+			Vars: map[string]string{
+				"name":      "foo/bar",
+				"reference": "sha256:abcdef0919234",
+			},
+		},
+		{
+			RouteName:  RouteNameTdfsPreview,
+			RequestURI: "/v2/foo/bar/_2dfs/preview/tag--0.0.1.1",
+			Vars: map[string]string{
+				"name":      "foo/bar",
+				"reference": "tag--0.0.1.1",
+			},
+		},
+		{
+			RouteName:  RouteNameTdfsDiff,
+			RequestURI: "/v2/foo/bar/_2dfs/diff/v1/sha256:abcdef0919234",
+			Vars: map[string]string{
+				"name":      "foo/bar",
+				"from":      "v1",
+				"reference": "sha256:abcdef0919234",
+			},
+		},
 		{
 			RouteName:  RouteNameBlobUploadChunk,
 			RequestURI: "/v2/foo/bar/blobs/uploads/uuid",
@@ -162,6 +162,83 @@ func (ub *URLBuilder) BuildManifestURL(ref reference.Named) (string, error) {
 	return manifestURL.String(), nil
 }
 
+// BuildTdfsFieldURL constructs a url for the description of the 2dfs fields
+// of the manifest identified by name and reference. The argument reference
+// may be either a tag or digest.
+func (ub *URLBuilder) BuildTdfsFieldURL(ref reference.Named) (string, error) {
+	route := ub.cloneRoute(RouteNameTdfsField)
+
+	tagOrDigest := ""
+	switch v := ref.(type) {
+	case reference.Tagged:
+		tagOrDigest = v.Tag()
+	case reference.Digested:
+		tagOrDigest = v.Digest().String()
+	default:
+		return "", fmt.Errorf("reference must have a tag or digest")
+	}
+
+	fieldURL, err := route.URL("name", ref.Name(), "reference", tagOrDigest)
+	if err != nil {
+		return "", err
+	}
+
+	return fieldURL.String(), nil
+}
+
+// BuildTdfsPreviewURL constructs a url for the preview of the partitions of
+// the manifest identified by name and reference, including any url values.
+// The argument reference may be either a tag or digest.
+func (ub *URLBuilder) BuildTdfsPreviewURL(ref reference.Named, values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameTdfsPreview)
+
+	tagOrDigest := ""
+	switch v := ref.(type) {
+	case reference.Tagged:
+		tagOrDigest = v.Tag()
+	case reference.Digested:
+		tagOrDigest = v.Digest().String()
+	default:
+		return "", fmt.Errorf("reference must have a tag or digest")
+	}
+
+	previewURL, err := route.URL("name", ref.Name(), "reference", tagOrDigest)
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(previewURL, values...).String(), nil
+}
+
+// BuildTdfsDiffURL constructs a url for the differences between the 2dfs
+// fields of the manifests identified by from and to, which must name the
+// same repository. The references may be either tags or digests.
+func (ub *URLBuilder) BuildTdfsDiffURL(from, to reference.Named) (string, error) {
+	if from.Name() != to.Name() {
+		return "", fmt.Errorf("references must name the same repository")
+	}
+	route := ub.cloneRoute(RouteNameTdfsDiff)
+
+	references := make([]string, 2)
+	for i, ref := range []reference.Named{from, to} {
+		switch v := ref.(type) {
+		case reference.Tagged:
+			references[i] = v.Tag()
+		case reference.Digested:
+			references[i] = v.Digest().String()
+		default:
+			return "", fmt.Errorf("reference must have a tag or digest")
+		}
+	}
+
+	diffURL, err := route.URL("name", to.Name(), "from", references[0], "reference", references[1])
+	if err != nil {
+		return "", err
+	}
+
+	return diffURL.String(), nil
+}
+
 // BuildBlobURL constructs the url for the blob identified by name and dgst.
 func (ub *URLBuilder) BuildBlobURL(ref reference.Canonical) (string, error) {
 	route := ub.cloneRoute(RouteNameBlob)
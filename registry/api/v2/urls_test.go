@@ -71,6 +71,53 @@ func makeURLBuilderTestCases(urlBuilder *URLBuilder) []urlBuilderTestCase {
 				return urlBuilder.BuildManifestURL(fooBarRef)
 			},
 		},
+		{
+			description:  "test 2dfs field url tagged ref",
+			expectedPath: "/v2/foo/bar/_2dfs/field/tag",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				ref, _ := reference.WithTag(fooBarRef, "tag")
+				return urlBuilder.BuildTdfsFieldURL(ref)
+			},
+		},
+		{
+			description:  "test 2dfs field url bare ref",
+			expectedPath: "",
+			expectedErr:  fmt.Errorf("reference must have a tag or digest"),
+			build: func() (string, error) {
+				return urlBuilder.BuildTdfsFieldURL(fooBarRef)
+			},
+		},
+		{
+			description:  "test 2dfs preview url with partitions",
+			expectedPath: "/v2/foo/bar/_2dfs/preview/tag?partition=r0",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				ref, _ := reference.WithTag(fooBarRef, "tag")
+				return urlBuilder.BuildTdfsPreviewURL(ref, url.Values{"partition": []string{"r0"}})
+			},
+		},
+		{
+			description:  "test 2dfs diff url",
+			expectedPath: "/v2/foo/bar/_2dfs/diff/v1/sha256:3b3692957d439ac1928219a83fac91e7bf96c153725526874673ae1f2023f8d5",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				from, _ := reference.WithTag(fooBarRef, "v1")
+				to, _ := reference.WithDigest(fooBarRef, "sha256:3b3692957d439ac1928219a83fac91e7bf96c153725526874673ae1f2023f8d5")
+				return urlBuilder.BuildTdfsDiffURL(from, to)
+			},
+		},
+		{
+			description:  "test 2dfs diff url across repositories",
+			expectedPath: "",
+			expectedErr:  fmt.Errorf("references must name the same repository"),
+			build: func() (string, error) {
+				otherRef, _ := reference.WithName("foo/baz")
+				from, _ := reference.WithTag(otherRef, "v1")
+				to, _ := reference.WithTag(fooBarRef, "v2")
+				return urlBuilder.BuildTdfsDiffURL(from, to)
+			},
+		},
 		{
 			description:  "build blob url",
 			expectedPath: "/v2/foo/bar/blobs/sha256:3b3692957d439ac1928219a83fac91e7bf96c153725526874673ae1f2023f8d5",
@@ -79,6 +79,12 @@ type Access struct {
 type Grant struct {
 	User      UserInfo   // The authenticated user for the request.
 	Resources []Resource // The list of resources which have been authorized for the request.
+
+	// Partitions restricts the pulls of 2dfs images to the given partitions,
+	// by repository name. Partitions follow the grammar of semantic tags
+	// without the leading tag. Repositories missing from the map are not
+	// restricted.
+	Partitions map[string][]string
 }
 
 // Challenge is a special error type which is used for HTTP 401 Unauthorized
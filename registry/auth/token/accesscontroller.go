@@ -429,7 +429,8 @@ func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Ac
 	}
 
 	return &auth.Grant{
-		User:      auth.UserInfo{Name: claims.Subject},
-		Resources: claims.resources(),
+		User:       auth.UserInfo{Name: claims.Subject},
+		Resources:  claims.resources(),
+		Partitions: claims.partitions(),
 	}, nil
 }
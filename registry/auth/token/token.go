@@ -67,6 +67,11 @@ type ResourceActions struct {
 	Class   string   `json:"class,omitempty"`
 	Name    string   `json:"name"`
 	Actions []string `json:"actions"`
+
+	// Partitions restricts the pulls of the 2dfs images of a repository to
+	// the given partitions, following the grammar of semantic tags without
+	// the leading tag.
+	Partitions []string `json:"partitions,omitempty"`
 }
 
 // ClaimSet describes the main section of a JSON Web Token.
@@ -313,3 +318,31 @@ func (c *ClaimSet) resources() []auth.Resource {
 
 	return resources
 }
+
+// partitions returns, by repository name, the 2dfs partitions pulls are
+// restricted to. A repository granted pull access without partitions by any
+// of the claims is not restricted.
+func (c *ClaimSet) partitions() map[string][]string {
+	partitions := map[string][]string{}
+	unrestricted := map[string]bool{}
+
+	for _, resourceActions := range c.Access {
+		if resourceActions.Type != "repository" {
+			continue
+		}
+		if len(resourceActions.Partitions) > 0 {
+			partitions[resourceActions.Name] = append(partitions[resourceActions.Name], resourceActions.Partitions...)
+			continue
+		}
+		for _, action := range resourceActions.Actions {
+			if action == "pull" || action == "*" {
+				unrestricted[resourceActions.Name] = true
+			}
+		}
+	}
+
+	for name := range unrestricted {
+		delete(partitions, name)
+	}
+	return partitions
+}
@@ -15,6 +15,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -593,6 +594,31 @@ func TestAccessController(t *testing.T) {
 	}
 }
 
+// TestClaimSetPartitions tests that the 2dfs partitions granted by the claims
+// restrict the pulls of a repository unless it is also granted without them.
+func TestClaimSetPartitions(t *testing.T) {
+	claims := ClaimSet{
+		Access: []*ResourceActions{
+			{Type: "repository", Name: "foo/bar", Actions: []string{"pull"}, Partitions: []string{"0.0.1.1"}},
+			{Type: "repository", Name: "foo/bar", Actions: []string{"pull"}, Partitions: []string{"r3--ex3.0.3.0"}},
+			{Type: "repository", Name: "foo/baz", Actions: []string{"pull"}, Partitions: []string{"c0"}},
+			{Type: "repository", Name: "foo/baz", Actions: []string{"pull"}},
+			{Type: "repository", Name: "foo/qux", Actions: []string{"pull"}, Partitions: []string{"c0"}},
+			{Type: "repository", Name: "foo/qux", Actions: []string{"push"}},
+			{Type: "repository", Name: "foo/all", Actions: []string{"*"}},
+			{Type: "registry", Name: "catalog", Actions: []string{"*"}, Partitions: []string{"c0"}},
+		},
+	}
+
+	expected := map[string][]string{
+		"foo/bar": {"0.0.1.1", "r3--ex3.0.3.0"},
+		"foo/qux": {"c0"},
+	}
+	if partitions := claims.partitions(); !reflect.DeepEqual(partitions, expected) {
+		t.Fatalf("unexpected partitions: %v != %v", partitions, expected)
+	}
+}
+
 // This tests that newAccessController can handle PEM blocks in the certificate
 // file other than certificates, for example a private key.
 func TestNewAccessControllerPemBlock(t *testing.T) {
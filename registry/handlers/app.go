@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -24,6 +25,7 @@ import (
 	"github.com/2DFS/2dfs-registry/v3/health"
 	"github.com/2DFS/2dfs-registry/v3/health/checks"
 	"github.com/2DFS/2dfs-registry/v3/internal/dcontext"
+	"github.com/2DFS/2dfs-registry/v3/manifest/tdfs"
 	prometheus "github.com/2DFS/2dfs-registry/v3/metrics"
 	"github.com/2DFS/2dfs-registry/v3/notifications"
 	"github.com/2DFS/2dfs-registry/v3/registry/api/errcode"
@@ -33,6 +35,7 @@ import (
 	repositorymiddleware "github.com/2DFS/2dfs-registry/v3/registry/middleware/repository"
 	"github.com/2DFS/2dfs-registry/v3/registry/proxy"
 	"github.com/2DFS/2dfs-registry/v3/registry/storage"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/cache"
 	memorycache "github.com/2DFS/2dfs-registry/v3/registry/storage/cache/memory"
 	rediscache "github.com/2DFS/2dfs-registry/v3/registry/storage/cache/redis"
 	storagedriver "github.com/2DFS/2dfs-registry/v3/registry/storage/driver"
@@ -43,9 +46,11 @@ import (
 	events "github.com/docker/go-events"
 	"github.com/docker/go-metrics"
 	"github.com/gorilla/mux"
+	"github.com/hashicorp/golang-lru/arc/v2"
 	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 // randomSecretSize is the number of random bytes to generate if no secret
@@ -86,6 +91,29 @@ type App struct {
 
 	// readOnly is true if the registry is in a read-only maintenance mode
 	readOnly bool
+
+	// derivedContent caches the manifests and configs derived by
+	// partitioning on registries which cannot persist them, that is
+	// read-only registries and pull through caches. It is nil otherwise.
+	derivedContent cache.DerivedContentCache
+
+	// partitions collapses the identical partitionings in flight into one.
+	partitions singleflight.Group
+
+	// partitionPolicies holds the default partitions of 2dfs images served
+	// to the clients which cannot unpack 2dfs fields, by repository.
+	partitionPolicies []partitionPolicy
+
+	// blobGrants caches whether the callers granted some partitions only
+	// may read the blobs they request.
+	blobGrants *arc.ARCCache[blobGrantKey, blobGrantDecision]
+}
+
+// partitionPolicy holds the default partitions of the 2dfs images in the
+// repositories matching pattern.
+type partitionPolicy struct {
+	pattern    string
+	partitions []tdfs.Partition
 }
 
 // NewApp takes a configuration and returns a configured app, ready to serve
@@ -109,6 +137,9 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	app.register(v2.RouteNameBlob, blobDispatcher)
 	app.register(v2.RouteNameBlobUpload, blobUploadDispatcher)
 	app.register(v2.RouteNameBlobUploadChunk, blobUploadDispatcher)
+	app.register(v2.RouteNameTdfsField, tdfsFieldDispatcher)
+	app.register(v2.RouteNameTdfsPreview, tdfsPreviewDispatcher)
+	app.register(v2.RouteNameTdfsDiff, tdfsDiffDispatcher)
 
 	// override the storage driver's UA string for registry outbound HTTP requests
 	storageParams := config.Storage.Parameters()
@@ -165,6 +196,14 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	app.configureEvents(config)
 	app.configureRedis(config)
 	app.configureLogHook(config)
+	if app.readOnly || app.isCache {
+		app.configureDerivedContentCache(config)
+	}
+	app.configurePartitionPolicies(config)
+	app.blobGrants, err = arc.NewARC[blobGrantKey, blobGrantDecision](blobGrantCacheSize)
+	if err != nil {
+		panic(err)
+	}
 
 	options := registrymiddleware.GetRegistryOptions()
 
@@ -587,6 +626,66 @@ func (app *App) configureRedis(cfg *configuration.Configuration) {
 	}))
 }
 
+// configureDerivedContentCache configures the cache serving the manifests
+// derived by partitioning without persisting them. Content is cached in
+// memory unless redis is configured as the derivedcontent cache.
+func (app *App) configureDerivedContentCache(cfg *configuration.Configuration) {
+	cc := cfg.Storage["cache"]
+
+	ttl := cache.DefaultDerivedContentTTL
+	if configuredTTL, ok := cc["derivedcontentttl"]; ok {
+		var err error
+		ttl, err = time.ParseDuration(fmt.Sprint(configuredTTL))
+		if err != nil {
+			panic(fmt.Sprintf("invalid derivedcontentttl value %s: %s", configuredTTL, err))
+		}
+	}
+
+	switch v := cc["derivedcontent"]; v {
+	case "redis":
+		if app.redis == nil {
+			panic("redis configuration required to use for derivedcontent cache")
+		}
+		if _, ok := cc["derivedcontentsize"]; ok {
+			dcontext.GetLogger(app).Warnf("derivedcontentsize parameter is not supported with redis cache")
+		}
+		app.derivedContent = rediscache.NewRedisDerivedContentCache(app.redis, ttl)
+		dcontext.GetLogger(app).Infof("using redis derived content cache")
+	default:
+		if v != nil && v != "inmemory" {
+			dcontext.GetLogger(app).Warnf("unknown derived content cache type %q, using inmemory", v)
+		}
+		size := memorycache.DefaultDerivedContentSize
+		if configuredSize, ok := cc["derivedcontentsize"]; ok {
+			var err error
+			size, err = strconv.Atoi(fmt.Sprint(configuredSize))
+			if err != nil {
+				panic(fmt.Sprintf("invalid derivedcontentsize value %s: %s", configuredSize, err))
+			}
+		}
+		app.derivedContent = memorycache.NewInMemoryDerivedContentCache(size, ttl)
+		dcontext.GetLogger(app).Infof("using inmemory derived content cache")
+	}
+}
+
+// configurePartitionPolicies parses the default partitions of 2dfs images
+// configured by repository.
+func (app *App) configurePartitionPolicies(cfg *configuration.Configuration) {
+	for _, policy := range cfg.Policy.Repository.Partitions {
+		if _, err := path.Match(policy.Repository, ""); err != nil {
+			panic(fmt.Sprintf("invalid partition policy repository %q: %v", policy.Repository, err))
+		}
+		partitions, err := tdfs.ParsePartitions(policy.Default)
+		if err != nil {
+			panic(fmt.Sprintf("invalid default partitions %q of repository %q: %v", policy.Default, policy.Repository, err))
+		}
+		app.partitionPolicies = append(app.partitionPolicies, partitionPolicy{
+			pattern:    policy.Repository,
+			partitions: partitions,
+		})
+	}
+}
+
 func (app *App) createPool(cfg redis.UniversalOptions) redis.UniversalClient {
 	cfg.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
 		res := cn.Ping(ctx)
@@ -729,10 +828,11 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 			}
 
 			// assign and decorate the authorized repository with an event bridge.
+			context.events = app.eventBridge(context, r)
 			context.Repository, context.RepositoryRemover = notifications.Listen(
 				repository,
 				context.App.repoRemover,
-				app.eventBridge(context, r))
+				context.events)
 
 			context.Repository, err = applyRepoMiddleware(app, context.Repository, app.Config.Middleware["repository"])
 			if err != nil {
@@ -880,6 +980,7 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 
 	ctx := withUser(context.Context, grant.User)
 	ctx = withResources(ctx, grant.Resources)
+	ctx = withGrantedPartitions(ctx, grant.Partitions)
 
 	dcontext.GetLogger(ctx, userNameKey).Info("authorized request")
 	// TODO(stevvooe): This pattern needs to be cleaned up a bit. One context
@@ -30,16 +30,18 @@ func TestAppDispatcher(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error creating registry: %v", err)
 	}
+	// the routes are given a host below, use a router of our own so that
+	// it does not leak into the shared router of the following tests.
+	router := v2.RouterWithPrefix("")
 	app := &App{
 		Config:   &configuration.Configuration{},
 		Context:  ctx,
-		router:   v2.Router(),
+		router:   router,
 		driver:   driver,
 		registry: registry,
 	}
 	server := httptest.NewServer(app)
 	defer server.Close()
-	router := v2.Router()
 
 	serverURL, err := url.Parse(server.URL)
 	if err != nil {
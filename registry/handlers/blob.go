@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"bytes"
+	"fmt"
 	"net/http"
+	"time"
 
 	distribution "github.com/2DFS/2dfs-registry/v3"
 	"github.com/2DFS/2dfs-registry/v3/internal/dcontext"
@@ -54,6 +57,32 @@ type blobHandler struct {
 // response.
 func (bh *blobHandler) GetBlob(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(bh).Debug("GetBlob")
+
+	// callers granted some partitions of the 2dfs images only cannot read
+	// the fields, nor the allotments outside of the granted partitions,
+	// whether the blob is stored or derived
+	granted, restricted, err := bh.grantedPartitions()
+	if err != nil {
+		dcontext.GetLogger(bh).Errorf("invalid partitions granted for %s: %v", bh.Repository.Named().Name(), err)
+		bh.Errors = append(bh.Errors, errcode.ErrorCodeDenied)
+		return
+	}
+	if restricted {
+		allowed, err := bh.blobGranted(bh.Digest, granted)
+		if err != nil {
+			bh.Errors = append(bh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		if !allowed {
+			bh.Errors = append(bh.Errors, errcode.ErrorCodeDenied.WithMessage("blob is outside of the granted partitions"))
+			return
+		}
+	}
+
+	if bh.serveDerivedBlob(w, r) {
+		return
+	}
+
 	blobs := bh.Repository.Blobs(bh)
 	desc, err := blobs.Stat(bh, bh.Digest)
 	if err != nil {
@@ -72,6 +101,31 @@ func (bh *blobHandler) GetBlob(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveDerivedBlob serves the blob from the derived content cache, holding
+// the configs of the manifests partitioned by registries which cannot persist
+// them. It returns false if the blob is not cached.
+func (bh *blobHandler) serveDerivedBlob(w http.ResponseWriter, r *http.Request) bool {
+	if bh.App.derivedContent == nil {
+		return false
+	}
+
+	desc, content, err := bh.App.derivedContent.Get(bh, bh.Repository.Named().Name(), bh.Digest)
+	if err != nil {
+		if err != distribution.ErrBlobUnknown {
+			dcontext.GetLogger(bh).Warnf("error looking up derived blob %s: %v", bh.Digest, err)
+		}
+		return false
+	}
+	partitionMetrics.DerivedContentHit()
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, desc.Digest))
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	w.Header().Set("Content-Type", desc.MediaType)
+	w.Header().Set("Content-Length", fmt.Sprint(desc.Size))
+	http.ServeContent(w, r, desc.Digest.String(), time.Time{}, bytes.NewReader(content))
+	return true
+}
+
 // DeleteBlob deletes a layer blob
 func (bh *blobHandler) DeleteBlob(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(bh).Debug("DeleteBlob")
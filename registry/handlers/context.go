@@ -7,6 +7,7 @@ import (
 
 	distribution "github.com/2DFS/2dfs-registry/v3"
 	"github.com/2DFS/2dfs-registry/v3/internal/dcontext"
+	"github.com/2DFS/2dfs-registry/v3/notifications"
 	"github.com/2DFS/2dfs-registry/v3/registry/api/errcode"
 	v2 "github.com/2DFS/2dfs-registry/v3/registry/api/v2"
 	"github.com/2DFS/2dfs-registry/v3/registry/auth"
@@ -33,6 +34,11 @@ type Context struct {
 	// handler *must not* start the response via http.ResponseWriter.
 	Errors errcode.Errors
 
+	// events dispatches the events of the request which are not repository
+	// operations, such as the partitioning of 2dfs images. This field may be
+	// nil.
+	events notifications.Listener
+
 	urlBuilder *v2.URLBuilder
 
 	// TODO(stevvooe): The goal is too completely factor this context and
@@ -160,3 +166,37 @@ func authorizedResources(ctx context.Context) []auth.Resource {
 
 	return nil
 }
+
+// withGrantedPartitions returns a context with the 2dfs partitions the pulls
+// of repositories are restricted to, by repository name.
+func withGrantedPartitions(ctx context.Context, partitions map[string][]string) context.Context {
+	return grantedPartitionsContext{
+		Context:    ctx,
+		partitions: partitions,
+	}
+}
+
+type grantedPartitionsContext struct {
+	context.Context
+	partitions map[string][]string
+}
+
+type grantedPartitionsKey struct{}
+
+func (gpc grantedPartitionsContext) Value(key interface{}) interface{} {
+	if key == (grantedPartitionsKey{}) {
+		return gpc.partitions
+	}
+
+	return gpc.Context.Value(key)
+}
+
+// grantedPartitions returns the 2dfs partitions the pulls of repositories
+// have been restricted to for this request, by repository name.
+func grantedPartitions(ctx context.Context) map[string][]string {
+	if partitions, ok := ctx.Value(grantedPartitionsKey{}).(map[string][]string); ok {
+		return partitions
+	}
+
+	return nil
+}
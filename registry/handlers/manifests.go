@@ -3,7 +3,6 @@ package handlers
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"mime"
 	"net/http"
 	"strings"
@@ -79,6 +78,14 @@ type manifestHandler struct {
 	Tag        string
 	Partitions []tdfs.Partition
 	Digest     digest.Digest
+
+	// Flatten requests the allotments of the partitions to be flattened
+	// into a single layer.
+	Flatten bool
+
+	// clamped are the Partitions clamped to the grid of the fields of the
+	// image, which derived manifests are recorded and annotated with.
+	clamped []tdfs.Partition
 }
 
 // GetManifest fetches the image manifest from the storage backend, if it exists.
@@ -91,6 +98,8 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	var supports [numStorageTypes]bool
+	// clients unpacking 2dfs fields list the field media type as well
+	var supportsTdfs bool
 
 	// this parsing of Accept headers is not quite as full-featured as godoc.org's parser, but we don't care about "q=" values
 	// https://github.com/golang/gddo/blob/e91d4165076d7474d20abda83f92d15c7ebc3e81/httputil/header/header.go#L165-L202
@@ -117,33 +126,61 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 			if mediaType == v1.MediaTypeImageIndex {
 				supports[ociImageIndexSchema] = true
 			}
+			if mediaType == tdfs.MediaTypeTdfsLayer {
+				supportsTdfs = true
+			}
 		}
 	}
 
 	if imh.Tag != "" {
-		tags := imh.Repository.Tags(imh)
-
 		// Remove semantical partitioning if one provided in the tag
-		tag, partitions := tdfs.CheckTagPartitions(imh.Tag)
-		if len(partitions) > 0 {
-			imh.Tag = tag
-			imh.Partitions = partitions
-		}
-
-		desc, err := tags.Get(imh, imh.Tag)
+		tag, partitions, desc, err := resolveSemanticTag(imh, imh.Repository.Tags(imh), imh.Tag)
 		if err != nil {
-			if _, ok := err.(distribution.ErrTagUnknown); ok {
-				imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestUnknown.WithDetail(err))
-			} else {
-				imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			if err, ok := err.(errcode.Error); ok && err.Code == errcode.ErrorCodePartitionInvalid {
+				partitionMetrics.Request(partitionOutcomeError)
 			}
+			imh.Errors = append(imh.Errors, err)
 			return
 		}
+		imh.Tag = tag
+		imh.Partitions = partitions
 		imh.Digest = desc.Digest
 
 	}
 
-	if etagMatch(r, imh.Digest.String()) {
+	// partitions may also be requested aside of the reference, which makes
+	// digest references partitionable as well
+	partitions, err := requestedPartitions(r)
+	if err != nil {
+		partitionMetrics.Request(partitionOutcomeError)
+		imh.Errors = append(imh.Errors, errcode.ErrorCodePartitionInvalid.WithDetail(err))
+		return
+	}
+	imh.Partitions = append(imh.Partitions, partitions...)
+	imh.Flatten, err = requestedFlatten(r)
+	if err != nil {
+		partitionMetrics.Request(partitionOutcomeError)
+		imh.Errors = append(imh.Errors, errcode.ErrorCodePartitionInvalid.WithDetail(err))
+		return
+	}
+
+	// plain tag pulls of clients which cannot unpack 2dfs fields are served
+	// the default partitions of the repository, if any
+	var defaultPartitions []tdfs.Partition
+	if imh.Tag != "" && len(imh.Partitions) == 0 && !supportsTdfs {
+		defaultPartitions = imh.defaultPartitions()
+	}
+
+	// callers granted some partitions only are restricted to them
+	granted, restricted, err := imh.grantedPartitions()
+	if err != nil {
+		dcontext.GetLogger(imh).Errorf("invalid partitions granted for %s: %v", imh.Repository.Named().Name(), err)
+		imh.Errors = append(imh.Errors, errcode.ErrorCodeDenied)
+		return
+	}
+
+	// the etag of partitioned manifests is the digest of the derived one
+	if len(imh.Partitions) == 0 && len(defaultPartitions) == 0 && !restricted && etagMatch(r, imh.Digest.String()) {
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
@@ -152,7 +189,12 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 	if imh.Tag != "" {
 		options = append(options, distribution.WithTag(imh.Tag))
 	}
-	manifest, err := manifests.Get(imh, imh.Digest, options...)
+	// manifests derived by registries which cannot persist them are only
+	// cached
+	manifest := imh.derivedManifest(manifests, blobstore)
+	if manifest == nil {
+		manifest, err = manifests.Get(imh, imh.Digest, options...)
+	}
 	if err != nil {
 		if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
 			imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestUnknown.WithDetail(err))
@@ -220,83 +262,76 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	ct, p, err := manifest.Payload()
-	if err != nil {
-		return
-	}
-
-	// perform 2dfs partitioning if index requested and partitions provided
-	if partitionedOciManifest, ok := manifest.(*ocischema.DeserializedImageIndex); ok && len(imh.Partitions) > 0 {
-		log.Default().Printf("Partitioning index %s\n", imh.Digest)
-
-		//for each manifest in the index, partition it and upload it to the store
-		for i, manifestDescriptor := range partitionedOciManifest.Manifests {
-			submanifest, err := manifests.Get(imh, manifestDescriptor.Digest, options...)
-
+	// only 2dfs images are partitioned by default and restricted to the
+	// granted partitions, others are served as is
+	if len(defaultPartitions) > 0 || restricted {
+		hasField, err := imh.hasField(manifests, manifest)
+		if err != nil {
+			if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+				imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestUnknown.WithDetail(err))
+			} else {
+				imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			}
+			return
+		}
+		if hasField && len(defaultPartitions) > 0 {
+			// defaults larger than the fields of the image are clipped to
+			// them, images sharing none of their allotments are served as is
+			fieldPartitions, err := imh.fieldPartitions(manifests, blobstore, manifest)
 			if err != nil {
-				if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
-					imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestUnknown.WithDetail(err))
-				} else {
-					imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
-				}
+				partitionMetrics.Request(partitionOutcomeError)
+				imh.Errors = append(imh.Errors, tdfsError(err))
 				return
 			}
-
-			if ociSubManifest, isOci := submanifest.(*ocischema.DeserializedManifest); isOci {
-
-				partitioned, err := tdfs.ConvertTdfsManifestToOciManifest(imh, ociSubManifest, blobstore, imh.Partitions)
-				if err != nil {
-					imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
-					return
-				}
-				mediaType, b, err := partitioned.Payload()
-				if err != nil {
-					imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
-					return
-				}
-
-				//upload new menifest
-				digest, err := manifests.Put(imh, partitioned)
-				if err != nil {
-					imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
-					return
+			imh.Partitions = tdfs.ClipPartitions(defaultPartitions, fieldPartitions)
+		}
+		if hasField && restricted {
+			requested := len(imh.Partitions) > 0
+			imh.Partitions, err = restrictPartitions(imh.Partitions, granted)
+			if err != nil {
+				if requested {
+					partitionMetrics.Request(partitionOutcomeError)
 				}
+				imh.Errors = append(imh.Errors, err)
+				return
+			}
+		}
+	}
 
-				partitionedOciManifest.Manifests[i] = distribution.Descriptor{
-					Digest:    digest,
-					Size:      int64(len(b)),
-					MediaType: mediaType,
-				}
-				log.Default().Printf("Saved partitioned manifest %s\n", digest)
+	ct, p, err := manifest.Payload()
+	if err != nil {
+		return
+	}
 
+	// perform 2dfs partitioning if partitions provided for an index or an image manifest
+	_, isImageIndex := manifest.(*ocischema.DeserializedImageIndex)
+	_, isImageManifest := manifest.(*ocischema.DeserializedManifest)
+	if (isImageIndex || isImageManifest) && len(imh.Partitions) > 0 {
+		derived, derivedDigest, err := imh.partition(manifests, blobstore, manifest)
+		if err != nil {
+			switch err := err.(type) {
+			case distribution.ErrManifestUnknownRevision:
+				imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestUnknown.WithDetail(err))
+			case tdfs.ErrPartitionInvalid:
+				imh.Errors = append(imh.Errors, errcode.ErrorCodePartitionInvalid.WithDetail(err))
+			case errcode.Error:
+				imh.Errors = append(imh.Errors, err)
+			default:
+				imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 			}
-
+			return
 		}
 
-		// Generate new index with partition
-		bytes, err := tdfs.ConvertPartitionedIndexToOciIndex(partitionedOciManifest)
-		imh.Digest = digest.FromBytes(bytes)
-		if err != nil {
-			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		imh.Digest = derivedDigest
+		if etagMatch(r, imh.Digest.String()) {
+			w.WriteHeader(http.StatusNotModified)
 			return
 		}
-		newIndex, _, err := distribution.UnmarshalManifest(v1.MediaTypeImageIndex, bytes)
+		ct, p, err = derived.Payload()
 		if err != nil {
-			imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestInvalid.WithMessage("Unable to marshal newly generated manifest"))
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 			return
 		}
-
-		// Upload new index if not existing
-		if exists, _ := manifests.Exists(imh, imh.Digest); !exists {
-			imh.Digest, err = manifests.Put(imh, newIndex)
-			if err != nil {
-				log.Default().Printf("[ERROR PUT]: %s \n", err.Error())
-				imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestInvalid.WithMessage("Unable to save newly generated manifest"))
-				return
-			}
-		}
-
-		_, p, _ = newIndex.Payload()
 	}
 
 	w.Header().Set("Content-Type", ct)
@@ -398,6 +433,8 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 					imh.Errors = append(imh.Errors, errcode.ErrorCodeNameInvalid.WithDetail(err))
 				case distribution.ErrManifestUnverified:
 					imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestUnverified)
+				case tdfs.ErrFieldInvalid:
+					imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestInvalid.WithDetail(verificationError))
 				default:
 					if verificationError == digest.ErrDigestInvalidFormat {
 						imh.Errors = append(imh.Errors, errcode.ErrorCodeDigestInvalid)
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"time"
+
+	prometheus "github.com/2DFS/2dfs-registry/v3/metrics"
+	"github.com/docker/go-metrics"
+	promclient "github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of the partition requests.
+const (
+	// partitionOutcomeHit is the outcome of requests served a recorded
+	// derived manifest.
+	partitionOutcomeHit = "hit"
+	// partitionOutcomeDerived is the outcome of requests deriving the
+	// manifest.
+	partitionOutcomeDerived = "derived"
+	// partitionOutcomeShared is the outcome of requests served the manifest
+	// derived by an identical request in flight.
+	partitionOutcomeShared = "shared"
+	// partitionOutcomeError is the outcome of failed or canceled requests.
+	partitionOutcomeError = "error"
+)
+
+// Caches serving derived content.
+const (
+	// partitionCachePartitions is the cache of the manifests derived by the
+	// registries persisting them, recorded by partitions.
+	partitionCachePartitions = "partitions"
+	// partitionCacheDerivedContent is the cache of the manifests and configs
+	// derived by the registries which cannot persist them.
+	partitionCacheDerivedContent = "derivedcontent"
+)
+
+var (
+	// partitionRequests is the number of partition requests by outcome
+	partitionRequests = prometheus.PartitionNamespace.NewLabeledCounter("requests", "The number of partition requests", "outcome")
+	// partitionHits is the number of derived manifests and configs served from a cache by cache
+	partitionHits = prometheus.PartitionNamespace.NewLabeledCounter("cache_hits", "The number of derived manifests and configs served from a cache", "cache")
+	// partitionMisses is the number of partition requests which derived the manifest themselves
+	partitionMisses = prometheus.PartitionNamespace.NewCounter("cache_misses", "The number of partition requests which derived the manifest themselves")
+	// partitionDuration is the time deriving partitioned manifests takes by outcome
+	partitionDuration = prometheus.PartitionNamespace.NewLabeledTimer("duration", "The number of seconds deriving a partitioned manifest takes", "outcome")
+	// partitionAllotments is the distribution of the number of allotments selected by a derivation
+	partitionAllotments = promclient.NewHistogram(promclient.HistogramOpts{
+		Namespace: prometheus.NamespacePrefix,
+		Subsystem: "partition",
+		Name:      "allotments",
+		Help:      "The number of allotments selected by a derived manifest",
+		Buckets:   promclient.ExponentialBuckets(1, 2, 11),
+	})
+	// partitionAllotmentBytes is the size of the allotments referenced by derived manifests
+	partitionAllotmentBytes = prometheus.PartitionNamespace.NewCounter("allotment_bytes", "The size of total bytes of allotments referenced by derived manifests")
+)
+
+// partitionMetricsCollector records the metrics of the partitioning of 2dfs
+// images.
+type partitionMetricsCollector struct{}
+
+// partitionMetrics tracks metrics about partitioning. This is kept globally
+// and exposed by prometheus.
+var partitionMetrics = &partitionMetricsCollector{}
+
+func init() {
+	prometheus.PartitionNamespace.Add(partitionAllotments)
+	metrics.Register(prometheus.PartitionNamespace)
+
+	for _, outcome := range []string{partitionOutcomeHit, partitionOutcomeDerived, partitionOutcomeShared, partitionOutcomeError} {
+		partitionRequests.WithValues(outcome).Inc(0)
+	}
+	for _, cache := range []string{partitionCachePartitions, partitionCacheDerivedContent} {
+		partitionHits.WithValues(cache).Inc(0)
+	}
+}
+
+// Request tracks a partition request with the given outcome. Requests
+// sharing the derivation of an identical request in flight are neither cache
+// hits nor misses, they are only counted by their outcome.
+func (pmc *partitionMetricsCollector) Request(outcome string) {
+	partitionRequests.WithValues(outcome).Inc(1)
+
+	switch outcome {
+	case partitionOutcomeHit:
+		partitionHits.WithValues(partitionCachePartitions).Inc(1)
+	case partitionOutcomeDerived:
+		partitionMisses.Inc(1)
+	}
+}
+
+// DerivedContentHit tracks a derived manifest or config served from the
+// derived content cache.
+func (pmc *partitionMetricsCollector) DerivedContentHit() {
+	partitionHits.WithValues(partitionCacheDerivedContent).Inc(1)
+}
+
+// StartDerivation starts timing a derivation, the returned function stops
+// it with the error of the derivation.
+func (pmc *partitionMetricsCollector) StartDerivation() func(err error) {
+	start := time.Now()
+	return func(err error) {
+		outcome := "success"
+		if err != nil {
+			outcome = "error"
+		}
+		partitionDuration.WithValues(outcome).UpdateSince(start)
+	}
+}
+
+// Derived tracks the allotments referenced by a derived manifest.
+func (pmc *partitionMetricsCollector) Derived(stats partitionStats) {
+	partitionAllotments.Observe(float64(stats.allotments))
+	partitionAllotmentBytes.Inc(float64(stats.size))
+}
@@ -0,0 +1,1008 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/internal/dcontext"
+	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/2DFS/2dfs-registry/v3/manifest/tdfs"
+	"github.com/2DFS/2dfs-registry/v3/notifications"
+	"github.com/2DFS/2dfs-registry/v3/registry/api/errcode"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/cache"
+	"github.com/2DFS/2dfs-registry/v3/tracing"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+)
+
+// tracer is the OpenTelemetry tracer utilized for tracing the partitioning
+// of 2dfs manifests.
+var tracer = otel.Tracer("github.com/2DFS/2dfs-registry/v3/registry/handlers")
+
+// parseSemanticTag splits tag into the plain tag and the partitions it
+// requests, as tdfs.CheckTagPartitions does.
+func parseSemanticTag(ctx context.Context, tag string) (string, []tdfs.Partition, error) {
+	_, span := tracer.Start(
+		ctx,
+		"ParseSemanticTag",
+		trace.WithAttributes(attribute.String(tracing.AttributePrefix+"tdfs.tag", tag)))
+	defer span.End()
+
+	plain, partitions, err := tdfs.CheckTagPartitions(tag)
+	if err == nil {
+		span.SetAttributes(attribute.String(tracing.AttributePrefix+"tdfs.partitions", tdfs.FormatPartitions(partitions)))
+	}
+	return plain, partitions, err
+}
+
+// resolveSemanticTag resolves the semantic tag reference to the plain tag,
+// the partitions it requests and the descriptor the tag points to. The
+// reference is looked up as a plain tag first, so that pushed tags holding
+// the partition separator are served as is, and only parsed as a semantic
+// tag if it is unknown. Partitions which cannot be parsed are only reported
+// if the tag they follow exists. The returned errors are registry API errors.
+func resolveSemanticTag(ctx context.Context, tags distribution.TagService, reference string) (string, []tdfs.Partition, v1.Descriptor, error) {
+	desc, err := tags.Get(ctx, reference)
+	if err == nil {
+		return reference, nil, desc, nil
+	}
+	if _, ok := err.(distribution.ErrTagUnknown); !ok {
+		return "", nil, v1.Descriptor{}, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	unknown := errcode.ErrorCodeManifestUnknown.WithDetail(err)
+
+	tag, partitions, err := parseSemanticTag(ctx, reference)
+	if tag == reference {
+		return "", nil, v1.Descriptor{}, unknown
+	}
+	desc, tagErr := tags.Get(ctx, tag)
+	if tagErr != nil {
+		if _, ok := tagErr.(distribution.ErrTagUnknown); ok {
+			return "", nil, v1.Descriptor{}, unknown
+		}
+		return "", nil, v1.Descriptor{}, errcode.ErrorCodeUnknown.WithDetail(tagErr)
+	}
+	if err != nil {
+		return "", nil, v1.Descriptor{}, errcode.ErrorCodePartitionInvalid.WithDetail(err)
+	}
+	return tag, partitions, desc, nil
+}
+
+// partitionIndex returns the persistent index of the manifests derived by
+// partitioning in the current repository, or nil if the registry does not
+// support one.
+func (imh *manifestHandler) partitionIndex() distribution.PartitionIndex {
+	provider, ok := imh.App.registry.(distribution.PartitionIndexProvider)
+	if !ok {
+		return nil
+	}
+	return provider.PartitionIndex(imh.Repository.Named())
+}
+
+// requestedPartitions returns the partitions requested through the
+// partition query parameters and the partition header of r, which follow
+// the same grammar as semantic tags. Header values may also be separated by
+// commas.
+func requestedPartitions(r *http.Request) ([]tdfs.Partition, error) {
+	values := r.URL.Query()[tdfs.PartitionQueryParam]
+	for _, header := range r.Header.Values(tdfs.PartitionHeader) {
+		for _, value := range strings.Split(header, ",") {
+			values = append(values, strings.TrimSpace(value))
+		}
+	}
+
+	partitions := []tdfs.Partition{}
+	for _, value := range values {
+		parsed, err := tdfs.ParsePartitions(value)
+		if err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, parsed...)
+	}
+	return partitions, nil
+}
+
+// defaultPartitions returns the partitions served by default for the 2dfs
+// images of the current repository by the first matching partition policy,
+// or nil if no policy applies.
+func (imh *manifestHandler) defaultPartitions() []tdfs.Partition {
+	name := imh.Repository.Named().Name()
+	for _, policy := range imh.App.partitionPolicies {
+		if matched, _ := path.Match(policy.pattern, name); matched || policy.pattern == "" {
+			return policy.partitions
+		}
+	}
+	return nil
+}
+
+// grantedPartitions returns the partitions the access grant restricts the
+// pulls of the 2dfs images of the current repository to, and whether they
+// are restricted at all. The partitions are nil if they are not restricted.
+func (ctx *Context) grantedPartitions() ([]tdfs.Partition, bool, error) {
+	granted, restricted := grantedPartitions(ctx)[ctx.Repository.Named().Name()]
+	if !restricted {
+		return nil, false, nil
+	}
+
+	// every grant applies its exclusions to its own partitions only
+	partitions := []tdfs.Partition{}
+	for _, grant := range granted {
+		parsed, err := tdfs.ParsePartitions(grant)
+		if err != nil {
+			return nil, true, err
+		}
+		partitions = append(partitions, tdfs.NormalizePartitions(parsed)...)
+	}
+	return partitions, true, nil
+}
+
+// restrictPartitions clips the partitions requested from a 2dfs image to the
+// granted ones. Requests for the whole image, or for partitions outside of
+// the granted ones, are denied.
+func restrictPartitions(partitions, granted []tdfs.Partition) ([]tdfs.Partition, error) {
+	if len(partitions) == 0 {
+		return nil, errcode.ErrorCodeDenied.WithMessage("access is granted to some partitions of the image only")
+	}
+	partitions = tdfs.ClipPartitions(partitions, granted)
+	if len(partitions) == 0 {
+		return nil, errcode.ErrorCodeDenied.WithMessage("requested partitions are outside of the granted ones")
+	}
+	return partitions, nil
+}
+
+// blobGrantTTL is the time the decisions of blobGranted are cached for, so
+// that restricted callers pulling the layers of an image do not inspect the
+// repository again for every layer.
+const blobGrantTTL = time.Minute
+
+// blobGrantCacheSize is the number of decisions of blobGranted cached.
+const blobGrantCacheSize = 10000
+
+// blobGrantKey identifies a decision of blobGranted.
+type blobGrantKey struct {
+	repo    string
+	granted string
+	digest  digest.Digest
+}
+
+// blobGrantDecision is a decision of blobGranted, cached until expires.
+type blobGrantDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+// blobGranted returns whether callers granted the partitions of the current
+// repository only may read the blob dgst. Field layers are denied, as well
+// as the allotments lying outside of the granted partitions and the layers
+// of the manifests derived for partitions outside of the granted ones. The
+// decisions are cached for blobGrantTTL by repository, granted partitions
+// and blob.
+func (ctx *Context) blobGranted(dgst digest.Digest, granted []tdfs.Partition) (bool, error) {
+	key := blobGrantKey{
+		repo:    ctx.Repository.Named().Name(),
+		granted: tdfs.FormatPartitions(granted),
+		digest:  dgst,
+	}
+	if ctx.App.blobGrants != nil {
+		if decision, ok := ctx.App.blobGrants.Get(key); ok && time.Now().Before(decision.expires) {
+			return decision.allowed, nil
+		}
+	}
+
+	allowed, err := ctx.checkBlobGrant(dgst, granted)
+	if err != nil {
+		return false, err
+	}
+	if ctx.App.blobGrants != nil {
+		ctx.App.blobGrants.Add(key, blobGrantDecision{allowed: allowed, expires: time.Now().Add(blobGrantTTL)})
+	}
+	return allowed, nil
+}
+
+// checkBlobGrant inspects the manifests of the current repository for
+// blobGranted. The tagged images are inspected first: the blobs they
+// reference and the allotments of their fields are settled without reading
+// the other manifests. The remaining blobs, such as the flattened layers of
+// the derived manifests, are looked up through every manifest of the
+// repository.
+func (ctx *Context) checkBlobGrant(dgst digest.Digest, granted []tdfs.Partition) (bool, error) {
+	ictx := notifications.WithInternal(ctx)
+	manifests, err := ctx.Repository.Manifests(ictx)
+	if err != nil {
+		return false, err
+	}
+	blobs := ctx.Repository.Blobs(ictx)
+
+	grant := tdfs.BlobUnrelated
+	referenced := false
+	visited := map[digest.Digest]bool{}
+	var visit func(digest.Digest) error
+	visit = func(manifestDigest digest.Digest) error {
+		if visited[manifestDigest] || grant == tdfs.BlobGranted {
+			return nil
+		}
+		visited[manifestDigest] = true
+		manifest, err := manifests.Get(ictx, manifestDigest)
+		if err != nil {
+			if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+				return nil
+			}
+			return err
+		}
+
+		var manifestGrant tdfs.BlobGrant
+		switch m := manifest.(type) {
+		case *ocischema.DeserializedImageIndex:
+			for _, descriptor := range m.Manifests {
+				if err := visit(descriptor.Digest); err != nil {
+					return err
+				}
+			}
+			return nil
+		case *ocischema.DeserializedManifest:
+			if m.Config.Digest == dgst || slices.ContainsFunc(m.Layers, func(layer v1.Descriptor) bool {
+				return layer.Digest == dgst && layer.MediaType != tdfs.MediaTypeTdfsLayer
+			}) {
+				referenced = true
+			}
+			if tdfs.HasField(m) {
+				manifestGrant, err = tdfs.CheckBlobGrant(ictx, m, blobs, dgst, granted)
+			} else {
+				manifestGrant, err = derivedBlobGrant(ictx, manifests, m, dgst, granted)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// blobs granted by any manifest are granted
+		if manifestGrant == tdfs.BlobGranted || grant == tdfs.BlobUnrelated {
+			grant = manifestGrant
+		}
+		return nil
+	}
+
+	tags := ctx.Repository.Tags(ictx)
+	all, err := tags.All(ictx)
+	if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+		err = nil
+	}
+	for _, tag := range all {
+		desc, tagErr := tags.Get(ictx, tag)
+		if tagErr == nil {
+			tagErr = visit(desc.Digest)
+		}
+		if tagErr != nil {
+			err = tagErr
+			break
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	if grant != tdfs.BlobUnrelated || referenced {
+		return grant != tdfs.BlobDenied, nil
+	}
+
+	if enumerator, ok := manifests.(distribution.ManifestEnumerator); ok {
+		if err := enumerator.Enumerate(ictx, visit); err != nil {
+			return false, err
+		}
+	}
+	return grant != tdfs.BlobDenied, nil
+}
+
+// derivedBlobGrant returns whether callers granted the partitions only may
+// read the blob dgst as a layer of the manifest m, derived by partitioning a
+// 2dfs manifest. The allotments and flattened layers of derived manifests
+// are granted if their recorded partitions are, regular layers are
+// unrelated.
+func derivedBlobGrant(ctx context.Context, manifests distribution.ManifestService, m *ocischema.DeserializedManifest, dgst digest.Digest, granted []tdfs.Partition) (tdfs.BlobGrant, error) {
+	recorded, ok := m.Annotations[tdfs.AnnotationPartitions]
+	if !ok || m.Subject == nil || !slices.ContainsFunc(m.Layers, func(layer v1.Descriptor) bool { return layer.Digest == dgst }) {
+		return tdfs.BlobUnrelated, nil
+	}
+
+	source, err := manifests.Get(ctx, m.Subject.Digest)
+	if err != nil {
+		if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+			return tdfs.BlobDenied, nil
+		}
+		return tdfs.BlobUnrelated, err
+	}
+	if sourceManifest, ok := source.(*ocischema.DeserializedManifest); ok {
+		for _, layer := range sourceManifest.Layers {
+			if layer.Digest == dgst && layer.MediaType != tdfs.MediaTypeTdfsLayer {
+				return tdfs.BlobUnrelated, nil
+			}
+		}
+	}
+
+	partitions, err := tdfs.ParsePartitions(recorded)
+	if err != nil {
+		return tdfs.BlobDenied, nil
+	}
+	partitions = tdfs.NormalizePartitions(partitions)
+	if tdfs.FormatPartitions(tdfs.ClipPartitions(partitions, granted)) != tdfs.FormatPartitions(partitions) {
+		return tdfs.BlobDenied, nil
+	}
+	return tdfs.BlobGranted, nil
+}
+
+// hasField returns whether the image manifest, or one of the image manifests
+// of the image index, carries a 2dfs field. The image manifests are read
+// internally, they are not pulled.
+func (ctx *Context) hasField(manifests distribution.ManifestService, manifest distribution.Manifest) (bool, error) {
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		return tdfs.HasField(m), nil
+	case *ocischema.DeserializedImageIndex:
+		for _, descriptor := range m.Manifests {
+			if descriptor.MediaType != v1.MediaTypeImageManifest {
+				continue
+			}
+			submanifest, err := manifests.Get(notifications.WithInternal(ctx), descriptor.Digest)
+			if err != nil {
+				return false, err
+			}
+			if ociSubManifest, ok := submanifest.(*ocischema.DeserializedManifest); ok && tdfs.HasField(ociSubManifest) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// fieldPartitions returns the partitions selecting the allotments of the
+// fields of the image manifest, or those common to the fields of every 2dfs
+// image manifest of the image index, so that partitions clipped to them fit
+// every field. The image manifests are read internally, they are not pulled.
+func (imh *manifestHandler) fieldPartitions(manifests distribution.ManifestService, blobs distribution.BlobStore, manifest distribution.Manifest) ([]tdfs.Partition, error) {
+	ctx := notifications.WithInternal(imh)
+	ociManifests := []*ocischema.DeserializedManifest{}
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		ociManifests = append(ociManifests, m)
+	case *ocischema.DeserializedImageIndex:
+		for _, descriptor := range m.Manifests {
+			submanifest, err := manifests.Get(ctx, descriptor.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if ociSubManifest, ok := submanifest.(*ocischema.DeserializedManifest); ok {
+				ociManifests = append(ociManifests, ociSubManifest)
+			}
+		}
+	}
+
+	var partitions []tdfs.Partition
+	for _, m := range ociManifests {
+		if !tdfs.HasField(m) {
+			continue
+		}
+		fieldPartitions, err := tdfs.FieldPartitions(ctx, m, blobs)
+		if err != nil {
+			return nil, err
+		}
+		if partitions == nil {
+			partitions = fieldPartitions
+		} else {
+			partitions = tdfs.ClipPartitions(partitions, fieldPartitions)
+		}
+	}
+	return partitions, nil
+}
+
+// requestedFlatten returns whether the flatten query parameter of r requests
+// the allotments of the partitions to be flattened into a single layer.
+func requestedFlatten(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get(tdfs.FlattenQueryParam)
+	if value == "" {
+		return false, nil
+	}
+	flatten, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value %q", tdfs.FlattenQueryParam, value)
+	}
+	return flatten, nil
+}
+
+// clampPartitions checks that the requested partitions fit the fields of the
+// image manifest, or of every 2dfs image manifest of the image index, and
+// returns them clamped to the grid enclosing the fields. Equivalent requests
+// thus share the same key, whether they name the grid ends or leave them
+// open. It also returns whether the image carries any field at all.
+func (imh *manifestHandler) clampPartitions(manifests distribution.ManifestService, blobs distribution.BlobStore, manifest distribution.Manifest) ([]tdfs.Partition, bool, error) {
+	// the reads are part of the partitioning, not pulls of their own
+	ctx := notifications.WithInternal(imh)
+	ociManifests := []*ocischema.DeserializedManifest{}
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		ociManifests = append(ociManifests, m)
+	case *ocischema.DeserializedImageIndex:
+		for _, descriptor := range m.Manifests {
+			submanifest, err := manifests.Get(ctx, descriptor.Digest)
+			if err != nil {
+				return nil, false, err
+			}
+			if ociSubManifest, ok := submanifest.(*ocischema.DeserializedManifest); ok {
+				ociManifests = append(ociManifests, ociSubManifest)
+			}
+		}
+	}
+
+	var rows, cols int
+	hasField := false
+	for _, m := range ociManifests {
+		if !tdfs.HasField(m) {
+			continue
+		}
+		hasField = true
+		fieldRows, fieldCols, err := tdfs.CheckManifestPartitions(ctx, m, blobs, imh.Partitions)
+		if err != nil {
+			return nil, false, err
+		}
+		rows, cols = max(rows, fieldRows), max(cols, fieldCols)
+	}
+	return tdfs.ClampPartitions(imh.Partitions, rows, cols), hasField, nil
+}
+
+// partitionKey returns the key recording the manifest derived for the
+// partitions in the partition index. Derived manifests carry the tag their
+// source was requested by, so the tag is part of the key, and flattened
+// manifests are recorded apart from the others.
+func partitionKey(tag string, partitions []tdfs.Partition, flatten bool) string {
+	key := tdfs.FormatPartitions(partitions)
+	if tag != "" {
+		key = tag + "@" + key
+	}
+	if flatten {
+		key += "+flatten"
+	}
+	return key
+}
+
+// flattenIndex returns the persistent index of the layers flattened from
+// allotments in the current repository, or nil if the registry does not
+// support one.
+func (imh *manifestHandler) flattenIndex() distribution.FlattenIndex {
+	provider, ok := imh.App.registry.(distribution.FlattenIndexProvider)
+	if !ok {
+		return nil
+	}
+	return provider.FlattenIndex(imh.Repository.Named())
+}
+
+// flattener returns the tdfs.Flattener storing the flattened layers in
+// blobs. Flattened layers are recorded in the flatten index, so that every
+// set of allotments is flattened only once.
+func (imh *manifestHandler) flattener(blobs distribution.BlobStore) tdfs.Flattener {
+	flattenIndex := imh.flattenIndex()
+
+	return func(ctx context.Context, allotments []distribution.Descriptor) (distribution.Descriptor, digest.Digest, error) {
+		key := tdfs.FlattenKey(allotments)
+		if flattenIndex != nil {
+			layer, diffID, err := flattenIndex.Get(ctx, key)
+			switch err {
+			case nil:
+				desc, err := blobs.Stat(ctx, layer)
+				if err == nil {
+					desc.MediaType = v1.MediaTypeImageLayerGzip
+					return desc, diffID, nil
+				}
+				dcontext.GetLogger(ctx).Warnf("flattened layer %s is not available, flattening it again: %v", layer, err)
+			case distribution.ErrFlattenUnknown:
+			default:
+				dcontext.GetLogger(ctx).Warnf("error looking up flattened layer %s: %v", key, err)
+			}
+		}
+
+		desc, diffID, err := tdfs.FlattenAllotments(ctx, blobs, allotments)
+		if err != nil {
+			return distribution.Descriptor{}, "", err
+		}
+		dcontext.GetLogger(ctx).Debugf("flattened %d allotments into %s", len(allotments), desc.Digest)
+
+		if flattenIndex != nil {
+			if err := flattenIndex.Set(ctx, key, desc.Digest, diffID); err != nil {
+				dcontext.GetLogger(ctx).Warnf("error recording flattened layer %s: %v", key, err)
+			}
+		}
+		return desc, diffID, nil
+	}
+}
+
+// convert derives the image manifest holding the requested partitions of a
+// 2dfs image manifest, flattening its allotments if requested, and returns
+// it with the number of allotments selected.
+func (imh *manifestHandler) convert(ctx context.Context, blobs distribution.BlobStore, manifest *ocischema.DeserializedManifest, provenance tdfs.Provenance) (distribution.Manifest, int, error) {
+	if imh.Flatten {
+		return tdfs.ConvertTdfsManifestToFlatOciManifest(ctx, manifest, blobs, imh.Partitions, provenance, imh.flattener(blobs))
+	}
+	return tdfs.ConvertTdfsManifestToOciManifest(ctx, manifest, blobs, imh.Partitions, provenance)
+}
+
+// partitioned is the outcome of a partitioning, shared by the identical
+// requests in flight.
+type partitioned struct {
+	manifest distribution.Manifest
+	digest   digest.Digest
+}
+
+// partition derives the manifest holding only the requested partitions of
+// the 2dfs image index or image manifest stored at imh.Digest. Derived
+// manifests are stored and recorded in the partition index, so that later
+// requests for the same partitions resolve by reading the fields only, to
+// clamp the partitions, and a single lookup. Registries
+// which cannot persist them, read-only registries and pull through caches,
+// keep derived manifests and configs in the derived content cache instead.
+//
+// Identical requests in flight, for the same partitions of the same source in
+// the same repository, share a single derivation.
+func (imh *manifestHandler) partition(manifests distribution.ManifestService, blobs distribution.BlobStore, manifest distribution.Manifest) (distribution.Manifest, digest.Digest, error) {
+	clamped, hasField, err := imh.clampPartitions(manifests, blobs, manifest)
+	if err != nil {
+		partitionMetrics.Request(partitionOutcomeError)
+		return nil, "", err
+	}
+	// images without any 2dfs field have nothing to partition, they are
+	// served as is
+	if !hasField {
+		return manifest, imh.Digest, nil
+	}
+	imh.clamped = clamped
+	partitions := partitionKey(imh.Tag, clamped, imh.Flatten)
+	partitionIndex := imh.partitionIndex()
+
+	if imh.App.derivedContent != nil {
+		if imh.Flatten {
+			partitionMetrics.Request(partitionOutcomeError)
+			return nil, "", errcode.ErrorCodeUnsupported.WithMessage("flattening is not supported by read-only registries and pull through caches")
+		}
+		blobs = &derivedBlobStore{
+			BlobStore: blobs,
+			cache:     imh.App.derivedContent,
+			repo:      imh.Repository.Named().Name(),
+		}
+	}
+
+	if partitionIndex != nil {
+		derivedDigest, err := partitionIndex.Get(imh, imh.Digest, partitions)
+		switch err {
+		case nil:
+			derived, err := manifests.Get(imh, derivedDigest)
+			if err == nil {
+				partitionMetrics.Request(partitionOutcomeHit)
+				return derived, derivedDigest, nil
+			}
+			dcontext.GetLogger(imh).Warnf("derived manifest %s of %s is not available, deriving it again: %v", derivedDigest, imh.Digest, err)
+		case distribution.ErrPartitionUnknown:
+		default:
+			dcontext.GetLogger(imh).Warnf("error looking up partitions %q of %s: %v", partitions, imh.Digest, err)
+		}
+	}
+
+	// the shared derivation outlives the request which started it, waiters
+	// only give up on their own cancellation. Its reads and writes are
+	// reported by a single partition event.
+	key := imh.Repository.Named().Name() + "@" + imh.Digest.String() + "@" + partitions
+	ctx := notifications.WithInternal(context.WithoutCancel(imh))
+	outcome := partitionOutcomeShared
+	result := imh.App.partitions.DoChan(key, func() (interface{}, error) {
+		outcome = partitionOutcomeDerived
+		done := partitionMetrics.StartDerivation()
+		derived, derivedDigest, err := imh.derive(ctx, manifests, blobs, manifest, partitionIndex, partitions)
+		done(err)
+		return partitioned{manifest: derived, digest: derivedDigest}, err
+	})
+
+	select {
+	case <-imh.Done():
+		partitionMetrics.Request(partitionOutcomeError)
+		return nil, "", imh.Err()
+	case res := <-result:
+		if res.Err != nil {
+			partitionMetrics.Request(partitionOutcomeError)
+			return nil, "", res.Err
+		}
+		if outcome == partitionOutcomeShared {
+			dcontext.GetLogger(imh).Debugf("shared partitions %q of %s", partitions, imh.Digest)
+		}
+		partitionMetrics.Request(outcome)
+		derived := res.Val.(partitioned)
+		return derived.manifest, derived.digest, nil
+	}
+}
+
+// derive derives the manifest holding the requested partitions of the source
+// manifest, stores it and records it in the partition index under
+// partitions. Every derivation dispatches a partition event.
+func (imh *manifestHandler) derive(ctx context.Context, manifests distribution.ManifestService, blobs distribution.BlobStore, manifest distribution.Manifest, partitionIndex distribution.PartitionIndex, partitions string) (distribution.Manifest, digest.Digest, error) {
+	ctx, span := tracer.Start(
+		ctx,
+		"DerivePartitions",
+		trace.WithAttributes(
+			attribute.String(tracing.AttributePrefix+"tdfs.source.digest", imh.Digest.String()),
+			attribute.String(tracing.AttributePrefix+"tdfs.partitions", partitions),
+		))
+	defer span.End()
+
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		return nil, "", err
+	}
+	provenance := tdfs.Provenance{
+		Source: distribution.Descriptor{
+			MediaType: mediaType,
+			Digest:    imh.Digest,
+			Size:      int64(len(payload)),
+		},
+		Tag: imh.Tag,
+	}
+
+	var derived distribution.Manifest
+	var stats partitionStats
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedImageIndex:
+		dcontext.GetLogger(ctx).Debugf("partitioning index %s", imh.Digest)
+		derived, stats, err = imh.partitionImageIndex(ctx, manifests, blobs, m, provenance)
+	case *ocischema.DeserializedManifest:
+		dcontext.GetLogger(ctx).Debugf("partitioning manifest %s", imh.Digest)
+		derived, stats, err = imh.partitionImageManifest(ctx, blobs, m, provenance)
+	default:
+		err = fmt.Errorf("partitioning is not supported for %T", manifest)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	partitionMetrics.Derived(stats)
+
+	_, payload, err = derived.Payload()
+	if err != nil {
+		return nil, "", err
+	}
+	derivedDigest := digest.FromBytes(payload)
+
+	if imh.App.derivedContent != nil {
+		derivedDigest, err = imh.putDerived(ctx, manifests, derived)
+		if err != nil {
+			return nil, "", err
+		}
+		imh.manifestPartitioned(ctx, derived, stats.allotments)
+		return derived, derivedDigest, nil
+	}
+
+	// upload the derived manifest if not existing
+	if exists, _ := manifests.Exists(ctx, derivedDigest); !exists {
+		derivedDigest, err = imh.putDerived(ctx, manifests, derived)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if partitionIndex != nil {
+		if err := partitionIndex.Set(ctx, imh.Digest, partitions, derivedDigest); err != nil {
+			dcontext.GetLogger(ctx).Warnf("error recording partitions %q of %s: %v", partitions, imh.Digest, err)
+		}
+	}
+
+	imh.manifestPartitioned(ctx, derived, stats.allotments)
+	return derived, derivedDigest, nil
+}
+
+// manifestPartitioned dispatches the partition event of the manifest derived
+// from imh.Digest, holding the given number of allotments, if the listener
+// of the request listens to partitions.
+func (imh *manifestHandler) manifestPartitioned(ctx context.Context, derived distribution.Manifest, allotments int) {
+	listener, ok := imh.events.(notifications.PartitionListener)
+	if !ok {
+		return
+	}
+
+	normalized := tdfs.NormalizePartitions(imh.clamped)
+	partition := notifications.PartitionRecord{
+		Source:     imh.Digest,
+		Partitions: make([]string, len(normalized)),
+		Flattened:  imh.Flatten,
+		Allotments: allotments,
+	}
+	for i, p := range normalized {
+		partition.Partitions[i] = p.String()
+	}
+
+	var options []distribution.ManifestServiceOption
+	if imh.Tag != "" {
+		options = append(options, distribution.WithTag(imh.Tag))
+	}
+	if err := listener.ManifestPartitioned(imh.Repository.Named(), derived, partition, options...); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error dispatching manifest partition to listener: %v", err)
+	}
+}
+
+// partitionStats describes the allotments referenced by a derived manifest.
+type partitionStats struct {
+	// allotments is the number of allotments selected in the fields.
+	allotments int
+
+	// size is the size of the layers holding the allotments, flattened or
+	// not.
+	size int64
+}
+
+// add adds the allotments of other to the stats.
+func (stats *partitionStats) add(other partitionStats) {
+	stats.allotments += other.allotments
+	stats.size += other.size
+}
+
+// newPartitionStats returns the stats of the manifest derived from the 2dfs
+// image manifest, holding the given number of allotments.
+func newPartitionStats(manifest *ocischema.DeserializedManifest, derived distribution.Manifest, allotments int) partitionStats {
+	stats := partitionStats{allotments: allotments}
+
+	// the layers which are not regular layers of the source hold allotments
+	regular := map[digest.Digest]bool{}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != tdfs.MediaTypeTdfsLayer {
+			regular[layer.Digest] = true
+		}
+	}
+	if m, ok := derived.(*ocischema.DeserializedManifest); ok {
+		for _, layer := range m.Layers {
+			if !regular[layer.Digest] {
+				stats.size += layer.Size
+			}
+		}
+	}
+	return stats
+}
+
+// partitionImageIndex derives the image index referencing the partitioned
+// manifest of every 2dfs image in index, returning it with the stats of all
+// the images. The image manifests are partitioned in parallel and uploaded
+// to the store, the derived index is left to the caller.
+func (imh *manifestHandler) partitionImageIndex(ctx context.Context, manifests distribution.ManifestService, blobs distribution.BlobStore, index *ocischema.DeserializedImageIndex, provenance tdfs.Provenance) (distribution.Manifest, partitionStats, error) {
+	descriptors := make([]distribution.Descriptor, len(index.Manifests))
+	var stats partitionStats
+	var statsMu sync.Mutex
+	// the manifests partitioned in parallel share a single limit of blobs
+	// looked up in parallel
+	ctx = tdfs.WithConcurrencyLimit(ctx)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(tdfs.ConcurrencyLimit)
+	for i, descriptor := range index.Manifests {
+		descriptors[i] = descriptor
+
+		g.Go(func() error {
+			submanifest, err := manifests.Get(gctx, descriptor.Digest)
+			if err != nil {
+				return err
+			}
+
+			ociSubManifest, isOci := submanifest.(*ocischema.DeserializedManifest)
+			if !isOci || !tdfs.HasField(ociSubManifest) {
+				return nil
+			}
+
+			// the derived manifests trace back to the source image manifests
+			partitioned, allotments, err := imh.convert(gctx, blobs, ociSubManifest, tdfs.Provenance{
+				Source: descriptor,
+				Tag:    provenance.Tag,
+			})
+			if err != nil {
+				return err
+			}
+			statsMu.Lock()
+			stats.add(newPartitionStats(ociSubManifest, partitioned, allotments))
+			statsMu.Unlock()
+			mediaType, payload, err := partitioned.Payload()
+			if err != nil {
+				return err
+			}
+
+			// upload new manifest
+			dgst, err := imh.putDerived(gctx, manifests, partitioned)
+			if err != nil {
+				return err
+			}
+
+			descriptors[i].MediaType = mediaType
+			descriptors[i].Digest = dgst
+			descriptors[i].Size = int64(len(payload))
+			dcontext.GetLogger(gctx).Debugf("saved partitioned manifest %s", dgst)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, partitionStats{}, err
+	}
+
+	// generate new index with partition
+	derived, err := tdfs.ConvertPartitionedIndexToOciIndex(index, descriptors, imh.clamped, provenance)
+	if err != nil {
+		return nil, partitionStats{}, err
+	}
+	return derived, stats, nil
+}
+
+// partitionImageManifest derives the image manifest holding the requested
+// partitions of a 2dfs image manifest, returning it with its stats.
+func (imh *manifestHandler) partitionImageManifest(ctx context.Context, blobs distribution.BlobStore, manifest *ocischema.DeserializedManifest, provenance tdfs.Provenance) (distribution.Manifest, partitionStats, error) {
+	if !tdfs.HasField(manifest) {
+		return manifest, partitionStats{}, nil
+	}
+	derived, allotments, err := imh.convert(ctx, blobs, manifest, provenance)
+	if err != nil {
+		return nil, partitionStats{}, err
+	}
+	return derived, newPartitionStats(manifest, derived, allotments), nil
+}
+
+// putDerived stores a derived manifest and returns its digest. Registries
+// which cannot persist derived manifests cache them instead.
+func (imh *manifestHandler) putDerived(ctx context.Context, manifests distribution.ManifestService, manifest distribution.Manifest) (digest.Digest, error) {
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		return "", err
+	}
+	ctx, span := tracer.Start(
+		ctx,
+		"PutDerived",
+		trace.WithAttributes(
+			attribute.String(tracing.AttributePrefix+"tdfs.derived.digest", digest.FromBytes(payload).String()),
+			attribute.Bool(tracing.AttributePrefix+"tdfs.derived.cached", imh.App.derivedContent != nil),
+		))
+	defer span.End()
+
+	if imh.App.derivedContent == nil {
+		return manifests.Put(ctx, manifest)
+	}
+	desc, err := imh.App.derivedContent.Put(ctx, imh.Repository.Named().Name(), mediaType, payload)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest, nil
+}
+
+// derivedManifest returns the derived manifest cached at imh.Digest, or nil
+// if the registry persists derived manifests or the manifest is not cached.
+// The manifests, and the configs, a cached manifest references are evicted
+// from the cache on their own: if any of them is gone, the manifest is
+// derived again from its source.
+func (imh *manifestHandler) derivedManifest(manifests distribution.ManifestService, blobs distribution.BlobStore) distribution.Manifest {
+	if imh.App.derivedContent == nil {
+		return nil
+	}
+
+	manifest := imh.cachedManifest(imh.Digest)
+	if manifest == nil {
+		return nil
+	}
+	if !imh.derivedComplete(manifests, blobs, manifest) {
+		dcontext.GetLogger(imh).Debugf("content referenced by derived manifest %s is not cached, deriving it again", imh.Digest)
+		return imh.rederive(manifests, blobs, manifest)
+	}
+	partitionMetrics.DerivedContentHit()
+	return manifest
+}
+
+// cachedManifest returns the manifest cached at dgst in the derived content
+// cache, or nil if it is not cached.
+func (imh *manifestHandler) cachedManifest(dgst digest.Digest) distribution.Manifest {
+	desc, content, err := imh.App.derivedContent.Get(imh, imh.Repository.Named().Name(), dgst)
+	if err != nil {
+		if err != distribution.ErrBlobUnknown {
+			dcontext.GetLogger(imh).Warnf("error looking up derived manifest %s: %v", dgst, err)
+		}
+		return nil
+	}
+	manifest, _, err := distribution.UnmarshalManifest(desc.MediaType, content)
+	if err != nil {
+		dcontext.GetLogger(imh).Warnf("error unmarshaling derived manifest %s: %v", dgst, err)
+		return nil
+	}
+	return manifest
+}
+
+// derivedComplete returns whether the manifests and configs referenced by
+// the derived manifest are cached or stored.
+func (imh *manifestHandler) derivedComplete(manifests distribution.ManifestService, blobs distribution.BlobStore, manifest distribution.Manifest) bool {
+	ctx := notifications.WithInternal(imh)
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedImageIndex:
+		for _, descriptor := range m.Manifests {
+			if submanifest := imh.cachedManifest(descriptor.Digest); submanifest != nil {
+				if !imh.derivedComplete(manifests, blobs, submanifest) {
+					return false
+				}
+				continue
+			}
+			if exists, _ := manifests.Exists(ctx, descriptor.Digest); !exists {
+				return false
+			}
+		}
+	case *ocischema.DeserializedManifest:
+		if _, _, err := imh.App.derivedContent.Get(ctx, imh.Repository.Named().Name(), m.Config.Digest); err == nil {
+			return true
+		}
+		if _, err := blobs.Stat(ctx, m.Config.Digest); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// rederive derives the cached manifest stored at imh.Digest again from the
+// source and partitions it records, caching the content it references once
+// more. It returns nil if the manifest cannot be derived again.
+func (imh *manifestHandler) rederive(manifests distribution.ManifestService, blobs distribution.BlobStore, manifest distribution.Manifest) distribution.Manifest {
+	var annotations map[string]string
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedImageIndex:
+		annotations = m.Annotations
+	case *ocischema.DeserializedManifest:
+		annotations = m.Annotations
+	}
+	source, err := digest.Parse(annotations[tdfs.AnnotationSourceDigest])
+	if err != nil {
+		return nil
+	}
+	partitions, err := tdfs.ParsePartitions(annotations[tdfs.AnnotationPartitions])
+	if err != nil {
+		return nil
+	}
+	sourceManifest, err := manifests.Get(notifications.WithInternal(imh), source)
+	if err != nil {
+		dcontext.GetLogger(imh).Warnf("error reading source %s of derived manifest %s: %v", source, imh.Digest, err)
+		return nil
+	}
+
+	dgst, tag := imh.Digest, imh.Tag
+	defer func() {
+		imh.Digest, imh.Tag, imh.Partitions = dgst, tag, nil
+	}()
+	imh.Digest, imh.Tag, imh.Partitions = source, annotations[tdfs.AnnotationSourceTag], partitions
+	derived, derivedDigest, err := imh.partition(manifests, blobs, sourceManifest)
+	if err != nil {
+		dcontext.GetLogger(imh).Warnf("error deriving manifest %s again: %v", dgst, err)
+		return nil
+	}
+	if derivedDigest != dgst {
+		dcontext.GetLogger(imh).Warnf("deriving manifest %s again gave %s", dgst, derivedDigest)
+		return nil
+	}
+	return derived
+}
+
+// derivedBlobStore keeps the blobs put while deriving manifests, such as
+// the configs of partitioned manifests, in the derived content cache instead
+// of the storage backend.
+type derivedBlobStore struct {
+	distribution.BlobStore
+
+	cache cache.DerivedContentCache
+	repo  string
+}
+
+func (dbs *derivedBlobStore) Put(ctx context.Context, mediaType string, p []byte) (v1.Descriptor, error) {
+	return dbs.cache.Put(ctx, dbs.repo, mediaType, p)
+}
+
+func (dbs *derivedBlobStore) SetDescriptor(ctx context.Context, dgst digest.Digest, desc v1.Descriptor) error {
+	setter, ok := dbs.BlobStore.(distribution.BlobDescriptorSetter)
+	if !ok {
+		return distribution.ErrUnsupported
+	}
+	return setter.SetDescriptor(ctx, dgst, desc)
+}
@@ -0,0 +1,1343 @@
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	tdfsfilesystem "github.com/2DFS/2dfs-builder/filesystem"
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/configuration"
+	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/2DFS/2dfs-registry/v3/manifest/tdfs"
+	"github.com/2DFS/2dfs-registry/v3/notifications"
+	"github.com/2DFS/2dfs-registry/v3/registry/api/errcode"
+	"github.com/2DFS/2dfs-registry/v3/registry/auth"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/cache"
+	"github.com/distribution/reference"
+	events "github.com/docker/go-events"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	promclient "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// tdfsImage describes a 2dfs image pushed by pushTdfsImage.
+type tdfsImage struct {
+	name           reference.Named
+	indexDigest    digest.Digest
+	manifestDigest digest.Digest
+	manifest       *ocischema.DeserializedManifest
+	field          tdfsfilesystem.Field
+	// allotments holds the allotment blob digests by row and column.
+	allotments [][]digest.Digest
+}
+
+// pushBlob uploads content to the repository and returns its descriptor.
+func pushBlob(t *testing.T, env *testEnv, name reference.Named, mediaType string, content []byte) v1.Descriptor {
+	dgst := digest.FromBytes(content)
+	uploadURLBase, _ := startPushLayer(t, env, name)
+	pushLayer(t, env.builder, name, dgst, uploadURLBase, bytes.NewReader(content))
+	return v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(content)),
+	}
+}
+
+// gzipTar returns a gzip compressed tar archive holding a single file.
+func gzipTar(t *testing.T, name string, content []byte) []byte {
+	var archive bytes.Buffer
+	gw := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gw)
+	checkErr(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(content))}), "writing tar header")
+	_, err := tw.Write(content)
+	checkErr(t, err, "writing tar content")
+	checkErr(t, tw.Close(), "closing tar")
+	checkErr(t, gw.Close(), "closing gzip")
+	return archive.Bytes()
+}
+
+// pushTdfsManifest pushes an image manifest carrying a regular layer and a
+// rows x cols 2dfs field. The manifest is tagged if tag is not empty.
+func pushTdfsManifest(t *testing.T, env *testEnv, imageName, tag string, rows, cols int) tdfsImage {
+	name, err := reference.WithName(imageName)
+	checkErr(t, err, "parsing image name")
+
+	image := tdfsImage{
+		name:       name,
+		field:      tdfsfilesystem.GetField(),
+		allotments: make([][]digest.Digest, rows),
+	}
+
+	base := pushBlob(t, env, name, v1.MediaTypeImageLayerGzip, []byte(fmt.Sprintf("%s base layer", tag)))
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			content := []byte(fmt.Sprintf("%s allotment %d.%d", tag, row, col))
+			allotment := pushBlob(t, env, name, v1.MediaTypeImageLayerGzip, gzipTar(t, fmt.Sprintf("allotments/%d.%d", row, col), content))
+			image.allotments[row] = append(image.allotments[row], allotment.Digest)
+			image.field.AddAllotment(tdfsfilesystem.Allotment{
+				Row:    row,
+				Col:    col,
+				Digest: allotment.Digest.Encoded(),
+				DiffID: digest.FromString(string(content) + " diff").Encoded(),
+			})
+		}
+	}
+	field := pushBlob(t, env, name, tdfs.MediaTypeTdfsLayer, []byte(image.field.Marshal()))
+
+	config, err := json.Marshal(v1.Image{
+		Platform: v1.Platform{Architecture: "amd64", OS: "linux"},
+		RootFS: v1.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromString(tag + " base diff")},
+		},
+	})
+	checkErr(t, err, "marshaling config")
+	configDesc := pushBlob(t, env, name, v1.MediaTypeImageConfig, config)
+
+	image.manifest, err = ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []v1.Descriptor{base, field},
+	})
+	checkErr(t, err, "building manifest")
+	_, payload, err := image.manifest.Payload()
+	checkErr(t, err, "getting manifest payload")
+	image.manifestDigest = digest.FromBytes(payload)
+
+	var ref reference.Named
+	if tag != "" {
+		ref, _ = reference.WithTag(name, tag)
+	} else {
+		ref, _ = reference.WithDigest(name, image.manifestDigest)
+	}
+	manifestURL, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building manifest url")
+	resp := putManifest(t, "putting 2dfs manifest", manifestURL, v1.MediaTypeImageManifest, image.manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting 2dfs manifest", resp, http.StatusCreated)
+
+	return image
+}
+
+// pushTdfsImage pushes a single platform image index whose image carries a
+// regular layer and a rows x cols 2dfs field, and tags it.
+func pushTdfsImage(t *testing.T, env *testEnv, imageName, tag string, rows, cols int) tdfsImage {
+	image := pushTdfsManifest(t, env, imageName, "", rows, cols)
+	_, payload, err := image.manifest.Payload()
+	checkErr(t, err, "getting manifest payload")
+
+	index, err := ocischema.FromDescriptors([]v1.Descriptor{
+		{
+			MediaType: v1.MediaTypeImageManifest,
+			Digest:    image.manifestDigest,
+			Size:      int64(len(payload)),
+			Platform:  &v1.Platform{Architecture: "amd64", OS: "linux"},
+		},
+	}, nil)
+	checkErr(t, err, "building index")
+	_, payload, err = index.Payload()
+	checkErr(t, err, "getting index payload")
+	image.indexDigest = digest.FromBytes(payload)
+
+	tagRef, _ := reference.WithTag(image.name, tag)
+	indexURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building index url")
+	resp := putManifest(t, "putting 2dfs index", indexURL, v1.MediaTypeImageIndex, index)
+	defer resp.Body.Close()
+	checkResponse(t, "putting 2dfs index", resp, http.StatusCreated)
+
+	return image
+}
+
+// getTdfsManifest fetches the manifest for reference in the repository of
+// image, accepting both image indexes and image manifests.
+func getTdfsManifest(t *testing.T, env *testEnv, image tdfsImage, ref string) *http.Response {
+	return getTdfsManifestWith(t, env, image, ref, nil, nil)
+}
+
+// getTdfsManifestWith fetches the manifest for reference like
+// getTdfsManifest, adding the query parameters and headers to the request.
+func getTdfsManifestWith(t *testing.T, env *testEnv, image tdfsImage, ref string, query url.Values, header http.Header) *http.Response {
+	var named reference.Named
+	if dgst, err := digest.Parse(ref); err == nil {
+		named, _ = reference.WithDigest(image.name, dgst)
+	} else {
+		named, err = reference.WithTag(image.name, ref)
+		checkErr(t, err, "building tag reference")
+	}
+	manifestURL, err := env.builder.BuildManifestURL(named)
+	checkErr(t, err, "building manifest url")
+	if len(query) > 0 {
+		manifestURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	checkErr(t, err, "building request")
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Add("Accept", v1.MediaTypeImageIndex)
+	req.Header.Add("Accept", v1.MediaTypeImageManifest)
+
+	resp, err := http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching manifest")
+	return resp
+}
+
+// getPartitionedIndex fetches the derived index served for ref, checking
+// that its digest matches the Docker-Content-Digest header.
+func getPartitionedIndex(t *testing.T, env *testEnv, image tdfsImage, ref string) (*ocischema.DeserializedImageIndex, digest.Digest) {
+	resp := getTdfsManifest(t, env, image, ref)
+	defer resp.Body.Close()
+	checkResponse(t, "fetching partitioned index", resp, http.StatusOK)
+
+	body, err := io.ReadAll(resp.Body)
+	checkErr(t, err, "reading body")
+	dgst := digest.FromBytes(body)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	var index ocischema.DeserializedImageIndex
+	checkErr(t, index.UnmarshalJSON(body), "unmarshaling index")
+	return &index, dgst
+}
+
+func TestPartitionedIndexIsRecorded(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 2)
+
+	index, dgst := getPartitionedIndex(t, env, image, "v1--0.0.0.1")
+	if dgst == image.indexDigest {
+		t.Fatal("expected a derived index, got the source index")
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Platform == nil || index.Manifests[0].Platform.Architecture != "amd64" {
+		t.Fatalf("unexpected derived index manifests: %+v", index.Manifests)
+	}
+
+	partitionIndex := env.app.registry.(distribution.PartitionIndexProvider).PartitionIndex(image.name)
+	recorded, err := partitionIndex.Get(env.ctx, image.indexDigest, "v1@0.0.0.1")
+	checkErr(t, err, "looking up recorded partition")
+	if recorded != dgst {
+		t.Fatalf("unexpected recorded partition: %s != %s", recorded, dgst)
+	}
+
+	// equivalent semantic tags resolve to the recorded index
+	_, again := getPartitionedIndex(t, env, image, "v1--0.0.0.1--0.0.0.1")
+	if again != dgst {
+		t.Fatalf("unexpected digest for repeated partition request: %s != %s", again, dgst)
+	}
+
+	// moving the tag invalidates the derived manifests of the previous index
+	pushTdfsImage(t, env, "foo/tdfs", "v1", 1, 1)
+	if _, err := partitionIndex.Get(env.ctx, image.indexDigest, "v1@0.0.0.1"); err != distribution.ErrPartitionUnknown {
+		t.Fatalf("expected recorded partition to be invalidated, got %v", err)
+	}
+}
+
+func TestPartitionedImageManifest(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsManifest(t, env, "foo/tdfs", "single", 2, 2)
+
+	resp := getTdfsManifest(t, env, image, "single--1.0.1.1")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching partitioned manifest", resp, http.StatusOK)
+
+	body, err := io.ReadAll(resp.Body)
+	checkErr(t, err, "reading body")
+	dgst := digest.FromBytes(body)
+	checkHeaders(t, resp, http.Header{
+		"Content-Type":          []string{v1.MediaTypeImageManifest},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+	if dgst == image.manifestDigest {
+		t.Fatal("expected a derived manifest, got the source manifest")
+	}
+
+	var manifest ocischema.DeserializedManifest
+	checkErr(t, manifest.UnmarshalJSON(body), "unmarshaling manifest")
+	expected := []digest.Digest{
+		image.manifest.Layers[0].Digest,
+		image.allotments[1][0],
+		image.allotments[1][1],
+	}
+	if len(manifest.Layers) != len(expected) {
+		t.Fatalf("unexpected layers in derived manifest: %+v", manifest.Layers)
+	}
+	for i, layer := range manifest.Layers {
+		if layer.Digest != expected[i] {
+			t.Fatalf("unexpected layer %d in derived manifest: %s != %s", i, layer.Digest, expected[i])
+		}
+	}
+
+	// the derived manifest is served by digest as well
+	resp = getTdfsManifest(t, env, image, dgst.String())
+	defer resp.Body.Close()
+	checkResponse(t, "fetching derived manifest by digest", resp, http.StatusOK)
+}
+
+func TestPartitionWithoutField(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	name, err := reference.WithName("foo/plain")
+	checkErr(t, err, "parsing image name")
+	base := pushBlob(t, env, name, v1.MediaTypeImageLayerGzip, []byte("plain base layer"))
+	config, err := json.Marshal(v1.Image{
+		Platform: v1.Platform{Architecture: "amd64", OS: "linux"},
+		RootFS:   v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString("plain base diff")}},
+	})
+	checkErr(t, err, "marshaling config")
+	manifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    pushBlob(t, env, name, v1.MediaTypeImageConfig, config),
+		Layers:    []v1.Descriptor{base},
+	})
+	checkErr(t, err, "building manifest")
+	_, payload, err := manifest.Payload()
+	checkErr(t, err, "getting manifest payload")
+	manifestRef, _ := reference.WithDigest(name, digest.FromBytes(payload))
+	manifestURL, err := env.builder.BuildManifestURL(manifestRef)
+	checkErr(t, err, "building manifest url")
+	resp := putManifest(t, "putting plain manifest", manifestURL, v1.MediaTypeImageManifest, manifest)
+	resp.Body.Close()
+	checkResponse(t, "putting plain manifest", resp, http.StatusCreated)
+
+	index, err := ocischema.FromDescriptors([]v1.Descriptor{{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    manifestRef.Digest(),
+		Size:      int64(len(payload)),
+		Platform:  &v1.Platform{Architecture: "amd64", OS: "linux"},
+	}}, nil)
+	checkErr(t, err, "building index")
+	_, payload, err = index.Payload()
+	checkErr(t, err, "getting index payload")
+	image := tdfsImage{name: name, indexDigest: digest.FromBytes(payload)}
+	tagRef, _ := reference.WithTag(name, "v1")
+	indexURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building index url")
+	resp = putManifest(t, "putting plain index", indexURL, v1.MediaTypeImageIndex, index)
+	resp.Body.Close()
+	checkResponse(t, "putting plain index", resp, http.StatusCreated)
+
+	// the index has nothing to partition, it is served as is and no derived
+	// index is stored
+	for _, ref := range []string{"v1--r0", image.indexDigest.String()} {
+		resp := getTdfsManifestWith(t, env, image, ref, url.Values{tdfs.PartitionQueryParam: []string{"r0"}}, nil)
+		defer resp.Body.Close()
+		checkResponse(t, "fetching partitions of a plain index", resp, http.StatusOK)
+		checkHeaders(t, resp, http.Header{
+			"Docker-Content-Digest": []string{image.indexDigest.String()},
+		})
+	}
+	partitionIndex := env.app.registry.(distribution.PartitionIndexProvider).PartitionIndex(name)
+	for _, key := range []string{"v1@", "v1@0.0.0.*"} {
+		if _, err := partitionIndex.Get(env.ctx, image.indexDigest, key); err != distribution.ErrPartitionUnknown {
+			t.Fatalf("expected no derived index to be recorded for %q: %v", key, err)
+		}
+	}
+	repo, err := env.app.registry.Repository(env.ctx, name)
+	checkErr(t, err, "getting repository")
+	manifestService, err := repo.Manifests(env.ctx)
+	checkErr(t, err, "getting manifest service")
+	count := 0
+	checkErr(t, manifestService.(distribution.ManifestEnumerator).Enumerate(env.ctx, func(digest.Digest) error {
+		count++
+		return nil
+	}), "enumerating manifests")
+	if count != 2 {
+		t.Fatalf("expected only the plain index and manifest to be stored, got %d manifests", count)
+	}
+}
+
+func TestPartitionInvalid(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 2)
+
+	for _, ref := range []string{
+		"v1--1.0.0.0",
+		"v1--0.0.1",
+		"v1--0.0.1.1--x",
+		"v1--0.0.2.0",
+		"v1--0.0.0.2",
+	} {
+		resp := getTdfsManifest(t, env, image, ref)
+		checkResponse(t, "fetching invalid partition "+ref, resp, http.StatusBadRequest)
+		errs, _, _ := checkBodyHasErrorCodes(t, "fetching invalid partition "+ref, resp, errcode.ErrorCodePartitionInvalid)
+		resp.Body.Close()
+		if len(errs) != 1 || errs[0].(errcode.Error).Detail == nil {
+			t.Fatalf("expected the error of %s to detail the partition: %v", ref, errs)
+		}
+	}
+
+	// tags containing the partition separator are still served as is, even
+	// if they would parse as a semantic tag of an existing tag
+	for _, tag := range []string{"release--candidate", "v1--r1"} {
+		plain := pushTdfsImage(t, env, "foo/tdfs", tag, 1, 1)
+		resp := getTdfsManifest(t, env, plain, tag)
+		checkResponse(t, "fetching plain tag "+tag, resp, http.StatusOK)
+		if dgst := resp.Header.Get("Docker-Content-Digest"); dgst != plain.indexDigest.String() {
+			t.Fatalf("expected plain tag %s to be served as pushed, got %s", tag, dgst)
+		}
+		resp.Body.Close()
+	}
+
+	// unknown tags are unknown manifests, whether their partitions parse
+	for _, ref := range []string{"missing--r0", "missing--candidate", "v2--0.0.1"} {
+		resp := getTdfsManifest(t, env, image, ref)
+		checkResponse(t, "fetching unknown tag "+ref, resp, http.StatusNotFound)
+		checkBodyHasErrorCodes(t, "fetching unknown tag "+ref, resp, errcode.ErrorCodeManifestUnknown)
+		resp.Body.Close()
+	}
+}
+
+func TestPartitionQueryAndHeader(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 3, 3)
+	_, expected := getPartitionedIndex(t, env, image, "v1--0.0.1.1--r2")
+
+	for _, testcase := range []struct {
+		ref    string
+		query  url.Values
+		header http.Header
+	}{
+		{ref: "v1", query: url.Values{"partition": []string{"0.0.1.1--r2"}}},
+		{ref: "v1", query: url.Values{"partition": []string{"0.0.1.1", "r2"}}},
+		{ref: "v1", header: http.Header{tdfs.PartitionHeader: []string{"0.0.1.1, r2"}}},
+		{ref: "v1--0.0.1.1", header: http.Header{tdfs.PartitionHeader: []string{"r2"}}},
+	} {
+		resp := getTdfsManifestWith(t, env, image, testcase.ref, testcase.query, testcase.header)
+		checkResponse(t, "fetching partitioned index", resp, http.StatusOK)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		checkErr(t, err, "reading body")
+		if dgst := digest.FromBytes(body); dgst != expected {
+			t.Fatalf("unexpected digest for %s %v %v: %s != %s", testcase.ref, testcase.query, testcase.header, dgst, expected)
+		}
+	}
+
+	// digest references are partitioned as well, their derived index only
+	// lacks the source tag
+	var byDigest []digest.Digest
+	for _, header := range []http.Header{{tdfs.PartitionHeader: []string{"0.0.1.1--r2"}}, {tdfs.PartitionHeader: []string{"r2,0.0.1.1"}}} {
+		resp := getTdfsManifestWith(t, env, image, image.indexDigest.String(), nil, header)
+		checkResponse(t, "fetching partitioned index by digest", resp, http.StatusOK)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		checkErr(t, err, "reading body")
+		byDigest = append(byDigest, digest.FromBytes(body))
+	}
+	if byDigest[0] != byDigest[1] || byDigest[0] == image.indexDigest || byDigest[0] == expected {
+		t.Fatalf("unexpected digests for the digest reference: %v", byDigest)
+	}
+
+	// the derived manifest digest is the etag of the partitioned response
+	resp := getTdfsManifestWith(t, env, image, "v1", url.Values{"partition": []string{"r2--0.0.1.1"}}, http.Header{"If-None-Match": []string{fmt.Sprintf(`"%s"`, expected)}})
+	resp.Body.Close()
+	checkResponse(t, "fetching partitioned index with etag", resp, http.StatusNotModified)
+	resp = getTdfsManifestWith(t, env, image, "v1", url.Values{"partition": []string{"r2"}}, http.Header{"If-None-Match": []string{fmt.Sprintf(`"%s"`, image.indexDigest)}})
+	resp.Body.Close()
+	checkResponse(t, "fetching partitioned index with source etag", resp, http.StatusOK)
+
+	resp = getTdfsManifestWith(t, env, image, image.manifestDigest.String(), url.Values{"partition": []string{"0.0.x.1"}}, nil)
+	defer resp.Body.Close()
+	checkResponse(t, "fetching invalid partition", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "fetching invalid partition", resp, errcode.ErrorCodePartitionInvalid)
+}
+
+func TestPartitionProvenance(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 2)
+
+	index, _ := getPartitionedIndex(t, env, image, "v1--r1--0.0.0.0")
+	if index.Subject == nil || index.Subject.Digest != image.indexDigest || index.Subject.MediaType != v1.MediaTypeImageIndex {
+		t.Fatalf("unexpected subject of the derived index: %+v", index.Subject)
+	}
+	expected := map[string]string{
+		tdfs.AnnotationSourceDigest: image.indexDigest.String(),
+		tdfs.AnnotationSourceTag:    "v1",
+		tdfs.AnnotationPartitions:   "0.0.0.0--1.0.1.1",
+	}
+	for k, v := range expected {
+		if index.Annotations[k] != v {
+			t.Fatalf("unexpected annotation %s of the derived index: %q != %q", k, index.Annotations[k], v)
+		}
+	}
+
+	resp := getTdfsManifest(t, env, image, index.Manifests[0].Digest.String())
+	defer resp.Body.Close()
+	checkResponse(t, "fetching derived manifest", resp, http.StatusOK)
+	body, err := io.ReadAll(resp.Body)
+	checkErr(t, err, "reading body")
+	var manifest ocischema.DeserializedManifest
+	checkErr(t, manifest.UnmarshalJSON(body), "unmarshaling manifest")
+
+	if manifest.Subject == nil || manifest.Subject.Digest != image.manifestDigest || manifest.Subject.MediaType != v1.MediaTypeImageManifest {
+		t.Fatalf("unexpected subject of the derived manifest: %+v", manifest.Subject)
+	}
+	expected[tdfs.AnnotationSourceDigest] = image.manifestDigest.String()
+	for k, v := range expected {
+		if manifest.Annotations[k] != v {
+			t.Fatalf("unexpected annotation %s of the derived manifest: %q != %q", k, manifest.Annotations[k], v)
+		}
+	}
+
+	// digest references carry no source tag
+	resp = getTdfsManifestWith(t, env, image, image.indexDigest.String(), url.Values{"partition": []string{"r1"}}, nil)
+	defer resp.Body.Close()
+	checkResponse(t, "fetching partitioned index by digest", resp, http.StatusOK)
+	body, err = io.ReadAll(resp.Body)
+	checkErr(t, err, "reading body")
+	checkErr(t, index.UnmarshalJSON(body), "unmarshaling index")
+	if _, ok := index.Annotations[tdfs.AnnotationSourceTag]; ok {
+		t.Fatalf("unexpected source tag annotation for a digest reference: %v", index.Annotations)
+	}
+}
+
+func TestPartitionFlatten(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 2)
+	flatten := url.Values{tdfs.FlattenQueryParam: []string{"true"}}
+
+	resp := getTdfsManifestWith(t, env, image, "v1--r0", flatten, nil)
+	checkResponse(t, "fetching flattened index", resp, http.StatusOK)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	checkErr(t, err, "reading body")
+	var index ocischema.DeserializedImageIndex
+	checkErr(t, index.UnmarshalJSON(body), "unmarshaling index")
+
+	_, unflattened := getPartitionedIndex(t, env, image, "v1--r0")
+	if digest.FromBytes(body) == unflattened {
+		t.Fatal("expected the flattened index to differ from the partitioned one")
+	}
+
+	resp = getTdfsManifest(t, env, image, index.Manifests[0].Digest.String())
+	defer resp.Body.Close()
+	checkResponse(t, "fetching flattened manifest", resp, http.StatusOK)
+	var manifest ocischema.DeserializedManifest
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&manifest), "decoding flattened manifest")
+	if len(manifest.Layers) != 2 || manifest.Layers[0].Digest != image.manifest.Layers[0].Digest || manifest.Layers[1].MediaType != v1.MediaTypeImageLayerGzip {
+		t.Fatalf("unexpected layers of the flattened manifest: %+v", manifest.Layers)
+	}
+
+	// the flattened layer holds the files of the selected allotments
+	layerRef, _ := reference.WithDigest(image.name, manifest.Layers[1].Digest)
+	layerURL, err := env.builder.BuildBlobURL(layerRef)
+	checkErr(t, err, "building layer url")
+	resp, err = http.Get(layerURL)
+	checkErr(t, err, "fetching flattened layer")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching flattened layer", resp, http.StatusOK)
+	gr, err := gzip.NewReader(resp.Body)
+	checkErr(t, err, "decompressing flattened layer")
+	var names []string
+	archive := tar.NewReader(gr)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		checkErr(t, err, "reading flattened layer")
+		names = append(names, header.Name)
+	}
+	if len(names) != 2 || names[0] != "allotments/0.0" || names[1] != "allotments/0.1" {
+		t.Fatalf("unexpected entries of the flattened layer: %v", names)
+	}
+
+	// the flattened layer is recorded and reused by other partition sets
+	// selecting the same allotments
+	flattenIndex := env.app.registry.(distribution.FlattenIndexProvider).FlattenIndex(image.name)
+	allotments := []distribution.Descriptor{
+		{Digest: image.allotments[0][0]},
+		{Digest: image.allotments[0][1]},
+	}
+	recorded, _, err := flattenIndex.Get(env.ctx, tdfs.FlattenKey(allotments))
+	checkErr(t, err, "looking up flattened layer")
+	if recorded != manifest.Layers[1].Digest {
+		t.Fatalf("unexpected recorded flattened layer: %s != %s", recorded, manifest.Layers[1].Digest)
+	}
+	resp = getTdfsManifestWith(t, env, image, image.manifestDigest.String(), url.Values{
+		tdfs.FlattenQueryParam:   []string{"1"},
+		tdfs.PartitionQueryParam: []string{"0.0.0.1"},
+	}, nil)
+	defer resp.Body.Close()
+	checkResponse(t, "fetching flattened manifest by digest", resp, http.StatusOK)
+	var again ocischema.DeserializedManifest
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&again), "decoding flattened manifest")
+	if len(again.Layers) != 2 || again.Layers[1].Digest != manifest.Layers[1].Digest {
+		t.Fatalf("unexpected layers of the flattened manifest: %+v", again.Layers)
+	}
+
+	resp = getTdfsManifestWith(t, env, image, "v1--r0", url.Values{tdfs.FlattenQueryParam: []string{"maybe"}}, nil)
+	defer resp.Body.Close()
+	checkResponse(t, "fetching with an invalid flatten value", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "fetching with an invalid flatten value", resp, errcode.ErrorCodePartitionInvalid)
+}
+
+func TestPartitionReadOnly(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 2)
+
+	// switch the registry to the read-only maintenance mode once populated
+	env.app.readOnly = true
+	env.app.configureDerivedContentCache(&env.config)
+	hits := partitionMetric(t, "cache_hits_total", map[string]string{"cache": "derivedcontent"}).GetCounter().GetValue()
+
+	index, dgst := getPartitionedIndex(t, env, image, "v1--0.0.0.1")
+	if dgst == image.indexDigest {
+		t.Fatal("expected a derived index, got the source index")
+	}
+
+	// nothing is persisted
+	partitionIndex := env.app.registry.(distribution.PartitionIndexProvider).PartitionIndex(image.name)
+	if _, err := partitionIndex.Get(env.ctx, image.indexDigest, "v1@0.0.0.1"); err != distribution.ErrPartitionUnknown {
+		t.Fatalf("expected the partitions not to be recorded, got %v", err)
+	}
+	repository, err := env.app.registry.Repository(env.ctx, image.name)
+	checkErr(t, err, "getting repository")
+	manifests, err := repository.Manifests(env.ctx)
+	checkErr(t, err, "getting manifest service")
+	for _, derived := range []digest.Digest{dgst, index.Manifests[0].Digest} {
+		if exists, _ := manifests.Exists(env.ctx, derived); exists {
+			t.Fatalf("expected derived manifest %s not to be stored", derived)
+		}
+	}
+
+	// the derived manifests and config are served from the cache
+	_, again := getPartitionedIndex(t, env, image, dgst.String())
+	if again != dgst {
+		t.Fatalf("unexpected digest of the cached index: %s != %s", again, dgst)
+	}
+	resp := getTdfsManifest(t, env, image, index.Manifests[0].Digest.String())
+	defer resp.Body.Close()
+	checkResponse(t, "fetching cached manifest", resp, http.StatusOK)
+	var manifest ocischema.DeserializedManifest
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&manifest), "decoding cached manifest")
+	if len(manifest.Layers) != 3 || manifest.Layers[1].Digest != image.allotments[0][0] || manifest.Layers[2].Digest != image.allotments[0][1] {
+		t.Fatalf("unexpected layers of the cached manifest: %+v", manifest.Layers)
+	}
+
+	if _, err := repository.Blobs(env.ctx).Stat(env.ctx, manifest.Config.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the derived config not to be stored, got %v", err)
+	}
+	configRef, _ := reference.WithDigest(image.name, manifest.Config.Digest)
+	configURL, err := env.builder.BuildBlobURL(configRef)
+	checkErr(t, err, "building config url")
+	resp, err = http.Get(configURL)
+	checkErr(t, err, "fetching cached config")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching cached config", resp, http.StatusOK)
+	config, err := io.ReadAll(resp.Body)
+	checkErr(t, err, "reading cached config")
+	if digest.FromBytes(config) != manifest.Config.Digest {
+		t.Fatalf("unexpected cached config digest: %s != %s", digest.FromBytes(config), manifest.Config.Digest)
+	}
+	if value := partitionMetric(t, "cache_hits_total", map[string]string{"cache": "derivedcontent"}).GetCounter().GetValue(); value != hits+3 {
+		t.Errorf("expected the index, manifest and config to be derived content cache hits: %v != %v", value, hits+3)
+	}
+
+	// flattened layers cannot be served without storing them
+	resp = getTdfsManifestWith(t, env, image, "v1--r0", url.Values{tdfs.FlattenQueryParam: []string{"true"}}, nil)
+	defer resp.Body.Close()
+	checkResponse(t, "fetching flattened index", resp, http.StatusMethodNotAllowed)
+	checkBodyHasErrorCodes(t, "fetching flattened index", resp, errcode.ErrorCodeUnsupported)
+}
+
+// evictingCache is a derived content cache that misses the digests evicted
+// from it until they are cached again.
+type evictingCache struct {
+	cache.DerivedContentCache
+	mu      sync.Mutex
+	evicted map[digest.Digest]struct{}
+}
+
+func (c *evictingCache) evict(dgst digest.Digest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evicted[dgst] = struct{}{}
+}
+
+func (c *evictingCache) Get(ctx context.Context, repo string, dgst digest.Digest) (v1.Descriptor, []byte, error) {
+	c.mu.Lock()
+	_, evicted := c.evicted[dgst]
+	c.mu.Unlock()
+	if evicted {
+		return v1.Descriptor{}, nil, distribution.ErrBlobUnknown
+	}
+	return c.DerivedContentCache.Get(ctx, repo, dgst)
+}
+
+func (c *evictingCache) Put(ctx context.Context, repo string, mediaType string, content []byte) (v1.Descriptor, error) {
+	c.mu.Lock()
+	delete(c.evicted, digest.FromBytes(content))
+	c.mu.Unlock()
+	return c.DerivedContentCache.Put(ctx, repo, mediaType, content)
+}
+
+func TestPartitionReadOnlyEvicted(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 2)
+
+	env.app.readOnly = true
+	env.app.configureDerivedContentCache(&env.config)
+	derivedContent := &evictingCache{DerivedContentCache: env.app.derivedContent, evicted: map[digest.Digest]struct{}{}}
+	env.app.derivedContent = derivedContent
+
+	index, dgst := getPartitionedIndex(t, env, image, "v1--0.0.0.1")
+	resp := getTdfsManifest(t, env, image, index.Manifests[0].Digest.String())
+	defer resp.Body.Close()
+	checkResponse(t, "fetching cached manifest", resp, http.StatusOK)
+	var manifest ocischema.DeserializedManifest
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&manifest), "decoding cached manifest")
+
+	// the index outlives the manifest it references
+	derivedContent.evict(index.Manifests[0].Digest)
+	_, again := getPartitionedIndex(t, env, image, dgst.String())
+	if again != dgst {
+		t.Fatalf("unexpected digest of the derived index: %s != %s", again, dgst)
+	}
+	resp = getTdfsManifest(t, env, image, index.Manifests[0].Digest.String())
+	defer resp.Body.Close()
+	checkResponse(t, "fetching evicted manifest", resp, http.StatusOK)
+
+	// the manifest outlives its config
+	derivedContent.evict(manifest.Config.Digest)
+	resp = getTdfsManifest(t, env, image, index.Manifests[0].Digest.String())
+	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest with an evicted config", resp, http.StatusOK)
+	if _, _, err := derivedContent.Get(env.ctx, image.name.Name(), manifest.Config.Digest); err != nil {
+		t.Fatalf("expected the config to be cached again: %v", err)
+	}
+}
+
+func TestPartitionProxy(t *testing.T) {
+	upstreamEnv := newTestEnv(t, false)
+	defer upstreamEnv.Shutdown()
+
+	image := pushTdfsImage(t, upstreamEnv, "foo/tdfs", "v1", 2, 2)
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: upstreamEnv.server.URL,
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	// the semantic tag is looked up upstream like any other tag, a 2dfs
+	// upstream partitions the image itself
+	index, dgst := getPartitionedIndex(t, env, image, "v1--0.0.0.1")
+	if dgst == image.indexDigest || len(index.Manifests) != 1 {
+		t.Fatalf("unexpected derived index %s: %+v", dgst, index.Manifests)
+	}
+	if _, upstream := getPartitionedIndex(t, upstreamEnv, image, "v1--0.0.0.1"); upstream != dgst {
+		t.Fatalf("expected the index derived upstream, got %s != %s", dgst, upstream)
+	}
+	layers := []digest.Digest{}
+	for _, layer := range getPartitionedLayers(t, env, image, "v1--0.0.0.1") {
+		layers = append(layers, layer.Digest)
+	}
+	expected := []digest.Digest{image.manifest.Layers[0].Digest, image.allotments[0][0], image.allotments[0][1]}
+	if !reflect.DeepEqual(layers, expected) {
+		t.Fatalf("unexpected layers in derived manifest: %v != %v", layers, expected)
+	}
+
+	// the allotments are only fetched when pulled
+	local, err := storage.NewRegistry(env.ctx, env.app.driver)
+	checkErr(t, err, "creating local registry")
+	localRepo, err := local.Repository(env.ctx, image.name)
+	checkErr(t, err, "getting local repository")
+	localBlobs := localRepo.Blobs(env.ctx)
+
+	ref, _ := reference.WithDigest(image.name, image.allotments[0][0])
+	blobURL, err := env.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob url")
+	resp, err := http.Get(blobURL)
+	checkErr(t, err, "fetching allotment")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching allotment", resp, http.StatusOK)
+	_, err = io.Copy(io.Discard, resp.Body)
+	checkErr(t, err, "reading allotment")
+
+	for _, testcase := range []struct {
+		allotment digest.Digest
+		cached    bool
+	}{
+		{allotment: image.allotments[0][0], cached: true},
+		{allotment: image.allotments[0][1], cached: false},
+		{allotment: image.allotments[1][0], cached: false},
+	} {
+		_, err := localBlobs.Stat(env.ctx, testcase.allotment)
+		if cached := err == nil; cached != testcase.cached {
+			t.Fatalf("unexpected caching of allotment %s: %v", testcase.allotment, err)
+		}
+	}
+}
+
+func TestPartitionKeyIsClamped(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 3, 4)
+
+	// the whole row and the rectangle spanning it are the same partition of
+	// the 3x4 field
+	index, dgst := getPartitionedIndex(t, env, image, "v1--r2")
+	if annotation := index.Annotations[tdfs.AnnotationPartitions]; annotation != "2.0.2.3" {
+		t.Fatalf("unexpected partitions annotation of the derived index: %q", annotation)
+	}
+	_, explicit := getPartitionedIndex(t, env, image, "v1--2.0.2.3")
+	if explicit != dgst {
+		t.Fatalf("expected the explicit rectangle to derive the same index as the row: %s != %s", explicit, dgst)
+	}
+
+	partitionIndex := env.app.registry.(distribution.PartitionIndexProvider).PartitionIndex(image.name)
+	recorded, err := partitionIndex.Get(env.ctx, image.indexDigest, "v1@2.0.2.3")
+	checkErr(t, err, "looking up recorded partition")
+	if recorded != dgst {
+		t.Fatalf("unexpected recorded partition: %s != %s", recorded, dgst)
+	}
+	if _, err := partitionIndex.Get(env.ctx, image.indexDigest, "v1@2.0.2.*"); err != distribution.ErrPartitionUnknown {
+		t.Fatalf("expected no partition recorded with open ends: %v", err)
+	}
+
+	// partitions out of the field are rejected before looking them up
+	resp := getTdfsManifest(t, env, image, "v1--r3")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching partitions out of the field", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "fetching partitions out of the field", resp, errcode.ErrorCodePartitionInvalid)
+}
+
+func TestPartitionConcurrent(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 3, 3)
+
+	// identical requests in flight share the derived index
+	const requests = 8
+	digests := make(chan digest.Digest, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := getTdfsManifest(t, env, image, "v1--r1--c2")
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("unexpected status fetching partitioned index: %s", resp.Status)
+				return
+			}
+			digests <- digest.Digest(resp.Header.Get("Docker-Content-Digest"))
+		}()
+	}
+	wg.Wait()
+	close(digests)
+
+	partitions, err := tdfs.ParsePartitions("r1--c2")
+	checkErr(t, err, "parsing partitions")
+	partitionIndex := env.app.registry.(distribution.PartitionIndexProvider).PartitionIndex(image.name)
+	recorded, err := partitionIndex.Get(env.ctx, image.indexDigest, "v1@"+tdfs.FormatPartitions(tdfs.ClampPartitions(partitions, 3, 3)))
+	checkErr(t, err, "looking up recorded partition")
+	for dgst := range digests {
+		if dgst != recorded {
+			t.Fatalf("unexpected digest of a concurrent request: %s != %s", dgst, recorded)
+		}
+	}
+}
+
+// eventRecorder is an events.Sink recording the notification events.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []notifications.Event
+}
+
+func (er *eventRecorder) Write(event events.Event) error {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	er.events = append(er.events, event.(notifications.Event))
+	return nil
+}
+
+func (er *eventRecorder) Close() error { return nil }
+
+// actions returns the actions of the recorded events, by target media type.
+func (er *eventRecorder) actions() map[string][]string {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	actions := map[string][]string{}
+	for _, event := range er.events {
+		actions[event.Target.MediaType] = append(actions[event.Target.MediaType], event.Action)
+	}
+	return actions
+}
+
+func TestPartitionEvents(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 2)
+	recorder := &eventRecorder{}
+	env.app.events.sink = recorder
+
+	index, dgst := getPartitionedIndex(t, env, image, "v1--0.0.0.1")
+
+	// the derivation is reported by a single partition event, its internal
+	// reads and writes are not reported as pulls and pushes
+	expected := map[string][]string{
+		v1.MediaTypeImageIndex: {notifications.EventActionPull, notifications.EventActionPartition},
+	}
+	if actions := recorder.actions(); !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("unexpected events: %v != %v", actions, expected)
+	}
+	event := recorder.events[1]
+	if event.Target.Digest != dgst || event.Target.Tag != "v1" || event.Target.Repository != image.name.Name() {
+		t.Fatalf("unexpected partition event target: %+v", event.Target)
+	}
+	expectedPartition := &notifications.PartitionRecord{
+		Source:     image.indexDigest,
+		Partitions: []string{"0.0.0.1"},
+		Allotments: 2,
+	}
+	if !reflect.DeepEqual(event.Partition, expectedPartition) {
+		t.Fatalf("unexpected partition record: %+v != %+v", event.Partition, expectedPartition)
+	}
+
+	// recorded partitions are not derived again
+	getPartitionedIndex(t, env, image, "v1--0.0.0.1")
+	for _, event := range recorder.events[2:] {
+		if event.Action == notifications.EventActionPartition {
+			t.Fatalf("unexpected partition event for recorded partitions: %+v", event)
+		}
+	}
+
+	// the derived manifests are pulled by clients
+	recorder.events = nil
+	resp := getTdfsManifest(t, env, image, index.Manifests[0].Digest.String())
+	defer resp.Body.Close()
+	checkResponse(t, "fetching partitioned manifest", resp, http.StatusOK)
+	expected = map[string][]string{
+		v1.MediaTypeImageManifest: {notifications.EventActionPull},
+	}
+	if actions := recorder.actions(); !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("unexpected events: %v != %v", actions, expected)
+	}
+}
+
+// partitionMetric returns the partition metric with the given name and
+// labels, or an empty metric if it was not collected yet.
+func partitionMetric(t *testing.T, name string, labels map[string]string) *dto.Metric {
+	families, err := promclient.DefaultGatherer.Gather()
+	checkErr(t, err, "gathering metrics")
+	for _, family := range families {
+		if family.GetName() != "registry_partition_"+name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric
+		}
+	}
+	return &dto.Metric{}
+}
+
+func TestPartitionMetrics(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 2)
+
+	derived := partitionMetric(t, "requests_total", map[string]string{"outcome": "derived"}).GetCounter().GetValue()
+	hit := partitionMetric(t, "requests_total", map[string]string{"outcome": "hit"}).GetCounter().GetValue()
+	hits := partitionMetric(t, "cache_hits_total", map[string]string{"cache": "partitions"}).GetCounter().GetValue()
+	misses := partitionMetric(t, "cache_misses_total", nil).GetCounter().GetValue()
+	durations := partitionMetric(t, "duration_seconds", map[string]string{"outcome": "success"}).GetHistogram().GetSampleCount()
+	allotments := partitionMetric(t, "allotments", nil).GetHistogram()
+	allotmentBytes := partitionMetric(t, "allotment_bytes_total", nil).GetCounter().GetValue()
+
+	// the first request derives the manifest, the second one is a hit
+	layers := getPartitionedLayers(t, env, image, "v1--0.0.0.1")
+	getPartitionedIndex(t, env, image, "v1--0.0.0.1")
+
+	for _, testcase := range []struct {
+		name     string
+		value    float64
+		expected float64
+	}{
+		{name: "derived requests", value: partitionMetric(t, "requests_total", map[string]string{"outcome": "derived"}).GetCounter().GetValue(), expected: derived + 1},
+		{name: "hit requests", value: partitionMetric(t, "requests_total", map[string]string{"outcome": "hit"}).GetCounter().GetValue(), expected: hit + 1},
+		{name: "cache hits", value: partitionMetric(t, "cache_hits_total", map[string]string{"cache": "partitions"}).GetCounter().GetValue(), expected: hits + 1},
+		{name: "cache misses", value: partitionMetric(t, "cache_misses_total", nil).GetCounter().GetValue(), expected: misses + 1},
+		{name: "durations", value: float64(partitionMetric(t, "duration_seconds", map[string]string{"outcome": "success"}).GetHistogram().GetSampleCount()), expected: float64(durations + 1)},
+		{name: "derivations", value: float64(partitionMetric(t, "allotments", nil).GetHistogram().GetSampleCount()), expected: float64(allotments.GetSampleCount() + 1)},
+		{name: "allotments", value: partitionMetric(t, "allotments", nil).GetHistogram().GetSampleSum(), expected: allotments.GetSampleSum() + 2},
+		{name: "allotment bytes", value: partitionMetric(t, "allotment_bytes_total", nil).GetCounter().GetValue(), expected: allotmentBytes + float64(layers[1].Size+layers[2].Size)},
+	} {
+		if testcase.value != testcase.expected {
+			t.Errorf("unexpected %s metric: %v != %v", testcase.name, testcase.value, testcase.expected)
+		}
+	}
+
+	// invalid partitions are failed requests, whether they are rejected
+	// before or while partitioning
+	errors := partitionMetric(t, "requests_total", map[string]string{"outcome": "error"}).GetCounter().GetValue()
+	for _, testcase := range []struct {
+		ref   string
+		query url.Values
+	}{
+		{ref: "v1--x"},
+		{ref: "v1", query: url.Values{tdfs.PartitionQueryParam: []string{"x"}}},
+		{ref: "v1", query: url.Values{tdfs.FlattenQueryParam: []string{"x"}}},
+		{ref: "v1--r5"},
+	} {
+		resp := getTdfsManifestWith(t, env, image, testcase.ref, testcase.query, nil)
+		resp.Body.Close()
+		checkResponse(t, "fetching "+testcase.ref, resp, http.StatusBadRequest)
+	}
+	if value := partitionMetric(t, "requests_total", map[string]string{"outcome": "error"}).GetCounter().GetValue(); value != errors+4 {
+		t.Errorf("unexpected error requests metric: %v != %v", value, errors+4)
+	}
+
+	// requests sharing a derivation are not misses
+	misses = partitionMetric(t, "cache_misses_total", nil).GetCounter().GetValue()
+	partitionMetrics.Request(partitionOutcomeShared)
+	if value := partitionMetric(t, "cache_misses_total", nil).GetCounter().GetValue(); value != misses {
+		t.Errorf("expected shared requests not to be misses: %v != %v", value, misses)
+	}
+}
+
+func TestPartitionPolicy(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Policy: configuration.Policy{
+			Repository: configuration.Repository{
+				Partitions: []configuration.PartitionPolicy{
+					{Repository: "foo/*", Default: "r0"},
+					{Repository: "big/*", Default: "0.0.3.3"},
+					{Repository: "outside/*", Default: "r5"},
+				},
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 2)
+	other := pushTdfsImage(t, env, "bar/tdfs", "v1", 2, 2)
+
+	// plain tag pulls of legacy clients get the default partitions
+	_, explicit := getPartitionedIndex(t, env, image, "v1--r0")
+	_, dgst := getPartitionedIndex(t, env, image, "v1")
+	if dgst != explicit {
+		t.Fatalf("expected the default partitions to be served, got %s instead of %s", dgst, explicit)
+	}
+
+	// clients unpacking 2dfs fields, digest references and other
+	// repositories get the raw image
+	resp := getTdfsManifestWith(t, env, image, "v1", nil, http.Header{"Accept": []string{tdfs.MediaTypeTdfsLayer}})
+	defer resp.Body.Close()
+	checkResponse(t, "fetching raw index", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{"Docker-Content-Digest": []string{image.indexDigest.String()}})
+
+	if _, dgst := getPartitionedIndex(t, env, image, image.indexDigest.String()); dgst != image.indexDigest {
+		t.Fatalf("expected the raw index by digest, got %s", dgst)
+	}
+	if _, dgst := getPartitionedIndex(t, env, other, "v1"); dgst != other.indexDigest {
+		t.Fatalf("expected the raw index outside of the policy, got %s", dgst)
+	}
+
+	// defaults larger than the field are clipped to it
+	big := pushTdfsImage(t, env, "big/tdfs", "v1", 2, 2)
+	_, explicit = getPartitionedIndex(t, env, big, "v1--0.0.1.1")
+	if _, dgst := getPartitionedIndex(t, env, big, "v1"); dgst != explicit {
+		t.Fatalf("expected the default partitions clipped to the field, got %s instead of %s", dgst, explicit)
+	}
+
+	// images sharing no allotment with the defaults are served as is
+	outside := pushTdfsImage(t, env, "outside/tdfs", "v1", 2, 2)
+	if _, dgst := getPartitionedIndex(t, env, outside, "v1"); dgst != outside.indexDigest {
+		t.Fatalf("expected the raw index outside of the default partitions, got %s", dgst)
+	}
+}
+
+// partitionGrantAccessController grants every access, restricting the pulls
+// of its repository to its partitions.
+type partitionGrantAccessController struct {
+	repository string
+	partitions []string
+}
+
+func (ac partitionGrantAccessController) Authorized(r *http.Request, access ...auth.Access) (*auth.Grant, error) {
+	return &auth.Grant{
+		Partitions: map[string][]string{ac.repository: ac.partitions},
+	}, nil
+}
+
+func init() {
+	auth.Register("partitiongrant", func(options map[string]interface{}) (auth.AccessController, error) {
+		return partitionGrantAccessController{
+			repository: options["repository"].(string),
+			partitions: strings.Split(options["partitions"].(string), ","),
+		}, nil
+	})
+}
+
+// getPartitionedLayers fetches the derived index served for ref and returns
+// the layers of its first image manifest.
+func getPartitionedLayers(t *testing.T, env *testEnv, image tdfsImage, ref string) []v1.Descriptor {
+	index, _ := getPartitionedIndex(t, env, image, ref)
+	resp := getTdfsManifest(t, env, image, index.Manifests[0].Digest.String())
+	defer resp.Body.Close()
+	checkResponse(t, "fetching partitioned manifest", resp, http.StatusOK)
+	var manifest ocischema.DeserializedManifest
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&manifest), "decoding partitioned manifest")
+	return manifest.Layers
+}
+
+// newPartitionGrantTestEnv returns a test environment restricting the pulls
+// of foo/tdfs to the partitions 0.0.0.1 and r1--ex1.1.1.1.
+func newPartitionGrantTestEnv(t *testing.T) *testEnv {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"partitiongrant": configuration.Parameters{
+				"repository": "foo/tdfs",
+				"partitions": "0.0.0.1,r1--ex1.1.1.1",
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	return newTestEnvWithConfig(t, &config)
+}
+
+func TestPartitionGrant(t *testing.T) {
+	env := newPartitionGrantTestEnv(t)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 3)
+	other := pushTdfsImage(t, env, "bar/tdfs", "v1", 2, 3)
+
+	// requests are clipped to the granted partitions
+	for _, testcase := range []struct {
+		ref        string
+		allotments [][2]int
+	}{
+		{ref: "v1--r0", allotments: [][2]int{{0, 0}, {0, 1}}},
+		{ref: "v1--c1", allotments: [][2]int{{0, 1}}},
+		{ref: "v1--r0--r1", allotments: [][2]int{{0, 0}, {0, 1}, {1, 0}, {1, 2}}},
+	} {
+		layers := getPartitionedLayers(t, env, image, testcase.ref)
+		if len(layers) != len(testcase.allotments)+1 {
+			t.Fatalf("unexpected layers for %s: %+v", testcase.ref, layers)
+		}
+		for i, allotment := range testcase.allotments {
+			if layers[i+1].Digest != image.allotments[allotment[0]][allotment[1]] {
+				t.Fatalf("unexpected layer %d for %s: %+v", i+1, testcase.ref, layers[i+1])
+			}
+		}
+	}
+
+	// unpartitioned pulls and requests outside of the grant are denied
+	for _, ref := range []string{"v1", image.indexDigest.String(), image.manifestDigest.String(), "v1--1.1.1.1"} {
+		resp := getTdfsManifest(t, env, image, ref)
+		defer resp.Body.Close()
+		checkResponse(t, "fetching "+ref, resp, http.StatusForbidden)
+		checkBodyHasErrorCodes(t, "fetching "+ref, resp, errcode.ErrorCodeDenied)
+	}
+
+	// other repositories are not restricted
+	if _, dgst := getPartitionedIndex(t, env, other, "v1"); dgst != other.indexDigest {
+		t.Fatalf("expected the raw index of an unrestricted repository, got %s", dgst)
+	}
+}
+
+// getBlobStatus fetches the blob dgst of the repository name and returns the
+// response status.
+func getBlobStatus(t *testing.T, env *testEnv, name reference.Named, dgst digest.Digest) int {
+	ref, _ := reference.WithDigest(name, dgst)
+	blobURL, err := env.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob url")
+	resp, err := http.Get(blobURL)
+	checkErr(t, err, "fetching blob")
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPartitionGrantOtherRoutes(t *testing.T) {
+	env := newPartitionGrantTestEnv(t)
+	defer env.Shutdown()
+
+	// the granted cells of the 2x3 field
+	granted := [][2]int{{0, 0}, {0, 1}, {1, 0}, {1, 2}}
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 3)
+	pushTdfsManifest(t, env, "foo/tdfs", "v2", 2, 3)
+
+	// fields are described within the grant
+	resp := getTdfsField(t, env, image.name, "v1")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching field", resp, http.StatusOK)
+	var described tdfsFieldAPIResponse
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&described), "decoding field")
+	cells := described.Manifests[0].Fields[0].Cells
+	if len(cells) != len(granted) {
+		t.Fatalf("unexpected cells described to a restricted caller: %+v", cells)
+	}
+	for i, cell := range cells {
+		if cell.Row != granted[i][0] || cell.Col != granted[i][1] {
+			t.Fatalf("unexpected cell %d described to a restricted caller: %+v", i, cell)
+		}
+	}
+
+	// diffs report the granted cells only
+	resp = getTdfsDiff(t, env, image.name, image.manifestDigest.String(), "v2")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching diff", resp, http.StatusOK)
+	var diff tdfsDiffAPIResponse
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&diff), "decoding diff")
+	changed := diff.Manifests[0].Fields[0].Changed
+	if len(changed) != len(granted) {
+		t.Fatalf("unexpected cells diffed for a restricted caller: %+v", changed)
+	}
+	for i, cell := range changed {
+		if cell.Row != granted[i][0] || cell.Col != granted[i][1] {
+			t.Fatalf("unexpected cell %d diffed for a restricted caller: %+v", i, cell)
+		}
+	}
+
+	// previews are clipped like pulls
+	resp = getTdfsPreview(t, env, image, "v1--r0", nil, "")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching preview", resp, http.StatusOK)
+	var previewed tdfsPreviewAPIResponse
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&previewed), "decoding preview")
+	if previewed.Partitions != "0.0.0.1" || len(previewed.Manifests[0].Allotments) != 2 {
+		t.Fatalf("unexpected preview for a restricted caller: %+v", previewed)
+	}
+	for _, tag := range []string{"v1", "v1--1.1.1.1"} {
+		resp := getTdfsPreview(t, env, image, tag, nil, "")
+		defer resp.Body.Close()
+		checkResponse(t, "fetching preview of "+tag, resp, http.StatusForbidden)
+		checkBodyHasErrorCodes(t, "fetching preview of "+tag, resp, errcode.ErrorCodeDenied)
+	}
+
+	// fields and allotments outside of the grant cannot be read as blobs
+	for _, testcase := range []struct {
+		dgst   digest.Digest
+		status int
+	}{
+		{dgst: image.manifest.Layers[0].Digest, status: http.StatusOK},
+		{dgst: image.manifest.Layers[1].Digest, status: http.StatusForbidden},
+		{dgst: image.allotments[0][0], status: http.StatusOK},
+		{dgst: image.allotments[1][1], status: http.StatusForbidden},
+	} {
+		if status := getBlobStatus(t, env, image.name, testcase.dgst); status != testcase.status {
+			t.Fatalf("expected status %d fetching blob %s, got %d", testcase.status, testcase.dgst, status)
+		}
+	}
+
+	// layers flattened within the grant can be read
+	flatten := url.Values{tdfs.FlattenQueryParam: []string{"true"}}
+	resp = getTdfsManifestWith(t, env, image, image.manifestDigest.String(), url.Values{
+		tdfs.PartitionQueryParam: []string{"r0"},
+		tdfs.FlattenQueryParam:   flatten[tdfs.FlattenQueryParam],
+	}, nil)
+	defer resp.Body.Close()
+	checkResponse(t, "fetching flattened manifest", resp, http.StatusOK)
+	var flattened ocischema.DeserializedManifest
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&flattened), "decoding flattened manifest")
+	if status := getBlobStatus(t, env, image.name, flattened.Layers[1].Digest); status != http.StatusOK {
+		t.Fatalf("expected the flattened layer to be readable, got %d", status)
+	}
+
+	// the decisions are cached by repository, grant and blob
+	cached := map[digest.Digest]bool{}
+	for _, key := range env.app.blobGrants.Keys() {
+		decision, _ := env.app.blobGrants.Peek(key)
+		if key.repo == image.name.Name() {
+			cached[key.digest] = decision.allowed
+		}
+	}
+	if allowed, ok := cached[image.allotments[1][1]]; !ok || allowed {
+		t.Fatalf("expected the denied allotment to be cached, got %v", cached)
+	}
+	if allowed, ok := cached[flattened.Layers[1].Digest]; !ok || !allowed {
+		t.Fatalf("expected the granted flattened layer to be cached, got %v", cached)
+	}
+}
+
+func TestPartitionGrantDerivedBlob(t *testing.T) {
+	env := newPartitionGrantTestEnv(t)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 3)
+	repository, err := env.app.registry.Repository(env.ctx, image.name)
+	checkErr(t, err, "getting repository")
+	field, err := repository.Blobs(env.ctx).Get(env.ctx, image.manifest.Layers[1].Digest)
+	checkErr(t, err, "reading field")
+
+	env.app.readOnly = true
+	env.app.configureDerivedContentCache(&env.config)
+
+	// blobs served from the derived content cache are checked against the
+	// grant as well
+	_, err = env.app.derivedContent.Put(env.ctx, image.name.Name(), tdfs.MediaTypeTdfsLayer, field)
+	checkErr(t, err, "caching field")
+	if status := getBlobStatus(t, env, image.name, image.manifest.Layers[1].Digest); status != http.StatusForbidden {
+		t.Fatalf("expected the cached field to be denied, got %d", status)
+	}
+}
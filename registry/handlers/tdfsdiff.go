@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/internal/dcontext"
+	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/2DFS/2dfs-registry/v3/manifest/tdfs"
+	"github.com/2DFS/2dfs-registry/v3/notifications"
+	"github.com/2DFS/2dfs-registry/v3/registry/api/errcode"
+	"github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tdfsDiffDispatcher constructs the 2dfs field diff api endpoint.
+func tdfsDiffDispatcher(ctx *Context, r *http.Request) http.Handler {
+	tdfsDiffHandler := &tdfsDiffHandler{
+		Context:   ctx,
+		From:      dcontext.GetStringValue(ctx, "vars.from"),
+		Reference: getReference(ctx),
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(tdfsDiffHandler.GetDiff),
+	}
+}
+
+// tdfsDiffHandler handles requests for the differences between the 2dfs
+// fields of two versions of an image.
+type tdfsDiffHandler struct {
+	*Context
+
+	// From is the tag or digest of the previous version of the image.
+	From string
+
+	// Reference is the tag or digest of the new version of the image.
+	Reference string
+}
+
+type tdfsDiffAPIResponse struct {
+	Name       string                `json:"name"`
+	From       string                `json:"from"`
+	FromDigest digest.Digest         `json:"fromDigest"`
+	Reference  string                `json:"reference"`
+	Digest     digest.Digest         `json:"digest"`
+	Manifests  []tdfsDiffAPIManifest `json:"manifests"`
+}
+
+// tdfsDiffAPIManifest describes the differences between the fields of two
+// versions of an image manifest. From or To is empty if the image manifest
+// is missing from that version.
+type tdfsDiffAPIManifest struct {
+	Platform *v1.Platform     `json:"platform,omitempty"`
+	From     digest.Digest    `json:"from,omitempty"`
+	To       digest.Digest    `json:"to,omitempty"`
+	Fields   []tdfs.FieldDiff `json:"fields"`
+}
+
+// tdfsDiffEntry is an image manifest of one version of the image.
+type tdfsDiffEntry struct {
+	platform *v1.Platform
+	digest   digest.Digest
+	manifest *ocischema.DeserializedManifest
+}
+
+// GetDiff returns the allotments added, removed or changed between the 2dfs
+// fields of the images identified by From and Reference. Image manifests of
+// image indexes are matched by platform.
+func (th *tdfsDiffHandler) GetDiff(w http.ResponseWriter, r *http.Request) {
+	dcontext.GetLogger(th).Debug("GetDiff")
+	manifests, err := th.Repository.Manifests(th)
+	if err != nil {
+		th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	blobs := th.Repository.Blobs(th)
+
+	fromDigest, err := resolveTdfsReference(th.Context, th.From)
+	if err != nil {
+		th.Errors = append(th.Errors, tdfsError(err))
+		return
+	}
+	toDigest, err := resolveTdfsReference(th.Context, th.Reference)
+	if err != nil {
+		th.Errors = append(th.Errors, tdfsError(err))
+		return
+	}
+
+	// callers granted some partitions only are reported the granted cells
+	granted, restricted, err := th.grantedPartitions()
+	if err != nil {
+		dcontext.GetLogger(th).Errorf("invalid partitions granted for %s: %v", th.Repository.Named().Name(), err)
+		th.Errors = append(th.Errors, errcode.ErrorCodeDenied)
+		return
+	}
+
+	// diffing the images does not pull them, their reads are not reported
+	ctx := notifications.WithInternal(th)
+	fromEntries, err := th.entries(ctx, manifests, fromDigest)
+	if err != nil {
+		th.Errors = append(th.Errors, tdfsError(err))
+		return
+	}
+	toEntries, err := th.entries(ctx, manifests, toDigest)
+	if err != nil {
+		th.Errors = append(th.Errors, tdfsError(err))
+		return
+	}
+
+	response := tdfsDiffAPIResponse{
+		Name:       th.Repository.Named().Name(),
+		From:       th.From,
+		FromDigest: fromDigest,
+		Reference:  th.Reference,
+		Digest:     toDigest,
+		Manifests:  []tdfsDiffAPIManifest{},
+	}
+	matched := make([]bool, len(fromEntries))
+	diff := func(from, to tdfsDiffEntry) error {
+		fields, err := tdfs.DiffManifestFields(ctx, blobs, from.manifest, to.manifest)
+		if err != nil {
+			return err
+		}
+		if restricted {
+			for i, field := range fields {
+				fields[i] = tdfs.ClipFieldDiff(field, granted)
+			}
+		}
+		platform := to.platform
+		if platform == nil {
+			platform = from.platform
+		}
+		response.Manifests = append(response.Manifests, tdfsDiffAPIManifest{
+			Platform: platform,
+			From:     from.digest,
+			To:       to.digest,
+			Fields:   fields,
+		})
+		return nil
+	}
+	for _, to := range toEntries {
+		var from tdfsDiffEntry
+		for i, candidate := range fromEntries {
+			if !matched[i] && platformKey(candidate.platform) == platformKey(to.platform) {
+				matched[i] = true
+				from = candidate
+				break
+			}
+		}
+		if err := diff(from, to); err != nil {
+			th.Errors = append(th.Errors, tdfsError(err))
+			return
+		}
+	}
+	for i, from := range fromEntries {
+		if matched[i] {
+			continue
+		}
+		if err := diff(from, tdfsDiffEntry{}); err != nil {
+			th.Errors = append(th.Errors, tdfsError(err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(response); err != nil {
+		th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
+// entries returns the image manifests of the image index or image manifest
+// stored at dgst. Manifests other than OCI image manifests have no fields.
+func (th *tdfsDiffHandler) entries(ctx context.Context, manifests distribution.ManifestService, dgst digest.Digest) ([]tdfsDiffEntry, error) {
+	manifest, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	index, ok := manifest.(*ocischema.DeserializedImageIndex)
+	if !ok {
+		ociManifest, _ := manifest.(*ocischema.DeserializedManifest)
+		return []tdfsDiffEntry{{digest: dgst, manifest: ociManifest}}, nil
+	}
+	entries := []tdfsDiffEntry{}
+	for _, descriptor := range index.Manifests {
+		submanifest, err := manifests.Get(ctx, descriptor.Digest)
+		if err != nil {
+			return nil, err
+		}
+		ociManifest, _ := submanifest.(*ocischema.DeserializedManifest)
+		entries = append(entries, tdfsDiffEntry{
+			platform: descriptor.Platform,
+			digest:   descriptor.Digest,
+			manifest: ociManifest,
+		})
+	}
+	return entries, nil
+}
+
+// platformKey returns the key matching image manifests of the same platform
+// across image indexes. Image manifests without a platform share the empty
+// key.
+func platformKey(platform *v1.Platform) string {
+	if platform == nil {
+		return ""
+	}
+	return platform.OS + "/" + platform.Architecture + "/" + platform.Variant
+}
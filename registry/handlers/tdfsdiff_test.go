@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/2DFS/2dfs-registry/v3/registry/api/errcode"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// getTdfsDiff fetches the differences between the fields of from and to in
+// the repository name.
+func getTdfsDiff(t *testing.T, env *testEnv, name reference.Named, from, to string) *http.Response {
+	refs := make([]reference.Named, 2)
+	for i, ref := range []string{from, to} {
+		if dgst, err := digest.Parse(ref); err == nil {
+			refs[i], _ = reference.WithDigest(name, dgst)
+		} else {
+			refs[i], err = reference.WithTag(name, ref)
+			checkErr(t, err, "building tag reference")
+		}
+	}
+	diffURL, err := env.builder.BuildTdfsDiffURL(refs[0], refs[1])
+	checkErr(t, err, "building diff url")
+
+	resp, err := http.Get(diffURL)
+	checkErr(t, err, "fetching diff")
+	return resp
+}
+
+func TestTdfsDiff(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	// every allotment of v2 differs from the one of v1 at the same position
+	v1 := pushTdfsManifest(t, env, "foo/tdfs", "v1", 2, 3)
+	v2 := pushTdfsManifest(t, env, "foo/tdfs", "v2", 3, 2)
+	recorder := &eventRecorder{}
+	env.app.events.sink = recorder
+
+	resp := getTdfsDiff(t, env, v1.name, "v1", v2.manifestDigest.String())
+	defer resp.Body.Close()
+	checkResponse(t, "fetching diff", resp, http.StatusOK)
+
+	// diffing the images does not pull them
+	if actions := recorder.actions(); len(actions) != 0 {
+		t.Fatalf("unexpected events diffing the images: %v", actions)
+	}
+
+	var diff tdfsDiffAPIResponse
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&diff), "decoding diff")
+	if diff.Name != "foo/tdfs" || diff.From != "v1" || diff.FromDigest != v1.manifestDigest || diff.Digest != v2.manifestDigest {
+		t.Fatalf("unexpected images in diff: %+v", diff)
+	}
+	if len(diff.Manifests) != 1 || diff.Manifests[0].From != v1.manifestDigest || diff.Manifests[0].To != v2.manifestDigest {
+		t.Fatalf("unexpected manifests in diff: %+v", diff.Manifests)
+	}
+	if len(diff.Manifests[0].Fields) != 1 {
+		t.Fatalf("unexpected fields in diff: %+v", diff.Manifests[0].Fields)
+	}
+
+	field := diff.Manifests[0].Fields[0]
+	if field.From != v1.manifest.Layers[1].Digest || field.To != v2.manifest.Layers[1].Digest {
+		t.Fatalf("unexpected field layers in diff: %+v", field)
+	}
+	if len(field.Changed) != 4 {
+		t.Fatalf("expected the 4 common allotments to be changed: %+v", field.Changed)
+	}
+	for i, cell := range field.Changed {
+		row, col := i/2, i%2
+		if cell.Row != row || cell.Col != col || cell.OldDigest != v1.allotments[row][col] || cell.NewDigest != v2.allotments[row][col] {
+			t.Fatalf("unexpected changed allotment %d: %+v", i, cell)
+		}
+		if cell.OldSize == 0 || cell.NewSize == 0 || cell.SizeDelta != cell.NewSize-cell.OldSize {
+			t.Fatalf("expected the sizes of changed allotment %d: %+v", i, cell)
+		}
+	}
+	if len(field.Removed) != 2 || field.Removed[0].Row != 0 || field.Removed[0].Col != 2 || field.Removed[1].Row != 1 || field.Removed[1].Col != 2 {
+		t.Fatalf("expected column 2 to be removed: %+v", field.Removed)
+	}
+	if len(field.Added) != 2 || field.Added[0].Row != 2 || field.Added[0].Col != 0 || field.Added[1].Row != 2 || field.Added[1].Col != 1 {
+		t.Fatalf("expected row 2 to be added: %+v", field.Added)
+	}
+	if field.Added[0].NewDigest != v2.allotments[2][0] || field.Removed[0].OldDigest != v1.allotments[0][2] {
+		t.Fatalf("unexpected digests of the added and removed allotments: %+v", field)
+	}
+
+	// identical versions have no differences
+	resp = getTdfsDiff(t, env, v1.name, "v1", "v1")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching diff of identical versions", resp, http.StatusOK)
+	diff = tdfsDiffAPIResponse{}
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&diff), "decoding diff")
+	if len(diff.Manifests) != 1 || len(diff.Manifests[0].Fields) != 1 {
+		t.Fatalf("unexpected diff of identical versions: %+v", diff)
+	}
+	if field := diff.Manifests[0].Fields[0]; len(field.Added)+len(field.Removed)+len(field.Changed) != 0 || field.SizeDelta != 0 {
+		t.Fatalf("expected no differences between identical versions: %+v", field)
+	}
+
+	resp = getTdfsDiff(t, env, v1.name, "unknown", "v1")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching diff from unknown tag", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "fetching diff from unknown tag", resp, errcode.ErrorCodeManifestUnknown)
+}
+
+func TestTdfsDiffIndex(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	// image indexes are matched by platform
+	v1 := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 2)
+	plain := pushTdfsManifest(t, env, "foo/tdfs", "plain", 1, 1)
+
+	resp := getTdfsDiff(t, env, v1.name, "v1", "plain")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching diff", resp, http.StatusOK)
+
+	var diff tdfsDiffAPIResponse
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&diff), "decoding diff")
+	if diff.FromDigest != v1.indexDigest || diff.Digest != plain.manifestDigest || len(diff.Manifests) != 2 {
+		t.Fatalf("unexpected diff: %+v", diff)
+	}
+
+	added, removed := diff.Manifests[0], diff.Manifests[1]
+	if added.From != "" || added.To != plain.manifestDigest || len(added.Fields) != 1 || len(added.Fields[0].Added) != 1 {
+		t.Fatalf("expected the image manifest without platform to be added: %+v", added)
+	}
+	if removed.From != v1.manifestDigest || removed.To != "" || removed.Platform == nil || removed.Platform.Architecture != "amd64" ||
+		len(removed.Fields) != 1 || len(removed.Fields[0].Removed) != 4 {
+		t.Fatalf("expected the amd64 image manifest to be removed: %+v", removed)
+	}
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/internal/dcontext"
+	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/2DFS/2dfs-registry/v3/manifest/tdfs"
+	"github.com/2DFS/2dfs-registry/v3/notifications"
+	"github.com/2DFS/2dfs-registry/v3/registry/api/errcode"
+	"github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tdfsFieldDispatcher constructs the 2dfs field inspection api endpoint.
+func tdfsFieldDispatcher(ctx *Context, r *http.Request) http.Handler {
+	tdfsFieldHandler := &tdfsFieldHandler{
+		Context:   ctx,
+		Reference: getReference(ctx),
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(tdfsFieldHandler.GetField),
+	}
+}
+
+// tdfsFieldHandler handles requests for the description of the 2dfs fields
+// of an image.
+type tdfsFieldHandler struct {
+	*Context
+
+	// Reference is the tag or digest of the image.
+	Reference string
+}
+
+type tdfsFieldAPIResponse struct {
+	Name      string                 `json:"name"`
+	Reference string                 `json:"reference"`
+	Digest    digest.Digest          `json:"digest"`
+	Manifests []tdfsFieldAPIManifest `json:"manifests"`
+}
+
+// tdfsFieldAPIManifest describes the fields of an image manifest. Manifests
+// without a field have no fields.
+type tdfsFieldAPIManifest struct {
+	Digest   digest.Digest           `json:"digest"`
+	Platform *v1.Platform            `json:"platform,omitempty"`
+	Fields   []tdfs.FieldDescription `json:"fields,omitempty"`
+}
+
+// GetField returns the description of the 2dfs fields of the image index or
+// image manifest identified by the reference.
+func (th *tdfsFieldHandler) GetField(w http.ResponseWriter, r *http.Request) {
+	dcontext.GetLogger(th).Debug("GetField")
+	manifests, err := th.Repository.Manifests(th)
+	if err != nil {
+		th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	blobs := th.Repository.Blobs(th)
+
+	dgst, err := resolveTdfsReference(th.Context, th.Reference)
+	if err != nil {
+		th.Errors = append(th.Errors, tdfsError(err))
+		return
+	}
+
+	// describing the image does not pull it, its reads are not reported
+	ctx := notifications.WithInternal(th)
+	manifest, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		th.Errors = append(th.Errors, tdfsError(err))
+		return
+	}
+
+	// callers granted some partitions only are described the granted cells
+	granted, _, err := th.grantedPartitions()
+	if err != nil {
+		dcontext.GetLogger(th).Errorf("invalid partitions granted for %s: %v", th.Repository.Named().Name(), err)
+		th.Errors = append(th.Errors, errcode.ErrorCodeDenied)
+		return
+	}
+
+	response := tdfsFieldAPIResponse{
+		Name:      th.Repository.Named().Name(),
+		Reference: th.Reference,
+		Digest:    dgst,
+		Manifests: []tdfsFieldAPIManifest{},
+	}
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedImageIndex:
+		for _, descriptor := range m.Manifests {
+			submanifest, err := manifests.Get(ctx, descriptor.Digest)
+			if err != nil {
+				th.Errors = append(th.Errors, tdfsError(err))
+				return
+			}
+			described, err := th.describeManifest(ctx, blobs, descriptor.Digest, submanifest, granted)
+			if err != nil {
+				th.Errors = append(th.Errors, tdfsError(err))
+				return
+			}
+			described.Platform = descriptor.Platform
+			response.Manifests = append(response.Manifests, described)
+		}
+	default:
+		described, err := th.describeManifest(ctx, blobs, dgst, manifest, granted)
+		if err != nil {
+			th.Errors = append(th.Errors, tdfsError(err))
+			return
+		}
+		response.Manifests = append(response.Manifests, described)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(response); err != nil {
+		th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
+// describeManifest describes the fields of the manifest stored at dgst, in
+// layer order, keeping the cells lying in the granted partitions only
+// unless granted is nil.
+func (th *tdfsFieldHandler) describeManifest(ctx context.Context, blobs distribution.BlobStore, dgst digest.Digest, manifest distribution.Manifest, granted []tdfs.Partition) (tdfsFieldAPIManifest, error) {
+	described := tdfsFieldAPIManifest{Digest: dgst}
+
+	ociManifest, ok := manifest.(*ocischema.DeserializedManifest)
+	if !ok {
+		return described, nil
+	}
+	fields, err := tdfs.DescribeFields(ctx, blobs, ociManifest)
+	if err != nil {
+		return described, err
+	}
+	if granted != nil {
+		for i, field := range fields {
+			fields[i] = tdfs.ClipFieldDescription(field, granted)
+		}
+	}
+	described.Fields = fields
+	return described, nil
+}
+
+// resolveTdfsReference returns the digest of the manifest identified by ref,
+// a tag or digest of the repository of ctx.
+func resolveTdfsReference(ctx *Context, ref string) (digest.Digest, error) {
+	if dgst, err := digest.Parse(ref); err == nil {
+		return dgst, nil
+	}
+	desc, err := ctx.Repository.Tags(ctx).Get(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest, nil
+}
+
+// tdfsError returns the error code reporting err, met while reading a 2dfs
+// image.
+func tdfsError(err error) errcode.Error {
+	switch err := err.(type) {
+	case distribution.ErrManifestUnknownRevision:
+		return errcode.ErrorCodeManifestUnknown.WithDetail(err)
+	case distribution.ErrTagUnknown:
+		return errcode.ErrorCodeManifestUnknown.WithDetail(err)
+	case tdfs.ErrFieldInvalid:
+		return errcode.ErrorCodeManifestInvalid.WithDetail(err)
+	case tdfs.ErrPartitionInvalid:
+		return errcode.ErrorCodePartitionInvalid.WithDetail(err)
+	case errcode.Error:
+		return err
+	default:
+		if err == distribution.ErrBlobUnknown {
+			return errcode.ErrorCodeBlobUnknown.WithDetail(err)
+		}
+		return errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/2DFS/2dfs-registry/v3/configuration"
+	"github.com/2DFS/2dfs-registry/v3/registry/api/errcode"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// getTdfsField fetches the description of the fields of ref in the
+// repository of image.
+func getTdfsField(t *testing.T, env *testEnv, name reference.Named, ref string) *http.Response {
+	var named reference.Named
+	if dgst, err := digest.Parse(ref); err == nil {
+		named, _ = reference.WithDigest(name, dgst)
+	} else {
+		named, err = reference.WithTag(name, ref)
+		checkErr(t, err, "building tag reference")
+	}
+	fieldURL, err := env.builder.BuildTdfsFieldURL(named)
+	checkErr(t, err, "building field url")
+
+	resp, err := http.Get(fieldURL)
+	checkErr(t, err, "fetching field")
+	return resp
+}
+
+func TestTdfsField(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 3)
+	recorder := &eventRecorder{}
+	env.app.events.sink = recorder
+
+	resp := getTdfsField(t, env, image.name, "v1")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching field", resp, http.StatusOK)
+
+	var described tdfsFieldAPIResponse
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&described), "decoding field description")
+	if described.Name != "foo/tdfs" || described.Reference != "v1" || described.Digest != image.indexDigest {
+		t.Fatalf("unexpected image in field description: %+v", described)
+	}
+	if len(described.Manifests) != 1 {
+		t.Fatalf("unexpected manifests in field description: %+v", described.Manifests)
+	}
+	manifest := described.Manifests[0]
+	if manifest.Digest != image.manifestDigest || manifest.Platform == nil || manifest.Platform.Architecture != "amd64" {
+		t.Fatalf("unexpected manifest in field description: %+v", manifest)
+	}
+	if len(manifest.Fields) != 1 {
+		t.Fatalf("unexpected fields in field description: %+v", manifest.Fields)
+	}
+
+	field := manifest.Fields[0]
+	if field.Digest != image.manifest.Layers[1].Digest || field.Rows != 2 || len(field.Columns) != 2 || field.Columns[0] != 3 || field.Columns[1] != 3 {
+		t.Fatalf("unexpected grid in field description: %+v", field)
+	}
+	if len(field.Cells) != 6 {
+		t.Fatalf("unexpected cells in field description: %+v", field.Cells)
+	}
+	for i, cell := range field.Cells {
+		row, col := i/3, i%3
+		if cell.Row != row || cell.Col != col || cell.Digest != image.allotments[row][col] {
+			t.Fatalf("unexpected cell %d in field description: %+v", i, cell)
+		}
+		if cell.DiffID == "" || cell.Size == 0 {
+			t.Fatalf("expected the diffID and size of cell %d: %+v", i, cell)
+		}
+	}
+
+	// image manifests are described by digest
+	resp = getTdfsField(t, env, image.name, image.manifestDigest.String())
+	defer resp.Body.Close()
+	checkResponse(t, "fetching field by digest", resp, http.StatusOK)
+	described = tdfsFieldAPIResponse{}
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&described), "decoding field description")
+	if len(described.Manifests) != 1 || described.Manifests[0].Platform != nil || len(described.Manifests[0].Fields) != 1 {
+		t.Fatalf("unexpected field description of the image manifest: %+v", described.Manifests)
+	}
+
+	// describing the image does not pull it
+	if actions := recorder.actions(); len(actions) != 0 {
+		t.Fatalf("unexpected events describing the field: %v", actions)
+	}
+
+	resp = getTdfsField(t, env, image.name, "unknown")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching field of unknown tag", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "fetching field of unknown tag", resp, errcode.ErrorCodeManifestUnknown)
+}
+
+func TestTdfsFieldAuthorized(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	name, _ := reference.WithName("foo/tdfs")
+	resp := getTdfsField(t, env, name, "v1")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching field without authorization", resp, http.StatusUnauthorized)
+	if challenge := resp.Header.Get("WWW-Authenticate"); !strings.Contains(challenge, `scope="repository:foo/tdfs:pull"`) {
+		t.Fatalf("expected a pull challenge, got %q", challenge)
+	}
+}
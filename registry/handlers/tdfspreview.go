@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/internal/dcontext"
+	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/2DFS/2dfs-registry/v3/manifest/tdfs"
+	"github.com/2DFS/2dfs-registry/v3/notifications"
+	"github.com/2DFS/2dfs-registry/v3/registry/api/errcode"
+	"github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tdfsPreviewDispatcher constructs the 2dfs partition preview api endpoint.
+func tdfsPreviewDispatcher(ctx *Context, r *http.Request) http.Handler {
+	tdfsPreviewHandler := &tdfsPreviewHandler{
+		Context:   ctx,
+		Reference: getReference(ctx),
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(tdfsPreviewHandler.GetPreview),
+	}
+}
+
+// tdfsPreviewHandler handles requests for the preview of the partitions of
+// a 2dfs image.
+type tdfsPreviewHandler struct {
+	*Context
+
+	// Reference is the semantic tag, tag or digest of the image.
+	Reference string
+}
+
+type tdfsPreviewAPIResponse struct {
+	Name       string                   `json:"name"`
+	Reference  string                   `json:"reference"`
+	Digest     digest.Digest            `json:"digest"`
+	Partitions string                   `json:"partitions"`
+	Manifests  []tdfsPreviewAPIManifest `json:"manifests"`
+}
+
+// tdfsPreviewAPIManifest describes the layers the partitioned manifest of an
+// image manifest would hold.
+type tdfsPreviewAPIManifest struct {
+	Digest   digest.Digest `json:"digest"`
+	Platform *v1.Platform  `json:"platform,omitempty"`
+	tdfs.PartitionPreview
+}
+
+// GetPreview returns, for every image manifest of the image identified by the
+// reference, the allotments selected by the requested partitions and the
+// size of the partitioned manifest. Unlike GetManifest, nothing is derived
+// nor stored.
+func (th *tdfsPreviewHandler) GetPreview(w http.ResponseWriter, r *http.Request) {
+	dcontext.GetLogger(th).Debug("GetPreview")
+	manifests, err := th.Repository.Manifests(th)
+	if err != nil {
+		th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	blobs := th.Repository.Blobs(th)
+
+	var partitions []tdfs.Partition
+	dgst, err := digest.Parse(th.Reference)
+	if err != nil {
+		_, tagPartitions, desc, err := resolveSemanticTag(th, th.Repository.Tags(th), th.Reference)
+		if err != nil {
+			th.Errors = append(th.Errors, err)
+			return
+		}
+		partitions = tagPartitions
+		dgst = desc.Digest
+	}
+
+	requested, err := requestedPartitions(r)
+	if err != nil {
+		th.Errors = append(th.Errors, errcode.ErrorCodePartitionInvalid.WithDetail(err))
+		return
+	}
+	partitions = append(partitions, requested...)
+
+	// previewing the image does not pull it, its reads are not reported
+	ctx := notifications.WithInternal(th)
+	manifest, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		th.Errors = append(th.Errors, tdfsError(err))
+		return
+	}
+
+	// callers granted some partitions only preview them, as they pull them
+	granted, restricted, err := th.grantedPartitions()
+	if err != nil {
+		dcontext.GetLogger(th).Errorf("invalid partitions granted for %s: %v", th.Repository.Named().Name(), err)
+		th.Errors = append(th.Errors, errcode.ErrorCodeDenied)
+		return
+	}
+	if restricted {
+		hasField, err := th.hasField(manifests, manifest)
+		if err != nil {
+			th.Errors = append(th.Errors, tdfsError(err))
+			return
+		}
+		if hasField {
+			partitions, err = restrictPartitions(partitions, granted)
+			if err != nil {
+				th.Errors = append(th.Errors, err)
+				return
+			}
+		}
+	}
+
+	response := tdfsPreviewAPIResponse{
+		Name:       th.Repository.Named().Name(),
+		Reference:  th.Reference,
+		Digest:     dgst,
+		Partitions: tdfs.FormatPartitions(partitions),
+		Manifests:  []tdfsPreviewAPIManifest{},
+	}
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedImageIndex:
+		for _, descriptor := range m.Manifests {
+			submanifest, err := manifests.Get(ctx, descriptor.Digest)
+			if err != nil {
+				th.Errors = append(th.Errors, tdfsError(err))
+				return
+			}
+			previewed, err := th.previewManifest(ctx, blobs, descriptor.Digest, submanifest, partitions)
+			if err != nil {
+				th.Errors = append(th.Errors, tdfsError(err))
+				return
+			}
+			previewed.Platform = descriptor.Platform
+			response.Manifests = append(response.Manifests, previewed)
+		}
+	default:
+		previewed, err := th.previewManifest(ctx, blobs, dgst, manifest, partitions)
+		if err != nil {
+			th.Errors = append(th.Errors, tdfsError(err))
+			return
+		}
+		response.Manifests = append(response.Manifests, previewed)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(response); err != nil {
+		th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
+// previewManifest previews the partitions of the manifest stored at dgst.
+// Only image manifests are partitioned, others are previewed without
+// allotments.
+func (th *tdfsPreviewHandler) previewManifest(ctx context.Context, blobs distribution.BlobStore, dgst digest.Digest, manifest distribution.Manifest, partitions []tdfs.Partition) (tdfsPreviewAPIManifest, error) {
+	previewed := tdfsPreviewAPIManifest{
+		Digest:           dgst,
+		PartitionPreview: tdfs.PartitionPreview{Allotments: []distribution.Descriptor{}},
+	}
+
+	ociManifest, ok := manifest.(*ocischema.DeserializedManifest)
+	if !ok {
+		return previewed, nil
+	}
+	preview, err := tdfs.PreviewTdfsManifest(ctx, ociManifest, blobs, partitions)
+	if err != nil {
+		return previewed, err
+	}
+	previewed.PartitionPreview = preview
+	return previewed, nil
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/2DFS/2dfs-registry/v3/manifest/tdfs"
+	"github.com/2DFS/2dfs-registry/v3/registry/api/errcode"
+	"github.com/distribution/reference"
+)
+
+// getTdfsPreview fetches the preview of the partitions of the tag in the
+// repository of image, adding the partitions of the header to the request.
+func getTdfsPreview(t *testing.T, env *testEnv, image tdfsImage, tag string, query url.Values, header string) *http.Response {
+	named, err := reference.WithTag(image.name, tag)
+	checkErr(t, err, "building tag reference")
+	previewURL, err := env.builder.BuildTdfsPreviewURL(named, query)
+	checkErr(t, err, "building preview url")
+
+	req, err := http.NewRequest(http.MethodGet, previewURL, nil)
+	checkErr(t, err, "building request")
+	if header != "" {
+		req.Header.Set(tdfs.PartitionHeader, header)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching preview")
+	return resp
+}
+
+func TestTdfsPreview(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 3)
+	recorder := &eventRecorder{}
+	env.app.events.sink = recorder
+
+	resp := getTdfsPreview(t, env, image, "v1--r1", url.Values{tdfs.PartitionQueryParam: []string{"0.0.0.0"}}, "")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching preview", resp, http.StatusOK)
+
+	var previewed tdfsPreviewAPIResponse
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&previewed), "decoding preview")
+	if previewed.Digest != image.indexDigest || previewed.Partitions != "0.0.0.0--1.0.1.*" {
+		t.Fatalf("unexpected image in preview: %+v", previewed)
+	}
+	if len(previewed.Manifests) != 1 || previewed.Manifests[0].Platform == nil || previewed.Manifests[0].Digest != image.manifestDigest {
+		t.Fatalf("unexpected manifests in preview: %+v", previewed.Manifests)
+	}
+
+	preview := previewed.Manifests[0]
+	expected := [][2]int{{0, 0}, {1, 0}, {1, 1}, {1, 2}}
+	if len(preview.Allotments) != len(expected) {
+		t.Fatalf("unexpected allotments in preview: %+v", preview.Allotments)
+	}
+	var allotmentsSize int64
+	for i, allotment := range preview.Allotments {
+		if allotment.Digest != image.allotments[expected[i][0]][expected[i][1]] || allotment.Size == 0 {
+			t.Fatalf("unexpected allotment %d in preview: %+v", i, allotment)
+		}
+		allotmentsSize += allotment.Size
+	}
+	if preview.AllotmentsSize != allotmentsSize || preview.Size != allotmentsSize+image.manifest.Layers[0].Size {
+		t.Fatalf("unexpected sizes in preview: %d, %d", preview.AllotmentsSize, preview.Size)
+	}
+
+	// previewing the image does not pull it
+	if actions := recorder.actions(); len(actions) != 0 {
+		t.Fatalf("unexpected events previewing the image: %v", actions)
+	}
+
+	// previews are not derived nor recorded
+	partitionIndex := env.app.registry.(distribution.PartitionIndexProvider).PartitionIndex(image.name)
+	if _, err := partitionIndex.Get(env.ctx, image.indexDigest, "v1@0.0.0.0--1.0.1.*"); err != distribution.ErrPartitionUnknown {
+		t.Fatalf("expected the preview not to be recorded, got %v", err)
+	}
+
+	// the preview matches the allotments of the partitioned manifest
+	index, _ := getPartitionedIndex(t, env, image, "v1--0.0.0.0--r1")
+	resp = getTdfsManifest(t, env, image, index.Manifests[0].Digest.String())
+	defer resp.Body.Close()
+	checkResponse(t, "fetching partitioned manifest", resp, http.StatusOK)
+	var partitioned ocischema.DeserializedManifest
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&partitioned), "decoding partitioned manifest")
+	if !reflect.DeepEqual(partitioned.Layers[1:], preview.Allotments) {
+		t.Fatalf("preview does not match the partitioned manifest: %+v != %+v", preview.Allotments, partitioned.Layers[1:])
+	}
+
+	// plain tags may contain the partition separator as well
+	plain := pushTdfsImage(t, env, "foo/tdfs", "release--candidate", 1, 1)
+	resp = getTdfsPreview(t, env, plain, "release--candidate", nil, "")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching preview of a plain tag", resp, http.StatusOK)
+	previewed = tdfsPreviewAPIResponse{}
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&previewed), "decoding preview of a plain tag")
+	if previewed.Digest != plain.indexDigest || previewed.Partitions != "" {
+		t.Fatalf("unexpected image in preview of a plain tag: %+v", previewed)
+	}
+}
+
+func TestTdfsPreviewInvalid(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	image := pushTdfsImage(t, env, "foo/tdfs", "v1", 2, 2)
+
+	for _, testcase := range []struct {
+		tag    string
+		header string
+		status int
+		code   errcode.ErrorCode
+	}{
+		{tag: "v1--0.0", status: http.StatusBadRequest, code: errcode.ErrorCodePartitionInvalid},
+		{tag: "v1", header: "r", status: http.StatusBadRequest, code: errcode.ErrorCodePartitionInvalid},
+		{tag: "v1--r5", status: http.StatusBadRequest, code: errcode.ErrorCodePartitionInvalid},
+		{tag: "v2--r0", status: http.StatusNotFound, code: errcode.ErrorCodeManifestUnknown},
+	} {
+		resp := getTdfsPreview(t, env, image, testcase.tag, nil, testcase.header)
+		defer resp.Body.Close()
+		checkResponse(t, "fetching preview of "+testcase.tag, resp, testcase.status)
+		checkBodyHasErrorCodes(t, "fetching preview of "+testcase.tag, resp, testcase.code)
+	}
+}
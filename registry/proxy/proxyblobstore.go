@@ -186,6 +186,38 @@ func (pbs *proxyBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte,
 	return blob, nil
 }
 
+// Open opens the local blob, or the remote one if it is not cached yet.
+// Remote blobs are read lazily and are not cached, so that reading a few
+// bytes of a blob, such as the header of a 2dfs allotment, does not
+// download it. Blobs are cached when served to clients.
+func (pbs *proxyBlobStore) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	rsc, err := pbs.localStore.Open(ctx, dgst)
+	if err == nil {
+		return rsc, nil
+	}
+
+	if err != distribution.ErrBlobUnknown {
+		return nil, err
+	}
+
+	if err := pbs.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return nil, err
+	}
+
+	return pbs.remoteStore.Open(ctx, dgst)
+}
+
+// SetDescriptor records desc for the blob dgst if it is cached locally.
+// Descriptors of remote blobs are not recorded, as that would make them look
+// cached.
+func (pbs *proxyBlobStore) SetDescriptor(ctx context.Context, dgst digest.Digest, desc v1.Descriptor) error {
+	setter, ok := pbs.localStore.(distribution.BlobDescriptorSetter)
+	if !ok {
+		return distribution.ErrUnsupported
+	}
+	return setter.SetDescriptor(ctx, dgst, desc)
+}
+
 // Unsupported functions
 func (pbs *proxyBlobStore) Put(ctx context.Context, mediaType string, p []byte) (v1.Descriptor, error) {
 	return v1.Descriptor{}, distribution.ErrUnsupported
@@ -203,10 +235,6 @@ func (pbs *proxyBlobStore) Mount(ctx context.Context, sourceRepo reference.Named
 	return v1.Descriptor{}, distribution.ErrUnsupported
 }
 
-func (pbs *proxyBlobStore) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
-	return nil, distribution.ErrUnsupported
-}
-
 func (pbs *proxyBlobStore) Delete(ctx context.Context, dgst digest.Digest) error {
 	return distribution.ErrUnsupported
 }
@@ -297,6 +297,53 @@ func TestProxyStoreStat(t *testing.T) {
 	}
 }
 
+func TestProxyStoreOpen(t *testing.T) {
+	te := makeTestEnv(t, "foo/bar")
+
+	populate(t, te, 1, 10, 1)
+
+	localStats := te.LocalStats()
+	remoteStats := te.RemoteStats()
+
+	// remote blobs are read without being cached
+	rsc, err := te.store.Open(te.ctx, te.inRemote[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(rsc, header); err != nil {
+		t.Fatal(err)
+	}
+	rsc.Close()
+
+	if (*remoteStats)["open"] != 1 {
+		t.Errorf("Unexpected remote open count")
+	}
+	if (*localStats)["put"] != 0 || (*localStats)["create"] != 0 {
+		t.Errorf("Unexpected local counts")
+	}
+	if _, err := te.store.localStore.Stat(te.ctx, te.inRemote[0].Digest); err != distribution.ErrBlobUnknown {
+		t.Errorf("Expected the opened blob not to be cached, got %v", err)
+	}
+
+	// cached blobs are read locally
+	if _, err := te.store.Get(te.ctx, te.inRemote[0].Digest); err != nil {
+		t.Fatal(err)
+	}
+	rsc, err = te.store.Open(te.ctx, te.inRemote[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsc.Close()
+
+	if (*remoteStats)["open"] != 1 {
+		t.Errorf("Unexpected remote open count")
+	}
+	if (*localStats)["open"] != 2 {
+		t.Errorf("Unexpected local open count")
+	}
+}
+
 func TestProxyStoreServeHighConcurrency(t *testing.T) {
 	te := makeTestEnv(t, "foo/bar")
 	blobSize := 200
@@ -3,9 +3,12 @@
 package cache
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -17,6 +20,24 @@ type BlobDescriptorCacheProvider interface {
 	RepositoryScoped(repo string) (distribution.BlobDescriptorService, error)
 }
 
+// DefaultDerivedContentTTL is the default time derived content is cached for
+// if no time to live is explicitly configured.
+const DefaultDerivedContentTTL = 10 * time.Minute
+
+// DerivedContentCache holds content derived from the stored content without
+// being persisted to the storage backend, such as the manifests partitioned by
+// read-only registries. Entries are scoped to a repository and expire after
+// the time to live of the cache.
+type DerivedContentCache interface {
+	// Get returns the descriptor and the content cached for dgst in repo. If
+	// the content is not cached, distribution.ErrBlobUnknown is returned.
+	Get(ctx context.Context, repo string, dgst digest.Digest) (v1.Descriptor, []byte, error)
+
+	// Put caches the content of the given media type in repo and returns
+	// its descriptor.
+	Put(ctx context.Context, repo string, mediaType string, content []byte) (v1.Descriptor, error)
+}
+
 // ValidateDescriptor provides a helper function to ensure that caches have
 // common criteria for admitting descriptors.
 func ValidateDescriptor(desc v1.Descriptor) error {
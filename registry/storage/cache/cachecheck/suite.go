@@ -186,3 +186,59 @@ func checkBlobDescriptorCacheClear(ctx context.Context, t *testing.T, provider c
 		t.Fatalf("expected error statting deleted blob: %v", err)
 	}
 }
+
+// CheckDerivedContentCache takes a derived content cache implementation
+// through a common set of operations.
+func CheckDerivedContentCache(t *testing.T, derived cache.DerivedContentCache) {
+	ctx := context.Background()
+
+	checkDerivedContentCacheEmpty(ctx, t, derived)
+	checkDerivedContentCachePutAndGet(ctx, t, derived)
+}
+
+func checkDerivedContentCacheEmpty(ctx context.Context, t *testing.T, derived cache.DerivedContentCache) {
+	if _, _, err := derived.Get(ctx, "foo/bar", digest.FromString("unknown")); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected unknown blob error with empty cache: %v", err)
+	}
+
+	if _, _, err := derived.Get(ctx, "foo/bar", ""); err != digest.ErrDigestInvalidFormat {
+		t.Fatalf("expected error getting content with empty digest: %v", err)
+	}
+
+	if _, err := derived.Put(ctx, "foo/bar", "", []byte("content")); err == nil {
+		t.Fatal("expected error putting content without media type")
+	}
+}
+
+func checkDerivedContentCachePutAndGet(ctx context.Context, t *testing.T, derived cache.DerivedContentCache) {
+	content := []byte(`{"schemaVersion":2}`)
+	expected := v1.Descriptor{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+
+	desc, err := derived.Put(ctx, "foo/bar", v1.MediaTypeImageManifest, content)
+	if err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	if !reflect.DeepEqual(desc, expected) {
+		t.Fatalf("unexpected descriptor: %#v != %#v", desc, expected)
+	}
+
+	desc, cached, err := derived.Get(ctx, "foo/bar", expected.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting content: %v", err)
+	}
+	if !reflect.DeepEqual(desc, expected) {
+		t.Fatalf("unexpected descriptor: %#v != %#v", desc, expected)
+	}
+	if string(cached) != string(content) {
+		t.Fatalf("unexpected content: %q != %q", cached, content)
+	}
+
+	// content is scoped to the repository it was derived in
+	if _, _, err := derived.Get(ctx, "foo/baz", expected.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected unknown blob error in another repository: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package memory
+
+import (
+	"context"
+	"math"
+	"time"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/cache"
+	"github.com/hashicorp/golang-lru/arc/v2"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultDerivedContentSize is the default number of derived contents cached
+// if no size is explicitly configured.
+const DefaultDerivedContentSize = 1000
+
+type derivedContent struct {
+	mediaType string
+	content   []byte
+	expires   time.Time
+}
+
+type inMemoryDerivedContentCache struct {
+	lru *arc.ARCCache[descriptorCacheKey, derivedContent]
+	ttl time.Duration
+}
+
+// NewInMemoryDerivedContentCache returns a new in memory cache holding up to
+// size derived contents for ttl.
+func NewInMemoryDerivedContentCache(size int, ttl time.Duration) cache.DerivedContentCache {
+	if size <= 0 {
+		size = math.MaxInt
+	}
+	lruCache, err := arc.NewARC[descriptorCacheKey, derivedContent](size)
+	if err != nil {
+		// NewARC can only fail if size is <= 0, so this unreachable
+		panic(err)
+	}
+	return &inMemoryDerivedContentCache{
+		lru: lruCache,
+		ttl: ttl,
+	}
+}
+
+func (imdcc *inMemoryDerivedContentCache) Get(ctx context.Context, repo string, dgst digest.Digest) (v1.Descriptor, []byte, error) {
+	if err := dgst.Validate(); err != nil {
+		return v1.Descriptor{}, nil, err
+	}
+
+	key := descriptorCacheKey{
+		digest: dgst,
+		repo:   repo,
+	}
+	derived, ok := imdcc.lru.Get(key)
+	if !ok {
+		return v1.Descriptor{}, nil, distribution.ErrBlobUnknown
+	}
+	if time.Now().After(derived.expires) {
+		imdcc.lru.Remove(key)
+		return v1.Descriptor{}, nil, distribution.ErrBlobUnknown
+	}
+
+	return v1.Descriptor{
+		MediaType: derived.mediaType,
+		Digest:    dgst,
+		Size:      int64(len(derived.content)),
+	}, derived.content, nil
+}
+
+func (imdcc *inMemoryDerivedContentCache) Put(ctx context.Context, repo string, mediaType string, content []byte) (v1.Descriptor, error) {
+	desc := v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	if err := cache.ValidateDescriptor(desc); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	key := descriptorCacheKey{
+		digest: desc.Digest,
+		repo:   repo,
+	}
+	imdcc.lru.Add(key, derivedContent{
+		mediaType: mediaType,
+		content:   content,
+		expires:   time.Now().Add(imdcc.ttl),
+	})
+	return desc, nil
+}
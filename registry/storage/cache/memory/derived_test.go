@@ -0,0 +1,34 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/cache"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/cache/cachecheck"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestInMemoryDerivedContentCache checks the in memory implementation is
+// working correctly.
+func TestInMemoryDerivedContentCache(t *testing.T) {
+	cachecheck.CheckDerivedContentCache(t, NewInMemoryDerivedContentCache(UnlimitedSize, cache.DefaultDerivedContentTTL))
+}
+
+// TestInMemoryDerivedContentCacheExpiry checks that cached content expires.
+func TestInMemoryDerivedContentCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	derived := NewInMemoryDerivedContentCache(UnlimitedSize, time.Millisecond)
+
+	desc, err := derived.Put(ctx, "foo/bar", v1.MediaTypeImageManifest, []byte("manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if _, _, err := derived.Get(ctx, "foo/bar", desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected expired content to be unknown: %v", err)
+	}
+}
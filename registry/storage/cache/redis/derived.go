@@ -0,0 +1,89 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/cache"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisDerivedContentCache provides an implementation of DerivedContentCache
+// based on redis. Every derived content is stored in a redis hash holding its
+// media type and content, which expires after the time to live of the cache.
+type redisDerivedContentCache struct {
+	pool redis.UniversalClient
+	ttl  time.Duration
+}
+
+var _ cache.DerivedContentCache = &redisDerivedContentCache{}
+
+// NewRedisDerivedContentCache returns a new redis-based DerivedContentCache
+// using the provided redis connection pool and holding content for ttl.
+func NewRedisDerivedContentCache(pool redis.UniversalClient, ttl time.Duration) cache.DerivedContentCache {
+	return &redisDerivedContentCache{
+		pool: pool,
+		ttl:  ttl,
+	}
+}
+
+// Get retrieves the derived content from the redis hash entry.
+func (rdcc *redisDerivedContentCache) Get(ctx context.Context, repo string, dgst digest.Digest) (v1.Descriptor, []byte, error) {
+	if err := dgst.Validate(); err != nil {
+		return v1.Descriptor{}, nil, err
+	}
+
+	reply, err := rdcc.pool.HMGet(ctx, rdcc.derivedContentHashKey(repo, dgst), "mediatype", "content").Result()
+	if err != nil {
+		return v1.Descriptor{}, nil, err
+	}
+	if len(reply) < 2 || reply[0] == nil || reply[1] == nil {
+		return v1.Descriptor{}, nil, distribution.ErrBlobUnknown
+	}
+
+	mediaType, ok := reply[0].(string)
+	if !ok {
+		return v1.Descriptor{}, nil, distribution.ErrBlobUnknown
+	}
+	content, ok := reply[1].(string)
+	if !ok {
+		return v1.Descriptor{}, nil, distribution.ErrBlobUnknown
+	}
+
+	return v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(content)),
+	}, []byte(content), nil
+}
+
+// Put stores the derived content in a redis hash expiring after the time to
+// live of the cache.
+func (rdcc *redisDerivedContentCache) Put(ctx context.Context, repo string, mediaType string, content []byte) (v1.Descriptor, error) {
+	desc := v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	if err := cache.ValidateDescriptor(desc); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	key := rdcc.derivedContentHashKey(repo, desc.Digest)
+	_, err := rdcc.pool.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "mediatype", mediaType, "content", content)
+		pipe.Expire(ctx, key, rdcc.ttl)
+		return nil
+	})
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func (rdcc *redisDerivedContentCache) derivedContentHashKey(repo string, dgst digest.Digest) string {
+	return "repository::" + repo + "::derived::" + dgst.String()
+}
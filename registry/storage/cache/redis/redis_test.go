@@ -6,6 +6,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/cache"
 	"github.com/2DFS/2dfs-registry/v3/registry/storage/cache/cachecheck"
 	"github.com/redis/go-redis/v9"
 )
@@ -48,3 +49,32 @@ func TestRedisBlobDescriptorCacheProvider(t *testing.T) {
 
 	cachecheck.CheckBlobDescriptorCache(t, NewRedisBlobDescriptorCacheProvider(pool))
 }
+
+// TestRedisDerivedContentCache exercises a live redis instance using the
+// derived content cache implementation.
+func TestRedisDerivedContentCache(t *testing.T) {
+	if redisAddr == "" {
+		// fallback to an environment variable
+		redisAddr = os.Getenv("TEST_REGISTRY_STORAGE_CACHE_REDIS_ADDR")
+	}
+
+	if redisAddr == "" {
+		// skip if still not set
+		t.Skip("please set -test.registry.storage.cache.redis.addr to test derived content cache against redis")
+	}
+
+	pool := redis.NewClient(&redis.Options{
+		Addr:       redisAddr,
+		MaxRetries: 3,
+		PoolSize:   2,
+	})
+
+	// Clear the database
+	ctx := context.Background()
+	err := pool.FlushDB(ctx).Err()
+	if err != nil {
+		t.Fatalf("unexpected error flushing redis db: %v", err)
+	}
+
+	cachecheck.CheckDerivedContentCache(t, NewRedisDerivedContentCache(pool, cache.DefaultDerivedContentTTL))
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+var _ distribution.FlattenIndex = &flattenIndex{}
+
+// flattenIndex persists the layers flattened from sets of allotments as
+// links under the repository's flattened directory.
+type flattenIndex struct {
+	name      string
+	blobStore *blobStore
+}
+
+// FlattenIndex returns the index of the layers flattened from allotments in
+// the named repository.
+func (reg *registry) FlattenIndex(name reference.Named) distribution.FlattenIndex {
+	return &flattenIndex{
+		name:      name.Name(),
+		blobStore: reg.blobStore,
+	}
+}
+
+// Get returns the digest and diffID of the layer flattened from the
+// allotments identified by key.
+func (fi *flattenIndex) Get(ctx context.Context, key digest.Digest) (digest.Digest, digest.Digest, error) {
+	linkPath, err := pathFor(flattenedLayerLinkPathSpec{name: fi.name, key: key})
+	if err != nil {
+		return "", "", err
+	}
+	diffIDPath, err := pathFor(flattenedLayerDiffIDPathSpec{name: fi.name, key: key})
+	if err != nil {
+		return "", "", err
+	}
+
+	layer, err := fi.blobStore.readlink(ctx, linkPath)
+	if err != nil {
+		switch err.(type) {
+		case driver.PathNotFoundError:
+			return "", "", distribution.ErrFlattenUnknown
+		}
+		return "", "", err
+	}
+	diffID, err := fi.blobStore.readlink(ctx, diffIDPath)
+	if err != nil {
+		switch err.(type) {
+		case driver.PathNotFoundError:
+			return "", "", distribution.ErrFlattenUnknown
+		}
+		return "", "", err
+	}
+
+	return layer, diffID, nil
+}
+
+// Set links layer as the layer flattened from the allotments identified by
+// key. The diffID is written first, so that a link is only found once its
+// diffID is.
+func (fi *flattenIndex) Set(ctx context.Context, key digest.Digest, layer digest.Digest, diffID digest.Digest) error {
+	linkPath, err := pathFor(flattenedLayerLinkPathSpec{name: fi.name, key: key})
+	if err != nil {
+		return err
+	}
+	diffIDPath, err := pathFor(flattenedLayerDiffIDPathSpec{name: fi.name, key: key})
+	if err != nil {
+		return err
+	}
+
+	if err := fi.blobStore.link(ctx, diffIDPath, diffID); err != nil {
+		return err
+	}
+	return fi.blobStore.link(ctx, linkPath, layer)
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestFlattenIndex(t *testing.T) {
+	ctx := context.Background()
+	reg, err := NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, _ := reference.WithName("a/b")
+	fi := reg.(distribution.FlattenIndexProvider).FlattenIndex(name)
+
+	key := digest.FromString("allotments")
+	layer := digest.FromString("layer")
+	diffID := digest.FromString("diffID")
+
+	if _, _, err := fi.Get(ctx, key); err != distribution.ErrFlattenUnknown {
+		t.Fatalf("expected ErrFlattenUnknown, got %v", err)
+	}
+
+	if err := fi.Set(ctx, key, layer, diffID); err != nil {
+		t.Fatal(err)
+	}
+	gotLayer, gotDiffID, err := fi.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotLayer != layer || gotDiffID != diffID {
+		t.Fatalf("unexpected flattened layer: %s, %s", gotLayer, gotDiffID)
+	}
+
+	// flattened layers are recorded by repository
+	other, _ := reference.WithName("a/c")
+	if _, _, err := reg.(distribution.FlattenIndexProvider).FlattenIndex(other).Get(ctx, key); err != distribution.ErrFlattenUnknown {
+		t.Fatalf("expected ErrFlattenUnknown in another repository, got %v", err)
+	}
+}
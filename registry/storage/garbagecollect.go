@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"path"
 
+	tdfsfilesystem "github.com/2DFS/2dfs-builder/filesystem"
 	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/manifest/tdfs"
 	"github.com/2DFS/2dfs-registry/v3/registry/storage/driver"
 	"github.com/distribution/reference"
 	"github.com/opencontainers/go-digest"
@@ -40,6 +43,7 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 	// mark
 	markSet := make(map[digest.Digest]struct{})
 	deleteLayerSet := make(map[string][]digest.Digest)
+	deleteLinkSet := make(map[string][]string)
 	manifestArr := make([]ManifestDel, 0)
 	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
 		if !opts.Quiet {
@@ -97,7 +101,7 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 			}
 			markSet[dgst] = struct{}{}
 
-			return markManifestReferences(dgst, manifestService, ctx, func(d digest.Digest) bool {
+			return markManifestReferences(dgst, manifestService, repository.Blobs(ctx), ctx, func(d digest.Digest) bool {
 				_, marked := markSet[d]
 				if !marked {
 					markSet[d] = struct{}{}
@@ -135,6 +139,14 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 		if len(deleteLayers) > 0 {
 			deleteLayerSet[repoName] = deleteLayers
 		}
+		if err != nil {
+			return err
+		}
+
+		deleteLinks, err := unmarkedLinks(ctx, storageDriver, repoName, markSet)
+		if len(deleteLinks) > 0 {
+			deleteLinkSet[repoName] = deleteLinks
+		}
 		return err
 	})
 	if err != nil {
@@ -196,6 +208,89 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 		}
 	}
 
+	for repo, dirs := range deleteLinkSet {
+		for _, dir := range dirs {
+			if !opts.Quiet {
+				emit("%s: derived link eligible for deletion: %s", repo, dir)
+			}
+			if opts.DryRun {
+				continue
+			}
+			err = vacuum.RemoveLink(dir)
+			if err != nil {
+				return fmt.Errorf("failed to delete derived link %s of repo %s: %v", dir, repo, err)
+			}
+		}
+	}
+
+	return err
+}
+
+// unmarkedLinks returns the directories of the partition and flattened layer
+// links of the repository whose source manifest or target is not marked.
+// These links never keep their targets alive, they are swept along with them.
+func unmarkedLinks(ctx context.Context, storageDriver driver.StorageDriver, repoName string, markSet map[digest.Digest]struct{}) ([]string, error) {
+	var dirs []string
+
+	partitionsPath, err := pathFor(manifestPartitionSourcesPathSpec{name: repoName})
+	if err != nil {
+		return nil, err
+	}
+	err = walkLinks(ctx, storageDriver, partitionsPath, func(dir string, target digest.Digest) error {
+		// <source digest path>/<partition set digest path>/link
+		source, err := digestFromPath(path.Dir(path.Dir(dir)))
+		if err != nil {
+			return fmt.Errorf("failed to parse source manifest of partition link %s: %v", dir, err)
+		}
+		_, sourceMarked := markSet[source]
+		_, targetMarked := markSet[target]
+		if !sourceMarked || !targetMarked {
+			dirs = append(dirs, dir)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	flattenedPath, err := pathFor(flattenedLayersPathSpec{name: repoName})
+	if err != nil {
+		return nil, err
+	}
+	err = walkLinks(ctx, storageDriver, flattenedPath, func(dir string, target digest.Digest) error {
+		if _, ok := markSet[target]; !ok {
+			dirs = append(dirs, dir)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dirs, nil
+}
+
+// walkLinks calls ingester with the directory and the target of every link
+// found under root. A missing root has no links.
+func walkLinks(ctx context.Context, storageDriver driver.StorageDriver, root string, ingester func(dir string, target digest.Digest) error) error {
+	err := storageDriver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() || path.Base(fileInfo.Path()) != "link" {
+			return nil
+		}
+
+		content, err := storageDriver.GetContent(ctx, fileInfo.Path())
+		if err != nil {
+			return err
+		}
+		target, err := digest.Parse(string(content))
+		if err != nil {
+			return fmt.Errorf("failed to parse link %s: %v", fileInfo.Path(), err)
+		}
+		return ingester(path.Dir(fileInfo.Path()), target)
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil
+	}
 	return err
 }
 
@@ -214,8 +309,10 @@ func unmarkReferencedManifest(manifestArr []ManifestDel, markSet map[digest.Dige
 	return filtered
 }
 
-// markManifestReferences marks the manifest references
-func markManifestReferences(dgst digest.Digest, manifestService distribution.ManifestService, ctx context.Context, ingester func(digest.Digest) bool) error {
+// markManifestReferences marks the manifest references. Allotments listed by
+// 2dfs field layers are marked as well, since they are not referenced by the
+// manifest directly.
+func markManifestReferences(dgst digest.Digest, manifestService distribution.ManifestService, blobService distribution.BlobProvider, ctx context.Context, ingester func(digest.Digest) bool) error {
 	manifest, err := manifestService.Get(ctx, dgst)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve manifest for digest %v: %v", dgst, err)
@@ -229,8 +326,15 @@ func markManifestReferences(dgst digest.Digest, manifestService distribution.Man
 			continue
 		}
 
+		if descriptor.MediaType == tdfs.MediaTypeTdfsLayer {
+			if err := markFieldAllotments(descriptor.Digest, blobService, ctx, ingester); err != nil {
+				return err
+			}
+			continue
+		}
+
 		if ok, _ := manifestService.Exists(ctx, descriptor.Digest); ok {
-			err := markManifestReferences(descriptor.Digest, manifestService, ctx, ingester)
+			err := markManifestReferences(descriptor.Digest, manifestService, blobService, ctx, ingester)
 			if err != nil {
 				return err
 			}
@@ -238,3 +342,30 @@ func markManifestReferences(dgst digest.Digest, manifestService distribution.Man
 	}
 	return nil
 }
+
+// markFieldAllotments marks every allotment blob listed by the 2dfs field
+// stored at dgst.
+func markFieldAllotments(dgst digest.Digest, blobService distribution.BlobProvider, ctx context.Context, ingester func(digest.Digest) bool) error {
+	content, err := blobService.Get(ctx, dgst)
+	if err != nil {
+		if err == distribution.ErrBlobUnknown {
+			// nothing left to protect, the field itself is gone
+			return nil
+		}
+		return fmt.Errorf("failed to retrieve 2dfs field %v: %v", dgst, err)
+	}
+
+	field, err := tdfsfilesystem.GetField().Unmarshal(string(content))
+	if err != nil {
+		return fmt.Errorf("failed to parse 2dfs field %v: %v", dgst, err)
+	}
+
+	for allotment := range field.IterateAllotments() {
+		// skip empty allotments
+		if allotment.Digest == "" {
+			continue
+		}
+		ingester(tdfs.AllotmentDigest(allotment))
+	}
+	return nil
+}
@@ -5,9 +5,11 @@ import (
 	"path"
 	"testing"
 
+	tdfsfilesystem "github.com/2DFS/2dfs-builder/filesystem"
 	distribution "github.com/2DFS/2dfs-registry/v3"
 	"github.com/2DFS/2dfs-registry/v3/internal/dcontext"
 	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/2DFS/2dfs-registry/v3/manifest/tdfs"
 	"github.com/2DFS/2dfs-registry/v3/registry/storage/driver"
 	storagedriver "github.com/2DFS/2dfs-registry/v3/registry/storage/driver"
 	"github.com/2DFS/2dfs-registry/v3/registry/storage/driver/inmemory"
@@ -923,3 +925,167 @@ func TestTaggedManifestlistWithDeletedReference(t *testing.T) {
 		t.Fatalf("Garbage collection affected storage: %d != %d", len(after), 0)
 	}
 }
+
+func TestTdfsFieldAllotmentsMarked(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "tdfs/field")
+	manifestService := makeManifestService(t, repo)
+
+	allotments, err := testutil.CreateRandomLayers(2)
+	if err != nil {
+		t.Fatalf("failed to make layers: %v", err)
+	}
+	err = testutil.UploadBlobs(repo, allotments)
+	if err != nil {
+		t.Fatalf("failed to upload layers: %v", err)
+	}
+
+	field := tdfsfilesystem.GetField()
+	col := 0
+	for dgst := range allotments {
+		field.AddAllotment(tdfsfilesystem.Allotment{
+			Row:    0,
+			Col:    col,
+			Digest: dgst.Encoded(),
+			DiffID: dgst.Encoded(),
+		})
+		col++
+	}
+	fieldDesc, err := repo.Blobs(ctx).Put(ctx, tdfs.MediaTypeTdfsLayer, []byte(field.Marshal()))
+	if err != nil {
+		t.Fatalf("failed to upload field: %v", err)
+	}
+	fieldDesc.MediaType = tdfs.MediaTypeTdfsLayer
+
+	builder := ocischema.NewManifestBuilder(repo.Blobs(ctx), []byte("{}"), map[string]string{})
+	if err := builder.AppendReference(fieldDesc); err != nil {
+		t.Fatalf("failed to append field: %v", err)
+	}
+	manifest, err := builder.Build(ctx)
+	if err != nil {
+		t.Fatalf("failed to build manifest: %v", err)
+	}
+	dgst, err := manifestService.Put(ctx, manifest)
+	if err != nil {
+		t.Fatalf("manifest upload failed: %v", err)
+	}
+	err = repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: dgst})
+	if err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+
+	// an unrelated layer which must still be collected
+	orphan := uploadRandomOCIImage(t, repo)
+	if err := manifestService.Delete(ctx, orphan.manifestDigest); err != nil {
+		t.Fatalf("failed to delete image: %v", err)
+	}
+
+	err = MarkAndSweep(dcontext.Background(), inmemoryDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	after := allBlobs(t, registry)
+	for dgst := range allotments {
+		if _, ok := after[dgst]; !ok {
+			t.Fatalf("allotment %s was garbage collected", dgst)
+		}
+		if _, err := repo.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Fatalf("allotment %s is no longer linked in repository: %v", dgst, err)
+		}
+	}
+	if _, ok := after[fieldDesc.Digest]; !ok {
+		t.Fatalf("field %s was garbage collected", fieldDesc.Digest)
+	}
+	for dgst := range orphan.layers {
+		if _, ok := after[dgst]; ok {
+			t.Fatalf("orphan layer %s was not garbage collected", dgst)
+		}
+	}
+}
+
+func TestDerivedLinksSwept(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "tdfs/derived")
+	partitions := registry.(distribution.PartitionIndexProvider).PartitionIndex(repo.Named())
+	flattened := registry.(distribution.FlattenIndexProvider).FlattenIndex(repo.Named())
+
+	source := uploadRandomOCIImage(t, repo)
+	kept := uploadRandomOCIImage(t, repo)
+	for tag, dgst := range map[string]digest.Digest{"source": source.manifestDigest, "kept": kept.manifestDigest} {
+		if err := repo.Tags(ctx).Tag(ctx, tag, v1.Descriptor{Digest: dgst}); err != nil {
+			t.Fatalf("failed to tag manifest: %v", err)
+		}
+	}
+	// neither the untagged derived manifest nor the untagged source survive
+	collected := uploadRandomOCIImage(t, repo)
+	untaggedSource := uploadRandomOCIImage(t, repo)
+
+	links := map[string]struct {
+		source  digest.Digest
+		derived digest.Digest
+		kept    bool
+	}{
+		"0.0.0.0": {source.manifestDigest, kept.manifestDigest, true},
+		"0.0.1.1": {source.manifestDigest, collected.manifestDigest, false},
+		"1.1.1.1": {untaggedSource.manifestDigest, kept.manifestDigest, false},
+	}
+	for set, link := range links {
+		if err := partitions.Set(ctx, link.source, set, link.derived); err != nil {
+			t.Fatalf("failed to link partition %s: %v", set, err)
+		}
+	}
+
+	var keptLayer, collectedLayer digest.Digest
+	for dgst := range kept.layers {
+		keptLayer = dgst
+	}
+	for dgst := range collected.layers {
+		collectedLayer = dgst
+	}
+	keptKey, collectedKey := digest.FromString("kept"), digest.FromString("collected")
+	if err := flattened.Set(ctx, keptKey, keptLayer, keptLayer); err != nil {
+		t.Fatalf("failed to link flattened layer: %v", err)
+	}
+	if err := flattened.Set(ctx, collectedKey, collectedLayer, collectedLayer); err != nil {
+		t.Fatalf("failed to link flattened layer: %v", err)
+	}
+
+	err := MarkAndSweep(dcontext.Background(), inmemoryDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	for set, link := range links {
+		derived, err := partitions.Get(ctx, link.source, set)
+		switch {
+		case link.kept && (err != nil || derived != link.derived):
+			t.Fatalf("partition link %s was swept: %v", set, err)
+		case !link.kept && err != distribution.ErrPartitionUnknown:
+			t.Fatalf("partition link %s was not swept: %v", set, err)
+		}
+	}
+	if layer, _, err := flattened.Get(ctx, keptKey); err != nil || layer != keptLayer {
+		t.Fatalf("flattened layer link was swept: %v", err)
+	}
+	if _, _, err := flattened.Get(ctx, collectedKey); err != distribution.ErrFlattenUnknown {
+		t.Fatalf("flattened layer link was not swept: %v", err)
+	}
+
+	// collecting again does not trip over the swept links
+	if err := MarkAndSweep(dcontext.Background(), inmemoryDriver, registry, GCOpts{RemoveUntagged: true}); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+}
@@ -44,7 +44,10 @@ type linkedBlobStore struct {
 	linkDirectoryPathSpec pathSpec
 }
 
-var _ distribution.BlobStore = &linkedBlobStore{}
+var (
+	_ distribution.BlobStore            = &linkedBlobStore{}
+	_ distribution.BlobDescriptorSetter = &linkedBlobStore{}
+)
 
 func (lbs *linkedBlobStore) Stat(ctx context.Context, dgst digest.Digest) (v1.Descriptor, error) {
 	return lbs.blobAccessController.Stat(ctx, dgst)
@@ -82,6 +85,17 @@ func (lbs *linkedBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter
 	return lbs.blobServer.ServeBlob(ctx, w, r, canonical.Digest)
 }
 
+// SetDescriptor records desc for the blob dgst of the repository in the blob
+// descriptor cache, if one is configured. Descriptors are otherwise only set
+// when blobs are committed.
+func (lbs *linkedBlobStore) SetDescriptor(ctx context.Context, dgst digest.Digest, desc v1.Descriptor) error {
+	if _, err := lbs.Stat(ctx, dgst); err != nil { // access check
+		return err
+	}
+
+	return lbs.blobAccessController.SetDescriptor(ctx, dgst, desc)
+}
+
 func (lbs *linkedBlobStore) Put(ctx context.Context, mediaType string, p []byte) (v1.Descriptor, error) {
 	dgst := digest.FromBytes(p)
 	// Place the data in the blob store first.
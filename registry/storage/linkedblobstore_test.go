@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/cache/memory"
 	"github.com/2DFS/2dfs-registry/v3/testutil"
 	"github.com/distribution/reference"
 	"github.com/opencontainers/go-digest"
@@ -263,3 +264,37 @@ func (f statCrossMountCreateOption) Apply(v interface{}) error {
 
 	return nil
 }
+
+func TestLinkedBlobStoreSetDescriptor(t *testing.T) {
+	fooRepoName, _ := reference.WithName("nm/foo")
+	fooEnv := newManifestStoreTestEnv(t, fooRepoName, "thetag",
+		BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)))
+	ctx := context.Background()
+
+	desc, err := fooEnv.repository.Blobs(ctx).Put(ctx, "application/octet-stream", []byte("layer"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+
+	setter, ok := fooEnv.repository.Blobs(ctx).(distribution.BlobDescriptorSetter)
+	if !ok {
+		t.Fatal("Blobs is not a BlobDescriptorSetter")
+	}
+	desc.MediaType = v1.MediaTypeImageLayerGzip
+	if err := setter.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+		t.Fatalf("unexpected error setting descriptor: %v", err)
+	}
+
+	stat, err := fooEnv.repository.Blobs(ctx).Stat(ctx, desc.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error stating blob: %v", err)
+	}
+	if stat.MediaType != v1.MediaTypeImageLayerGzip {
+		t.Fatalf("Expected the recorded media type %s, got %s", v1.MediaTypeImageLayerGzip, stat.MediaType)
+	}
+
+	// blobs unknown to the repository are not recorded
+	if err := setter.SetDescriptor(ctx, digest.FromString("unknown"), desc); err != distribution.ErrBlobUnknown {
+		t.Fatalf("Expected ErrBlobUnknown setting the descriptor of an unknown blob, got %v", err)
+	}
+}
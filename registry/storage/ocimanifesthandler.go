@@ -8,6 +8,7 @@ import (
 	distribution "github.com/2DFS/2dfs-registry/v3"
 	"github.com/2DFS/2dfs-registry/v3/internal/dcontext"
 	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/2DFS/2dfs-registry/v3/manifest/tdfs"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -109,6 +110,13 @@ func (ms *ocischemaManifestHandler) verifyManifest(ctx context.Context, mnfst oc
 				}
 			}
 
+		case tdfs.MediaTypeTdfsLayer:
+			// check the presence of the field and of every allotment it lists
+			_, err = blobsService.Stat(ctx, descriptor.Digest)
+			if err == nil {
+				errs = append(errs, ms.verifyField(ctx, descriptor.Digest)...)
+			}
+
 		case v1.MediaTypeImageManifest:
 			var exists bool
 			exists, err = manifestService.Exists(ctx, descriptor.Digest)
@@ -141,3 +149,38 @@ func (ms *ocischemaManifestHandler) verifyManifest(ctx context.Context, mnfst oc
 
 	return nil
 }
+
+// verifyField ensures that the 2dfs field stored at dgst is structurally valid
+// and that every allotment it references is present in the repository.
+func (ms *ocischemaManifestHandler) verifyField(ctx context.Context, dgst digest.Digest) []error {
+	blobsService := ms.repository.Blobs(ctx)
+
+	content, err := blobsService.Get(ctx, dgst)
+	if err != nil {
+		return []error{err}
+	}
+
+	field, err := tdfs.UnmarshalField(content)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for allotment := range field.IterateAllotments() {
+		// skip empty allotments
+		if allotment.Digest == "" {
+			continue
+		}
+
+		allotmentDigest := tdfs.AllotmentDigest(allotment)
+		if _, err := blobsService.Stat(ctx, allotmentDigest); err != nil {
+			if err != distribution.ErrBlobUnknown {
+				errs = append(errs, err)
+				continue
+			}
+			dcontext.GetLogger(ms.ctx).Debugf("allotment (%d,%d) of field %v is unknown", allotment.Row, allotment.Col, dgst)
+			errs = append(errs, distribution.ErrManifestBlobUnknown{Digest: allotmentDigest})
+		}
+	}
+	return errs
+}
@@ -2,12 +2,16 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"regexp"
 	"strings"
 	"testing"
 
+	tdfsfilesystem "github.com/2DFS/2dfs-builder/filesystem"
 	distribution "github.com/2DFS/2dfs-registry/v3"
 	"github.com/2DFS/2dfs-registry/v3/manifest/ocischema"
+	"github.com/2DFS/2dfs-registry/v3/manifest/tdfs"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/driver"
 	"github.com/2DFS/2dfs-registry/v3/registry/storage/driver/inmemory"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
@@ -328,3 +332,144 @@ func TestVerifyOCIManifestBlobLayerAndConfig(t *testing.T) {
 		checkFn(m, c.Err)
 	}
 }
+
+func TestVerifyOCIManifestTdfsField(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+
+	repo := makeRepository(t, registry, strings.ToLower(t.Name()))
+	manifestService := makeManifestService(t, repo)
+
+	config, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allotment, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayerGzip, []byte("allotment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := digest.FromBytes([]byte("missing allotment"))
+
+	putField := func(field string) v1.Descriptor {
+		desc, err := repo.Blobs(ctx).Put(ctx, tdfs.MediaTypeTdfsLayer, []byte(field))
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc.MediaType = tdfs.MediaTypeTdfsLayer
+		return desc
+	}
+
+	complete := tdfsfilesystem.GetField().
+		AddAllotment(tdfsfilesystem.Allotment{Row: 0, Col: 0, Digest: allotment.Digest.Encoded(), DiffID: allotment.Digest.Encoded()}).
+		AddAllotment(tdfsfilesystem.Allotment{Row: 1, Col: 1, Digest: allotment.Digest.Encoded(), DiffID: allotment.Digest.Encoded()})
+	incomplete := tdfsfilesystem.GetField().
+		AddAllotment(tdfsfilesystem.Allotment{Row: 0, Col: 0, Digest: allotment.Digest.Encoded(), DiffID: allotment.Digest.Encoded()}).
+		AddAllotment(tdfsfilesystem.Allotment{Row: 0, Col: 1, Digest: missing.Encoded(), DiffID: missing.Encoded()})
+
+	putManifest := func(field v1.Descriptor) error {
+		dm, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: v1.MediaTypeImageManifest,
+			Config:    config,
+			Layers:    []v1.Descriptor{field},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = manifestService.Put(ctx, dm)
+		return err
+	}
+
+	if err := putManifest(putField(complete.Marshal())); err != nil {
+		t.Fatalf("unexpected error putting manifest with complete field: %v", err)
+	}
+
+	err = putManifest(putField(incomplete.Marshal()))
+	verr, ok := err.(distribution.ErrManifestVerification)
+	if !ok || len(verr) != 1 {
+		t.Fatalf("expected a single verification error, got %v", err)
+	}
+	if verr[0] != (distribution.ErrManifestBlobUnknown{Digest: missing}) {
+		t.Fatalf("expected unknown allotment %s, got %v", missing, verr[0])
+	}
+
+	err = putManifest(putField(`{"rows":[{"allotments":[],"allotments_size":3}],"rows_size":1,"owner":""}`))
+	verr, ok = err.(distribution.ErrManifestVerification)
+	if !ok || len(verr) != 1 {
+		t.Fatalf("expected a single verification error, got %v", err)
+	}
+	if _, ok := verr[0].(tdfs.ErrFieldInvalid); !ok {
+		t.Fatalf("expected invalid field error, got %v", verr[0])
+	}
+
+	for _, field := range []string{
+		`{"rows":[{"allotments":[{"row":0,"col":0,"digest":"` + allotment.Digest.Encoded() + `","diffid":"not hex"}],"allotments_size":1}],"rows_size":1,"owner":""}`,
+		`{"rows":[{"allotments":[{"row":0,"col":1,"digest":"` + allotment.Digest.Encoded() + `","diffid":"` + allotment.Digest.Encoded() + `"}],"allotments_size":1}],"rows_size":1,"owner":""}`,
+	} {
+		err = putManifest(putField(field))
+		verr, ok = err.(distribution.ErrManifestVerification)
+		if !ok || len(verr) != 1 {
+			t.Fatalf("expected a single verification error, got %v", err)
+		}
+		if _, ok := verr[0].(tdfs.ErrFieldInvalid); !ok {
+			t.Fatalf("expected invalid field error, got %v", verr[0])
+		}
+	}
+}
+
+// brokenLinkDriver fails reading the links to the blob with the given
+// digest.
+type brokenLinkDriver struct {
+	driver.StorageDriver
+	dgst digest.Digest
+}
+
+func (d *brokenLinkDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if strings.Contains(path, d.dgst.Encoded()) {
+		return nil, errors.New("storage failure")
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func TestVerifyOCIManifestTdfsFieldStorageError(t *testing.T) {
+	ctx := context.Background()
+	broken := digest.FromBytes([]byte("broken allotment"))
+	registry := createRegistry(t, &brokenLinkDriver{StorageDriver: inmemory.New(), dgst: broken})
+
+	repo := makeRepository(t, registry, strings.ToLower(t.Name()))
+	manifestService := makeManifestService(t, repo)
+
+	config, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := tdfsfilesystem.GetField().
+		AddAllotment(tdfsfilesystem.Allotment{Row: 0, Col: 0, Digest: broken.Encoded(), DiffID: broken.Encoded()})
+	fieldDesc, err := repo.Blobs(ctx).Put(ctx, tdfs.MediaTypeTdfsLayer, []byte(field.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fieldDesc.MediaType = tdfs.MediaTypeTdfsLayer
+
+	dm, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []v1.Descriptor{fieldDesc},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// storage failures are not reported as unknown allotments
+	_, err = manifestService.Put(ctx, dm)
+	verr, ok := err.(distribution.ErrManifestVerification)
+	if !ok || len(verr) != 1 {
+		t.Fatalf("expected a single verification error, got %v", err)
+	}
+	if _, ok := verr[0].(distribution.ErrManifestBlobUnknown); ok {
+		t.Fatalf("expected the storage failure to be reported, got %v", verr[0])
+	}
+}
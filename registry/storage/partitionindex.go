@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+var _ distribution.PartitionIndex = &partitionIndex{}
+
+// partitionIndex persists the manifests derived from 2dfs source manifests
+// as links under the repository's manifest directory.
+type partitionIndex struct {
+	name      string
+	blobStore *blobStore
+}
+
+// PartitionIndex returns the index of manifests derived by partitioning in
+// the named repository.
+func (reg *registry) PartitionIndex(name reference.Named) distribution.PartitionIndex {
+	return &partitionIndex{
+		name:      name.Name(),
+		blobStore: reg.blobStore,
+	}
+}
+
+// Get returns the digest of the manifest derived from source for the
+// normalized partition set.
+func (pi *partitionIndex) Get(ctx context.Context, source digest.Digest, partitions string) (digest.Digest, error) {
+	linkPath, err := pathFor(manifestPartitionLinkPathSpec{
+		name:       pi.name,
+		source:     source,
+		partitions: partitions,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	derived, err := pi.blobStore.readlink(ctx, linkPath)
+	if err != nil {
+		switch err.(type) {
+		case driver.PathNotFoundError:
+			return "", distribution.ErrPartitionUnknown
+		}
+		return "", err
+	}
+
+	return derived, nil
+}
+
+// Set links derived as the manifest derived from source for the normalized
+// partition set.
+func (pi *partitionIndex) Set(ctx context.Context, source digest.Digest, partitions string, derived digest.Digest) error {
+	linkPath, err := pathFor(manifestPartitionLinkPathSpec{
+		name:       pi.name,
+		source:     source,
+		partitions: partitions,
+	})
+	if err != nil {
+		return err
+	}
+
+	return pi.blobStore.link(ctx, linkPath, derived)
+}
+
+// Clear removes every derived manifest link recorded for source.
+func (pi *partitionIndex) Clear(ctx context.Context, source digest.Digest) error {
+	partitionsPath, err := pathFor(manifestPartitionsPathSpec{
+		name:   pi.name,
+		source: source,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = pi.blobStore.driver.Delete(ctx, partitionsPath)
+	if err != nil {
+		switch err.(type) {
+		case driver.PathNotFoundError:
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
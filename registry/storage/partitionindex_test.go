@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	distribution "github.com/2DFS/2dfs-registry/v3"
+	"github.com/2DFS/2dfs-registry/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPartitionIndex(t *testing.T) {
+	ctx := context.Background()
+	reg, err := NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, _ := reference.WithName("a/b")
+	pi := reg.(distribution.PartitionIndexProvider).PartitionIndex(name)
+
+	source := digest.FromString("source")
+	derived := digest.FromString("derived")
+
+	if _, err := pi.Get(ctx, source, "0.0.1.1"); err != distribution.ErrPartitionUnknown {
+		t.Fatalf("expected ErrPartitionUnknown, got %v", err)
+	}
+
+	if err := pi.Set(ctx, source, "0.0.1.1", derived); err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := pi.Get(ctx, source, "0.0.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dgst != derived {
+		t.Fatalf("unexpected derived digest: %s != %s", dgst, derived)
+	}
+	if _, err := pi.Get(ctx, source, "0.0.2.2"); err != distribution.ErrPartitionUnknown {
+		t.Fatalf("expected ErrPartitionUnknown for another partition set, got %v", err)
+	}
+
+	if err := pi.Clear(ctx, source); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pi.Get(ctx, source, "0.0.1.1"); err != distribution.ErrPartitionUnknown {
+		t.Fatalf("expected ErrPartitionUnknown after clear, got %v", err)
+	}
+	// clearing twice is not an error
+	if err := pi.Clear(ctx, source); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionIndexClearedWhenTagMoves(t *testing.T) {
+	env := testTagStore(t)
+	ctx := env.ctx
+
+	first, err := env.bs.Put(ctx, v1.MediaTypeImageIndex, []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := env.bs.Put(ctx, v1.MediaTypeImageIndex, []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.ts.Tag(ctx, "latest", first); err != nil {
+		t.Fatal(err)
+	}
+
+	pi := env.ts.(*tagStore).repository.PartitionIndex(env.ts.(*tagStore).repository.Named())
+	derived := digest.FromString("derived")
+	if err := pi.Set(ctx, first.Digest, "0.0.1.1", derived); err != nil {
+		t.Fatal(err)
+	}
+
+	// tagging the same revision again keeps the derived manifests
+	if err := env.ts.Tag(ctx, "latest", first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pi.Get(ctx, first.Digest, "0.0.1.1"); err != nil {
+		t.Fatalf("unexpected error looking up partition: %v", err)
+	}
+
+	if err := env.ts.Tag(ctx, "latest", second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pi.Get(ctx, first.Digest, "0.0.1.1"); err != distribution.ErrPartitionUnknown {
+		t.Fatalf("expected ErrPartitionUnknown after moving the tag, got %v", err)
+	}
+}
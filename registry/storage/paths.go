@@ -29,9 +29,17 @@ const (
 //	│       └── <split directory content addressable storage>
 //	└── repositories
 //	    └── <name>
+//	        ├── _flattened
+//	        │   └── <allotment set digest path>
+//	        │       ├── link
+//	        │       └── diffid
 //	        ├── _layers
 //	        │   └── <layer links to blob store>
 //	        ├── _manifests
+//	        │   ├── partitions
+//	        │   │   └── <source manifest digest path>
+//	        │   │       └── <partition set digest path>
+//	        │   │           └── link
 //	        │   ├── revisions
 //	        │   │   └── <manifest digest path>
 //	        │   │       └── link
@@ -73,7 +81,9 @@ const (
 // implied as to the ordering of changes to a manifest. The tag store provides
 // support for name, tag lookups of manifests, using "current/link" under a
 // named tag directory. An index is maintained to support deletions of all
-// revisions of a given manifest tag.
+// revisions of a given manifest tag. Finally, the partitions directory maps a
+// 2dfs source manifest and a normalized partition set, identified by its
+// digest, to the manifest derived from them.
 //
 // We cover the path formats implemented by this path mapper below.
 //
@@ -97,6 +107,18 @@ const (
 //	manifestTagIndexEntryPathSpec:         <root>/v2/repositories/<name>/_manifests/tags/<tag>/index/<algorithm>/<hex digest>/
 //	manifestTagIndexEntryLinkPathSpec:     <root>/v2/repositories/<name>/_manifests/tags/<tag>/index/<algorithm>/<hex digest>/link
 //
+//	Partitions:
+//
+//	manifestPartitionSourcesPathSpec:      <root>/v2/repositories/<name>/_manifests/partitions/
+//	manifestPartitionsPathSpec:            <root>/v2/repositories/<name>/_manifests/partitions/<algorithm>/<hex digest>/
+//	manifestPartitionLinkPathSpec:         <root>/v2/repositories/<name>/_manifests/partitions/<algorithm>/<hex digest>/<algorithm>/<hex partition set digest>/link
+//
+//	Flattened layers:
+//
+//	flattenedLayersPathSpec:               <root>/v2/repositories/<name>/_flattened/
+//	flattenedLayerLinkPathSpec:            <root>/v2/repositories/<name>/_flattened/<algorithm>/<hex allotment set digest>/link
+//	flattenedLayerDiffIDPathSpec:          <root>/v2/repositories/<name>/_flattened/<algorithm>/<hex allotment set digest>/diffid
+//
 //	Blobs:
 //
 //	layerLinkPathSpec:            <root>/v2/repositories/<name>/_layers/<algorithm>/<hex digest>/link
@@ -201,6 +223,46 @@ func pathFor(spec pathSpec) (string, error) {
 		}
 
 		return path.Join(root, path.Join(components...)), nil
+	case manifestPartitionSourcesPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_manifests", "partitions")...), nil
+	case manifestPartitionsPathSpec:
+		components, err := digestPathComponents(v.source, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(append(append(repoPrefix, v.name, "_manifests", "partitions"), components...)...), nil
+	case manifestPartitionLinkPathSpec:
+		root, err := pathFor(manifestPartitionsPathSpec{
+			name:   v.name,
+			source: v.source,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		components, err := digestPathComponents(digest.FromString(v.partitions), false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, path.Join(components...), "link"), nil
+	case flattenedLayersPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_flattened")...), nil
+	case flattenedLayerLinkPathSpec:
+		components, err := digestPathComponents(v.key, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(append(append(repoPrefix, v.name, "_flattened"), append(components, "link")...)...), nil
+	case flattenedLayerDiffIDPathSpec:
+		components, err := digestPathComponents(v.key, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(append(append(repoPrefix, v.name, "_flattened"), append(components, "diffid")...)...), nil
 	case layerLinkPathSpec:
 		components, err := digestPathComponents(v.digest, false)
 		if err != nil {
@@ -353,6 +415,60 @@ type manifestTagIndexEntryLinkPathSpec struct {
 
 func (manifestTagIndexEntryLinkPathSpec) pathSpec() {}
 
+// manifestPartitionSourcesPathSpec describes the directory holding the
+// manifests derived by partitioning for every 2dfs source manifest.
+type manifestPartitionSourcesPathSpec struct {
+	name string
+}
+
+func (manifestPartitionSourcesPathSpec) pathSpec() {}
+
+// manifestPartitionsPathSpec describes the directory holding the manifests
+// derived from a 2dfs source manifest by partitioning.
+type manifestPartitionsPathSpec struct {
+	name   string
+	source digest.Digest
+}
+
+func (manifestPartitionsPathSpec) pathSpec() {}
+
+// manifestPartitionLinkPathSpec describes the link to the manifest derived
+// from a 2dfs source manifest for a normalized partition set. The partition
+// set is addressed by its digest to keep the path safe for every driver.
+type manifestPartitionLinkPathSpec struct {
+	name       string
+	source     digest.Digest
+	partitions string
+}
+
+func (manifestPartitionLinkPathSpec) pathSpec() {}
+
+// flattenedLayersPathSpec describes the directory holding the layers
+// flattened from allotments.
+type flattenedLayersPathSpec struct {
+	name string
+}
+
+func (flattenedLayersPathSpec) pathSpec() {}
+
+// flattenedLayerLinkPathSpec describes the link to the layer flattened from
+// a set of allotments, addressed by the digest of the set.
+type flattenedLayerLinkPathSpec struct {
+	name string
+	key  digest.Digest
+}
+
+func (flattenedLayerLinkPathSpec) pathSpec() {}
+
+// flattenedLayerDiffIDPathSpec describes the file holding the diffID of the
+// layer flattened from a set of allotments.
+type flattenedLayerDiffIDPathSpec struct {
+	name string
+	key  digest.Digest
+}
+
+func (flattenedLayerDiffIDPathSpec) pathSpec() {}
+
 // layersPathSpec contains the path for the layers inside a repo
 type layersPathSpec struct {
 	name string
@@ -52,6 +52,47 @@ func TestPathMapper(t *testing.T) {
 			},
 			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/tags/thetag/index",
 		},
+		{
+			spec: manifestPartitionSourcesPathSpec{
+				name: "foo/bar",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/partitions",
+		},
+		{
+			spec: manifestPartitionsPathSpec{
+				name:   "foo/bar",
+				source: "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/partitions/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+		},
+		{
+			spec: manifestPartitionLinkPathSpec{
+				name:       "foo/bar",
+				source:     "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+				partitions: "0.0.1.1",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/partitions/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/sha256/a3a35307ef68c12aee3a437612f50ce59551b25ed06329b676883e56af0f9003/link",
+		},
+		{
+			spec: flattenedLayersPathSpec{
+				name: "foo/bar",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_flattened",
+		},
+		{
+			spec: flattenedLayerLinkPathSpec{
+				name: "foo/bar",
+				key:  "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_flattened/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/link",
+		},
+		{
+			spec: flattenedLayerDiffIDPathSpec{
+				name: "foo/bar",
+				key:  "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_flattened/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/diffid",
+		},
 		{
 			spec: manifestTagIndexEntryPathSpec{
 				name:     "foo/bar",
@@ -77,6 +77,15 @@ func (ts *tagStore) Tag(ctx context.Context, tag string, desc v1.Descriptor) err
 		return err
 	}
 
+	// Invalidate the manifests derived from the previous revision, if the
+	// tag is being moved.
+	previous, err := ts.blobStore.readlink(ctx, currentPath)
+	if err == nil && previous != desc.Digest {
+		if err := ts.repository.PartitionIndex(ts.repository.Named()).Clear(ctx, previous); err != nil {
+			return err
+		}
+	}
+
 	// Overwrite the current link
 	return ts.blobStore.link(ctx, currentPath, desc.Digest)
 }
@@ -115,3 +115,15 @@ func (v Vacuum) RemoveLayer(repoName string, dgst digest.Digest) error {
 
 	return nil
 }
+
+// RemoveLink removes the directory of a derived manifest or flattened layer
+// link from the storage
+func (v Vacuum) RemoveLink(dir string) error {
+	dcontext.GetLogger(v.ctx).Infof("Deleting link path: %s", dir)
+	err := v.driver.Delete(v.ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}